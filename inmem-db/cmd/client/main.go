@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// printResponse reads one RESP reply from reader and prints it, one line
+// per simple value, with array elements indented under their header.
+func printResponse(reader *bufio.Reader, indent string) error {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	line = strings.TrimRight(line, "\r\n")
+	if line == "" {
+		return nil
+	}
+	switch line[0] {
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			fmt.Println(indent + "(nil)")
+			return err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(reader, buf); err != nil {
+			return err
+		}
+		fmt.Printf("%s%q\n", indent, buf[:n])
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			fmt.Println(indent + "(nil)")
+			return err
+		}
+		if n == 0 {
+			fmt.Println(indent + "(empty array)")
+		}
+		for i := 0; i < n; i++ {
+			if err := printResponse(reader, indent+"  "); err != nil {
+				return err
+			}
+		}
+	default:
+		fmt.Println(indent + line)
+	}
+	return nil
+}
+
+func main() {
+	host := flag.String("host", "localhost", "server host")
+	port := flag.Int("port", 6379, "server port")
+	flag.Parse()
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(*host, strconv.Itoa(*port)))
+	if err != nil {
+		fmt.Println("Error connecting to server:", err)
+		return
+	}
+	defer func(conn net.Conn) {
+		err := conn.Close()
+		if err != nil {
+			fmt.Println("Error closing connection", err)
+		}
+	}(conn)
+
+	reader := bufio.NewReader(os.Stdin)
+	writer := bufio.NewWriter(conn)
+	replies := bufio.NewReader(conn)
+
+	for {
+		fmt.Print("> ")
+		cmd, err := reader.ReadString('\n') // Read input from user
+		cmd = strings.TrimRight(cmd, "\r\n")
+		if cmd == "" {
+			if err != nil {
+				return
+			}
+			continue
+		}
+		_, err = fmt.Fprint(writer, cmd)
+		if err != nil {
+			fmt.Println("Error from server", err)
+			return
+		} // Send command to server
+		_, err = writer.WriteString("\r\n")
+		if err != nil {
+			fmt.Println("Error: ", err)
+			return
+		} // Add newline after the command
+		err = writer.Flush()
+		if err != nil {
+			fmt.Println(err)
+			return
+		} // Flush writer to send data immediately
+
+		// Print the response
+		if err := printResponse(replies, ""); err != nil {
+			fmt.Println("Error reading response:", err)
+			return
+		}
+	}
+}
@@ -2,7 +2,4 @@ module inmem-db/m
 
 go 1.22.0
 
-require (
-	github.com/google/go-cmp v0.6.0 // indirect
-	github.com/tidwall/resp v0.1.1 // indirect
-)
+require github.com/yuin/gopher-lua v1.1.1
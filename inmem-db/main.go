@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"inmem-db/m/server"
+)
+
+func main() {
+	enableDebug := flag.Bool("enable-debug-command", false, "allow DEBUG subcommands such as DEBUG PANIC")
+	healthAddr := flag.String("health-addr", "", "serve an HTTP /health endpoint on this address")
+	appendOnly := flag.Bool("appendonly", false, "log write commands to an append-only file and replay it on startup")
+	appendFilename := flag.String("appendfilename", "appendonly.aof", "path of the append-only file")
+	appendFsync := flag.String("appendfsync", server.FsyncEverysec, "when to fsync the append-only file: always, everysec or no")
+	dbFilename := flag.String("dbfilename", server.DefaultDumpPath, "snapshot file written by SAVE and BGSAVE and loaded on startup")
+	save := flag.String("save", "", `save points as "seconds changes ...": BGSAVE once that many writes have happened and that many seconds have passed since the last save`)
+	host := flag.String("host", "", "interface to listen on; empty means all interfaces")
+	port := flag.Int("port", server.DefaultPort, "TCP port to listen on")
+	addr := flag.String("addr", "", "host:port to listen on, overriding -host and -port")
+	flag.Parse()
+
+	db := server.NewDatabase()
+	if *enableDebug {
+		db.EnableDebugCommands()
+	}
+	db.SetDumpPath(*dbFilename)
+	if err := db.SetSavePoints(*save); err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	// Serve /health before loading, so it reports 503 until the load is
+	// done and the listener is up.
+	if *healthAddr != "" {
+		mux := http.NewServeMux()
+		mux.HandleFunc("/health", db.Health)
+		go func() {
+			if err := http.ListenAndServe(*healthAddr, mux); err != nil {
+				fmt.Println("Error serving health endpoint:", err)
+			}
+		}()
+	}
+
+	if *appendOnly {
+		// The AOF holds every write, so it alone rebuilds the dataset.
+		if err := db.OpenAOF(*appendFilename, *appendFsync); err != nil {
+			fmt.Println("Error loading AOF:", err)
+			return
+		}
+	} else if err := db.LoadSnapshot(*dbFilename); err != nil {
+		fmt.Println("Error loading snapshot:", err)
+		return
+	}
+
+	listenAddr := *addr
+	if listenAddr == "" {
+		listenAddr = net.JoinHostPort(*host, strconv.Itoa(*port))
+	}
+	listener, err := db.Listen(listenAddr)
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	defer listener.Close()
+	db.Serve(listener)
+}
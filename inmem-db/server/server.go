@@ -0,0 +1,6913 @@
+// Package server is the in-memory database and its RESP server. The
+// inmem-db command runs it; other programs can embed it, and the
+// testserver package starts a throwaway instance for tests.
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"container/heap"
+	"context"
+	"crypto/sha1"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	lua "github.com/yuin/gopher-lua"
+)
+
+// Store holds the string keyspace. Command handlers reach string values
+// only through it, so a different backend can be used in place of the
+// in-memory map. It covers strings only: sorted sets, hashes, lists and
+// sets, along with expiry and access times, stay in the Database's own
+// maps. A Store is only used while db.mu is held, so implementations need
+// not be safe for concurrent use.
+type Store interface {
+	Get(key string) (string, bool)
+	Set(key, value string)
+	// Del removes key, reporting whether it was present.
+	Del(key string) bool
+	Len() int
+	// Iterate calls fn for each entry until fn returns false. The Store
+	// is not modified while Iterate runs.
+	Iterate(fn func(key, value string) bool)
+	// Clear removes every entry. FLUSHALL calls it while holding db.mu,
+	// so it should not take time proportional to the number of entries.
+	Clear()
+}
+
+// mapStore is the default Store, backed by a plain map.
+type mapStore struct {
+	m map[string]string
+}
+
+func newMapStore() *mapStore {
+	return &mapStore{m: make(map[string]string)}
+}
+
+func (s *mapStore) Get(key string) (string, bool) {
+	value, ok := s.m[key]
+	return value, ok
+}
+
+func (s *mapStore) Set(key, value string) {
+	s.m[key] = value
+}
+
+func (s *mapStore) Del(key string) bool {
+	_, ok := s.m[key]
+	delete(s.m, key)
+	return ok
+}
+
+func (s *mapStore) Len() int {
+	return len(s.m)
+}
+
+func (s *mapStore) Iterate(fn func(key, value string) bool) {
+	for key, value := range s.m {
+		if !fn(key, value) {
+			return
+		}
+	}
+}
+
+// Clear swaps in an empty map and leaves the old one to the collector.
+func (s *mapStore) Clear() {
+	s.m = make(map[string]string)
+}
+
+type Database struct {
+	data      Store
+	expiry    map[string]time.Time
+	sortedSet map[string]*zset
+	hashes    map[string]map[string]string
+	lists     map[string][]string
+	sets      map[string]map[string]struct{}
+	accessed  map[string]time.Time
+
+	// ttlHeap orders the keys in expiry by deadline so the sweeper can
+	// find the keys that are due without scanning them all. ttlEntries
+	// locates each key's entry in it. Both are kept in step with expiry
+	// by setExpiry and clearExpiry.
+	ttlHeap    expiryHeap
+	ttlEntries map[string]*expiryEntry
+
+	// mu guards the keyspace and settings below. Commands that only read
+	// take the read lock; anything that may lazily delete an expired key
+	// or record an access, including GET, takes the write lock.
+	mu sync.RWMutex
+
+	// now is the clock key expiry, TTLs and idle times are measured
+	// against: time.Now unless SetClock replaced it.
+	now func() time.Time
+
+	// maxArgs caps the number of arguments, including the command name,
+	// accepted in one command. Zero disables the limit.
+	maxArgs int
+
+	// keysWarnThreshold is the KEYS result size above which a warning is
+	// logged. Zero disables the warning.
+	keysWarnThreshold int
+
+	// rateLimit caps the commands per second each connection may send.
+	// Zero disables the limit. It can be changed with CONFIG SET.
+	rateLimit int
+
+	// debugCommands enables DEBUG subcommands that can disrupt the
+	// server, such as DEBUG PANIC.
+	debugCommands bool
+
+	// forcedEncoding pins the encoding reported for a key, as set by
+	// DEBUG SET-ENCODING, until the key is deleted.
+	forcedEncoding map[string]string
+
+	// listener and conns are tracked so SHUTDOWN can close them; exit
+	// ends the process and is replaceable so SHUTDOWN can be exercised
+	// without os.Exit.
+	listener net.Listener
+	conns    map[net.Conn]*client
+	exit     func(code int)
+
+	nextClientID int64
+
+	// ready is set once the server accepts commands and cleared when it
+	// starts shutting down. The health endpoint reports it. It is not
+	// guarded by db.mu, so /health answers while a load holds the lock.
+	ready atomic.Bool
+
+	// channels and patterns map each pub/sub channel and pattern to its
+	// subscribers. A subscriber list is never changed in place:
+	// subscribing and unsubscribing replace it, so PUBLISH can take the
+	// lists under the read lock and deliver to them after releasing it.
+	channels map[string][]*client
+	patterns map[string][]*client
+
+	// keyspaceEvents is the notify-keyspace-events setting as notify*
+	// flags. Zero disables keyspace notifications.
+	keyspaceEvents int
+
+	// pubsubQueueLimit caps the messages queued for each subscriber; zero
+	// disables the limit. pubsubOverflow is what happens to a subscriber
+	// that reaches it: overflowDisconnect or overflowDropOldest.
+	pubsubQueueLimit int
+	pubsubOverflow   string
+
+	// waiters holds, per key, the channels of clients blocked until
+	// something can be popped from that key.
+	waiters map[string][]chan struct{}
+
+	// aof, if not nil, is the append-only file every successful write
+	// command is logged to. It is set by OpenAOF before the server
+	// accepts connections and not changed after.
+	aof *aof
+
+	// writeMu is held, while the AOF is on, from the start of each write
+	// command until it has been appended, so the file records writes in
+	// the order they were applied. It is taken before db.mu.
+	writeMu sync.Mutex
+
+	// scriptMu makes scripts atomic: every other command holds it for
+	// reading while it runs, and EVAL and EVALSHA hold it for writing, so
+	// nothing else runs until a script returns. It is taken before
+	// writeMu and db.mu.
+	scriptMu sync.RWMutex
+
+	// scripts caches scripts by SHA1 digest for EVALSHA.
+	scripts map[string]string
+
+	// script is the script EVAL or EVALSHA is running, or nil. It is
+	// read without scriptMu, which the script holds, so other commands
+	// can see that it is running and SCRIPT KILL can stop it.
+	script atomic.Pointer[runningScript]
+
+	// busyReplyThreshold is how long, in milliseconds, a script may run
+	// before other commands are refused with BUSY instead of waiting for
+	// it. Zero lets them wait however long the script takes.
+	busyReplyThreshold int
+
+	// dumpPath is the snapshot file SAVE and BGSAVE write. bgsaving is
+	// set while a BGSAVE is writing it.
+	dumpPath string
+	bgsaving bool
+
+	// savePoints start a BGSAVE once enough writes have happened since
+	// lastSave. dirty counts the writes since the last successful save and
+	// is updated without db.mu. A failed BGSAVE holds the save points off
+	// until saveRetryAt.
+	savePoints  []savePoint
+	lastSave    time.Time
+	saveRetryAt time.Time
+	dirty       atomic.Int64
+
+	// lazyfreeQueue holds values detached from the keyspace by UNLINK and
+	// FLUSHALL ASYNC until the lazyfree worker releases them, and
+	// lazyfreeWake wakes the worker. lazyfreePending counts the values
+	// queued or being released, lazyfreed those released so far. All
+	// four are guarded by lazyfreeMu rather than db.mu.
+	lazyfreeMu      sync.Mutex
+	lazyfreeQueue   []any
+	lazyfreeWake    chan struct{}
+	lazyfreePending int
+	lazyfreed       int
+
+	// done is closed by Close to stop the expiry sweeper and the lazyfree
+	// worker.
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// client is the state kept for each connection. Only the connection's own
+// goroutine writes it, and the fields CLIENT LIST shows are written while
+// holding db.mu so other connections can read them under the lock.
+// CLIENT KILL, also holding db.mu, calls kill; publishers queue messages
+// under outMu and may do so without db.mu.
+type client struct {
+	id         int64
+	conn       net.Conn
+	addr       string
+	name       string
+	created    time.Time
+	lastActive time.Time
+	lastCmd    string
+
+	// tokens and refilled are the connection's rate limit bucket.
+	tokens   float64
+	refilled time.Time
+
+	// replies feeds the connection's writer goroutine with command
+	// replies. Pub/sub messages wait in messages instead, so the overflow
+	// policy only ever drops messages, and wake tells the writer one has
+	// been queued. The writer is the only goroutine writing to the
+	// connection, so replies and messages are never interleaved.
+	replies chan<- string
+
+	// outMu guards messages. It is also held, along with db.mu, while
+	// subscriptions and patterns change, so a publisher holding only outMu
+	// can tell whether the client is still subscribed.
+	outMu    sync.Mutex
+	messages []string
+	wake     chan struct{}
+
+	// subscriptions and patterns are the channels and glob patterns the
+	// client is subscribed to. While either is non-empty only the pub/sub
+	// commands are accepted.
+	subscriptions map[string]bool
+	patterns      map[string]bool
+
+	// blocked is set while the client waits in a blocking command.
+	blocked bool
+
+	// killed is closed by kill so a blocked command gives up waiting.
+	killed   chan struct{}
+	killOnce sync.Once
+
+	// closeAfterReply is set when the client kills itself, so the
+	// connection closes once the reply is sent.
+	closeAfterReply bool
+}
+
+// resetConnState returns c to the state of a new connection, for RESET and
+// when the connection closes: it drops every subscription and any messages
+// still queued for them, and clears the client name. The rate limit bucket
+// is kept, so RESET cannot be used to skip the limit. The caller must hold
+// db.mu.
+func (db *Database) resetConnState(c *client) {
+	db.unsubscribe(c, nil, false)
+	db.unsubscribe(c, nil, true)
+	c.outMu.Lock()
+	c.messages = nil
+	c.outMu.Unlock()
+	c.name = ""
+}
+
+// subscriptionCount is how many channels and patterns c is subscribed to.
+func (c *client) subscriptionCount() int {
+	return len(c.subscriptions) + len(c.patterns)
+}
+
+// kill closes c's connection and wakes it if it is blocked. Only the
+// first call has any effect.
+func (c *client) kill() {
+	c.killOnce.Do(func() {
+		close(c.killed)
+		c.conn.Close()
+	})
+}
+
+const (
+	// defaultMaxArgs is the default per-command argument limit.
+	defaultMaxArgs = 1024 * 1024
+
+	// defaultKeysWarnThreshold is the default KEYS result size that
+	// triggers a warning.
+	defaultKeysWarnThreshold = 10000
+
+	// replyQueueSize is how many replies may wait for a connection's
+	// writer.
+	replyQueueSize = 1024
+
+	// defaultPubsubQueueLimit is how many pub/sub messages may wait for a
+	// subscriber's writer before the overflow policy applies.
+	defaultPubsubQueueLimit = 1024
+
+	// defaultBusyReplyThreshold is how long, in milliseconds, a script
+	// runs before other commands get BUSY, as in Redis.
+	defaultBusyReplyThreshold = 5000
+
+	// DefaultPort is the TCP port the server listens on by default.
+	DefaultPort = 6379
+
+	// DefaultDumpPath is the default snapshot file.
+	DefaultDumpPath = "dump.gob"
+)
+
+// commandSpec is the registry entry for a command. Arity follows the Redis
+// convention: a positive value is the exact argument count including the
+// command name, a negative one is the minimum. handleCommand enforces it
+// before dispatching, so handlers only check what arity cannot express.
+// firstKey, lastKey and step locate the key arguments; a negative lastKey
+// counts from the end.
+type commandSpec struct {
+	arity    int
+	flags    []string
+	firstKey int
+	lastKey  int
+	step     int
+}
+
+// acceptsArgs reports whether n arguments, including the command name,
+// satisfy the command's arity.
+func (spec commandSpec) acceptsArgs(n int) bool {
+	if spec.arity < 0 {
+		return n >= -spec.arity
+	}
+	return n == spec.arity
+}
+
+// keys returns the key arguments in parts, which must satisfy the arity.
+func (spec commandSpec) keys(parts []string) []string {
+	if spec.firstKey == 0 {
+		return nil
+	}
+	last := spec.lastKey
+	if last < 0 {
+		last += len(parts)
+	}
+	var keys []string
+	for i := spec.firstKey; i <= last; i += spec.step {
+		keys = append(keys, parts[i])
+	}
+	return keys
+}
+
+// commandTable is the command registry, keyed by lowercase command name.
+var commandTable = map[string]commandSpec{
+	"get":              {2, []string{"readonly", "fast"}, 1, 1, 1},
+	"set":              {-3, []string{"write", "denyoom"}, 1, 1, 1},
+	"del":              {-2, []string{"write"}, 1, -1, 1},
+	"exists":           {-2, []string{"readonly", "fast"}, 1, -1, 1},
+	"unlink":           {-2, []string{"write", "fast"}, 1, -1, 1},
+	"rename":           {3, []string{"write"}, 1, 2, 1},
+	"renamenx":         {3, []string{"write", "fast"}, 1, 2, 1},
+	"expire":           {3, []string{"write", "fast"}, 1, 1, 1},
+	"pexpire":          {3, []string{"write", "fast"}, 1, 1, 1},
+	"pexpireat":        {3, []string{"write", "fast"}, 1, 1, 1},
+	"keys":             {-2, []string{"readonly"}, 0, 0, 0},
+	"scan":             {-2, []string{"readonly"}, 0, 0, 0},
+	"persist":          {2, []string{"write", "fast"}, 1, 1, 1},
+	"ttl":              {2, []string{"readonly", "fast"}, 1, 1, 1},
+	"pttl":             {2, []string{"readonly", "fast"}, 1, 1, 1},
+	"zadd":             {-4, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"zrange":           {-4, []string{"readonly"}, 1, 1, 1},
+	"zrevrange":        {-4, []string{"readonly"}, 1, 1, 1},
+	"zrangebyscore":    {-4, []string{"readonly"}, 1, 1, 1},
+	"zrevrangebyscore": {-4, []string{"readonly"}, 1, 1, 1},
+	"zrangebylex":      {-4, []string{"readonly"}, 1, 1, 1},
+	"zrevrangebylex":   {-4, []string{"readonly"}, 1, 1, 1},
+	"zincrby":          {4, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"zscore":           {3, []string{"readonly", "fast"}, 1, 1, 1},
+	"zrem":             {-3, []string{"write", "fast"}, 1, 1, 1},
+	"zcard":            {2, []string{"readonly", "fast"}, 1, 1, 1},
+	"zrank":            {3, []string{"readonly", "fast"}, 1, 1, 1},
+	"zrevrank":         {3, []string{"readonly", "fast"}, 1, 1, 1},
+	"zmpop":            {-4, []string{"write", "movablekeys"}, 0, 0, 0},
+	"bzmpop":           {-5, []string{"write", "blocking", "movablekeys"}, 0, 0, 0},
+	"blmpop":           {-5, []string{"write", "blocking", "movablekeys"}, 0, 0, 0},
+	"getex":            {-2, []string{"write", "fast"}, 1, 1, 1},
+	"mset":             {-3, []string{"write", "denyoom"}, 1, -1, 2},
+	"mget":             {-2, []string{"readonly", "fast"}, 1, -1, 1},
+	"setnx":            {3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"getset":           {3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"append":           {3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"strlen":           {2, []string{"readonly", "fast"}, 1, 1, 1},
+	"getrange":         {4, []string{"readonly"}, 1, 1, 1},
+	"setrange":         {4, []string{"write", "denyoom"}, 1, 1, 1},
+	"hset":             {-4, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"hget":             {3, []string{"readonly", "fast"}, 1, 1, 1},
+	"hdel":             {-3, []string{"write", "fast"}, 1, 1, 1},
+	"hincrbyfloat":     {4, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"hgetall":          {2, []string{"readonly"}, 1, 1, 1},
+	"hexists":          {3, []string{"readonly", "fast"}, 1, 1, 1},
+	"hkeys":            {2, []string{"readonly"}, 1, 1, 1},
+	"hvals":            {2, []string{"readonly"}, 1, 1, 1},
+	"hlen":             {2, []string{"readonly", "fast"}, 1, 1, 1},
+	"lpush":            {-3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"rpush":            {-3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"lpop":             {2, []string{"write", "fast"}, 1, 1, 1},
+	"rpop":             {2, []string{"write", "fast"}, 1, 1, 1},
+	"llen":             {2, []string{"readonly", "fast"}, 1, 1, 1},
+	"lmpop":            {-4, []string{"write", "movablekeys"}, 0, 0, 0},
+	"lrange":           {4, []string{"readonly"}, 1, 1, 1},
+	"lindex":           {3, []string{"readonly"}, 1, 1, 1},
+	"sadd":             {-3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"srem":             {-3, []string{"write", "fast"}, 1, 1, 1},
+	"smembers":         {2, []string{"readonly"}, 1, 1, 1},
+	"sismember":        {3, []string{"readonly", "fast"}, 1, 1, 1},
+	"scard":            {2, []string{"readonly", "fast"}, 1, 1, 1},
+	"sunion":           {-2, []string{"readonly"}, 1, -1, 1},
+	"sinter":           {-2, []string{"readonly"}, 1, -1, 1},
+	"sdiff":            {-2, []string{"readonly"}, 1, -1, 1},
+	"bitpos":           {-3, []string{"readonly"}, 1, 1, 1},
+	"bitfield":         {-2, []string{"write", "denyoom"}, 1, 1, 1},
+	"type":             {2, []string{"readonly", "fast"}, 1, 1, 1},
+	"object":           {-2, []string{"readonly"}, 2, 2, 1},
+	"memory":           {-2, []string{"readonly"}, 0, 0, 0},
+	"debug":            {-2, []string{"admin", "noscript"}, 0, 0, 0},
+	"shutdown":         {-1, []string{"admin", "noscript"}, 0, 0, 0},
+	"save":             {1, []string{"admin", "noscript"}, 0, 0, 0},
+	"bgsave":           {1, []string{"admin", "noscript"}, 0, 0, 0},
+	"command":          {-1, []string{"loading", "stale"}, 0, 0, 0},
+	"info":             {-1, []string{"loading", "stale"}, 0, 0, 0},
+	"dbsize":           {1, []string{"readonly", "fast"}, 0, 0, 0},
+	"flushdb":          {-1, []string{"write"}, 0, 0, 0},
+	"flushall":         {-1, []string{"write"}, 0, 0, 0},
+	"pexpirepattern":   {3, []string{"write"}, 0, 0, 0},
+	"cas":              {4, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"incr":             {2, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"decr":             {2, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"incrby":           {3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"decrby":           {3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"incrbyfloat":      {3, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"increx":           {4, []string{"write", "denyoom", "fast"}, 1, 1, 1},
+	"client":           {-2, []string{"admin", "noscript", "loading", "stale"}, 0, 0, 0},
+	"subscribe":        {-2, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+	"unsubscribe":      {-1, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+	"psubscribe":       {-2, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+	"punsubscribe":     {-1, []string{"pubsub", "noscript", "loading", "stale"}, 0, 0, 0},
+	"publish":          {3, []string{"pubsub", "loading", "stale", "fast"}, 0, 0, 0},
+	"pubsub":           {-2, []string{"pubsub", "loading", "stale"}, 0, 0, 0},
+	"config":           {-2, []string{"admin", "noscript", "loading", "stale"}, 0, 0, 0},
+	"quit":             {-1, []string{"fast", "loading", "stale"}, 0, 0, 0},
+	"reset":            {1, []string{"noscript", "fast", "loading", "stale"}, 0, 0, 0},
+	"eval":             {-3, []string{"noscript", "stale", "movablekeys"}, 0, 0, 0},
+	"evalsha":          {-3, []string{"noscript", "stale", "movablekeys"}, 0, 0, 0},
+	"script":           {-2, []string{"noscript"}, 0, 0, 0},
+}
+
+// commandArg documents one argument of a command for COMMAND DOCS. oneof
+// and block arguments list their members in args.
+type commandArg struct {
+	name     string
+	typ      string
+	token    string
+	optional bool
+	multiple bool
+	args     []commandArg
+}
+
+// commandDoc is the COMMAND DOCS metadata for a registered command.
+type commandDoc struct {
+	summary string
+	since   string
+	group   string
+	args    []commandArg
+}
+
+var (
+	keyArg        = commandArg{name: "key", typ: "key"}
+	withScoresArg = commandArg{name: "withscores", typ: "pure-token", token: "WITHSCORES", optional: true}
+	limitArg      = commandArg{name: "limit", typ: "block", token: "LIMIT", optional: true, args: []commandArg{
+		{name: "offset", typ: "integer"},
+		{name: "count", typ: "integer"},
+	}}
+	flushModeArg = commandArg{name: "flush-type", typ: "oneof", optional: true, args: []commandArg{
+		{name: "async", typ: "pure-token", token: "ASYNC"},
+		{name: "sync", typ: "pure-token", token: "SYNC"},
+	}}
+)
+
+// commandDocs holds the documentation for each entry in commandTable.
+var commandDocs = map[string]commandDoc{
+	"get": {"Returns the string value of a key.", "1.0.0", "string", []commandArg{keyArg}},
+	"set": {"Sets the string value of a key, ignoring its type. The key is created if it doesn't exist.", "1.0.0", "string", []commandArg{
+		keyArg,
+		{name: "value", typ: "string"},
+		{name: "condition", typ: "oneof", optional: true, args: []commandArg{
+			{name: "nx", typ: "pure-token", token: "NX"},
+			{name: "xx", typ: "pure-token", token: "XX"},
+		}},
+		{name: "expiration", typ: "oneof", optional: true, args: []commandArg{
+			{name: "seconds", typ: "integer", token: "EX"},
+			{name: "milliseconds", typ: "integer", token: "PX"},
+			{name: "keepttl", typ: "pure-token", token: "KEEPTTL"},
+		}},
+	}},
+	"del":    {"Deletes one or more keys.", "1.0.0", "generic", []commandArg{{name: "key", typ: "key", multiple: true}}},
+	"exists": {"Determines whether one or more keys exist.", "1.0.0", "generic", []commandArg{{name: "key", typ: "key", multiple: true}}},
+	"unlink": {"Asynchronously deletes one or more keys.", "4.0.0", "generic", []commandArg{{name: "key", typ: "key", multiple: true}}},
+	"rename": {"Renames a key and overwrites the destination.", "1.0.0", "generic", []commandArg{
+		keyArg,
+		{name: "newkey", typ: "key"},
+	}},
+	"renamenx": {"Renames a key only when the target key name doesn't exist.", "1.0.0", "generic", []commandArg{
+		keyArg,
+		{name: "newkey", typ: "key"},
+	}},
+	"expire": {"Sets the expiration time of a key in seconds.", "1.0.0", "generic", []commandArg{keyArg, {name: "seconds", typ: "integer"}}},
+	"keys": {"Returns all key names that match a pattern, optionally only those of a given type.", "1.0.0", "generic", []commandArg{
+		{name: "pattern", typ: "pattern"},
+		{name: "type", typ: "string", token: "TYPE", optional: true},
+	}},
+	"scan": {"Iterates over the key names in the database.", "2.8.0", "generic", []commandArg{
+		{name: "cursor", typ: "integer"},
+		{name: "pattern", typ: "pattern", token: "MATCH", optional: true},
+		{name: "count", typ: "integer", token: "COUNT", optional: true},
+		{name: "type", typ: "string", token: "TYPE", optional: true},
+	}},
+	"persist": {"Removes the expiration time of a key.", "2.2.0", "generic", []commandArg{keyArg}},
+	"ttl":     {"Returns the expiration time in seconds of a key.", "1.0.0", "generic", []commandArg{keyArg}},
+	"pttl":    {"Returns the expiration time in milliseconds of a key.", "2.6.0", "generic", []commandArg{keyArg}},
+	"pexpire": {"Sets the expiration time of a key in milliseconds.", "2.6.0", "generic", []commandArg{keyArg, {name: "milliseconds", typ: "integer"}}},
+	"pexpireat": {"Sets the expiration time of a key to a Unix milliseconds timestamp.", "2.6.0", "generic", []commandArg{
+		keyArg,
+		{name: "unix-time-milliseconds", typ: "unix-time"},
+	}},
+	"zadd": {"Adds one or more members to a sorted set, or updates their scores. Creates the key if it doesn't exist.", "1.2.0", "sorted-set", []commandArg{
+		keyArg,
+		{name: "condition", typ: "oneof", optional: true, args: []commandArg{
+			{name: "nx", typ: "pure-token", token: "NX"},
+			{name: "xx", typ: "pure-token", token: "XX"},
+		}},
+		{name: "comparison", typ: "oneof", optional: true, args: []commandArg{
+			{name: "gt", typ: "pure-token", token: "GT"},
+			{name: "lt", typ: "pure-token", token: "LT"},
+		}},
+		{name: "change", typ: "pure-token", token: "CH", optional: true},
+		{name: "increment", typ: "pure-token", token: "INCR", optional: true},
+		{name: "data", typ: "block", multiple: true, args: []commandArg{
+			{name: "score", typ: "double"},
+			{name: "member", typ: "string"},
+		}},
+	}},
+	"zrange": {"Returns members in a sorted set within a range of indexes, scores or lexicographical values.", "1.2.0", "sorted-set", []commandArg{
+		keyArg,
+		{name: "start", typ: "string"},
+		{name: "stop", typ: "string"},
+		{name: "sortby", typ: "oneof", optional: true, args: []commandArg{
+			{name: "byscore", typ: "pure-token", token: "BYSCORE"},
+			{name: "bylex", typ: "pure-token", token: "BYLEX"},
+		}},
+		{name: "rev", typ: "pure-token", token: "REV", optional: true},
+		limitArg,
+		withScoresArg,
+	}},
+	"zrevrange": {"Returns members in a sorted set within a range of indexes in reverse order.", "1.2.0", "sorted-set", []commandArg{
+		keyArg, {name: "start", typ: "integer"}, {name: "stop", typ: "integer"}, withScoresArg,
+	}},
+	"zrangebyscore": {"Returns members in a sorted set within a range of scores.", "1.0.5", "sorted-set", []commandArg{
+		keyArg, {name: "min", typ: "double"}, {name: "max", typ: "double"}, withScoresArg, limitArg,
+	}},
+	"zrevrangebyscore": {"Returns members in a sorted set within a range of scores in reverse order.", "2.2.0", "sorted-set", []commandArg{
+		keyArg, {name: "max", typ: "double"}, {name: "min", typ: "double"}, withScoresArg, limitArg,
+	}},
+	"zrangebylex": {"Returns members in a sorted set within a lexicographical range.", "2.8.9", "sorted-set", []commandArg{
+		keyArg, {name: "min", typ: "string"}, {name: "max", typ: "string"}, limitArg,
+	}},
+	"zrevrangebylex": {"Returns members in a sorted set within a lexicographical range in reverse order.", "2.8.9", "sorted-set", []commandArg{
+		keyArg, {name: "max", typ: "string"}, {name: "min", typ: "string"}, limitArg,
+	}},
+	"zincrby": {"Increments the score of a member in a sorted set.", "1.2.0", "sorted-set", []commandArg{
+		keyArg,
+		{name: "increment", typ: "double"},
+		{name: "member", typ: "string"},
+	}},
+	"zscore": {"Returns the score of a member in a sorted set.", "1.2.0", "sorted-set", []commandArg{
+		keyArg,
+		{name: "member", typ: "string"},
+	}},
+	"zrem": {"Removes one or more members from a sorted set. Deletes the sorted set if all members were removed.", "1.2.0", "sorted-set", []commandArg{
+		keyArg,
+		{name: "member", typ: "string", multiple: true},
+	}},
+	"zcard": {"Returns the number of members in a sorted set.", "1.2.0", "sorted-set", []commandArg{keyArg}},
+	"zrank": {"Returns the index of a member in a sorted set ordered by ascending scores.", "2.0.0", "sorted-set", []commandArg{
+		keyArg,
+		{name: "member", typ: "string"},
+	}},
+	"zrevrank": {"Returns the index of a member in a sorted set ordered by descending scores.", "2.0.0", "sorted-set", []commandArg{
+		keyArg,
+		{name: "member", typ: "string"},
+	}},
+	"zmpop": {"Returns the highest- or lowest-scoring members from one or more sorted sets after removing them.", "7.0.0", "sorted-set", []commandArg{
+		{name: "numkeys", typ: "integer"},
+		{name: "key", typ: "key", multiple: true},
+		{name: "where", typ: "oneof", args: []commandArg{
+			{name: "min", typ: "pure-token", token: "MIN"},
+			{name: "max", typ: "pure-token", token: "MAX"},
+		}},
+		{name: "count", typ: "integer", token: "COUNT", optional: true},
+	}},
+	"bzmpop": {"Removes and returns a member by score from one or more sorted sets. Blocks until a member is available otherwise.", "7.0.0", "sorted-set", []commandArg{
+		{name: "timeout", typ: "double"},
+		{name: "numkeys", typ: "integer"},
+		{name: "key", typ: "key", multiple: true},
+		{name: "where", typ: "oneof", args: []commandArg{
+			{name: "min", typ: "pure-token", token: "MIN"},
+			{name: "max", typ: "pure-token", token: "MAX"},
+		}},
+		{name: "count", typ: "integer", token: "COUNT", optional: true},
+	}},
+	"getex": {"Returns the string value of a key after setting its expiration time.", "6.2.0", "string", []commandArg{
+		keyArg,
+		{name: "expiration", typ: "oneof", optional: true, args: []commandArg{
+			{name: "seconds", typ: "integer", token: "EX"},
+			{name: "milliseconds", typ: "integer", token: "PX"},
+			{name: "persist", typ: "pure-token", token: "PERSIST"},
+		}},
+	}},
+	"mset": {"Atomically creates or modifies the string values of one or more keys.", "1.0.1", "string", []commandArg{
+		{name: "data", typ: "block", multiple: true, args: []commandArg{
+			keyArg,
+			{name: "value", typ: "string"},
+		}},
+	}},
+	"mget": {"Atomically returns the string values of one or more keys.", "1.0.0", "string", []commandArg{
+		{name: "key", typ: "key", multiple: true},
+	}},
+	"setnx": {"Set the string value of a key only when the key doesn't exist.", "1.0.0", "string", []commandArg{
+		keyArg,
+		{name: "value", typ: "string"},
+	}},
+	"getset": {"Returns the previous string value of a key after setting it to a new value.", "1.0.0", "string", []commandArg{
+		keyArg,
+		{name: "value", typ: "string"},
+	}},
+	"append": {"Appends a string to the value of a key. Creates the key if it doesn't exist.", "2.0.0", "string", []commandArg{
+		keyArg,
+		{name: "value", typ: "string"},
+	}},
+	"strlen": {"Returns the length of a string value.", "2.2.0", "string", []commandArg{keyArg}},
+	"getrange": {"Returns a substring of the string stored at a key.", "2.4.0", "string", []commandArg{
+		keyArg,
+		{name: "start", typ: "integer"},
+		{name: "end", typ: "integer"},
+	}},
+	"setrange": {"Overwrites a part of a string value with another by an offset. Creates the key if it doesn't exist.", "2.2.0", "string", []commandArg{
+		keyArg,
+		{name: "offset", typ: "integer"},
+		{name: "value", typ: "string"},
+	}},
+	"hset": {"Creates or modifies the value of a field in a hash.", "2.0.0", "hash", []commandArg{
+		keyArg,
+		{name: "data", typ: "block", multiple: true, args: []commandArg{
+			{name: "field", typ: "string"},
+			{name: "value", typ: "string"},
+		}},
+	}},
+	"hget": {"Returns the value of a field in a hash.", "2.0.0", "hash", []commandArg{
+		keyArg,
+		{name: "field", typ: "string"},
+	}},
+	"hdel": {"Deletes one or more fields and their values from a hash. Deletes the hash if no fields remain.", "2.0.0", "hash", []commandArg{
+		keyArg,
+		{name: "field", typ: "string", multiple: true},
+	}},
+	"hincrbyfloat": {"Increments the floating point value of a field by a number. Uses 0 as initial value if the field doesn't exist.", "2.6.0", "hash", []commandArg{
+		keyArg,
+		{name: "field", typ: "string"},
+		{name: "increment", typ: "double"},
+	}},
+	"hgetall": {"Returns all fields and values in a hash.", "2.0.0", "hash", []commandArg{keyArg}},
+	"hexists": {"Determines whether a field exists in a hash.", "2.0.0", "hash", []commandArg{
+		keyArg,
+		{name: "field", typ: "string"},
+	}},
+	"hkeys": {"Returns all fields in a hash.", "2.0.0", "hash", []commandArg{keyArg}},
+	"hvals": {"Returns all values in a hash.", "2.0.0", "hash", []commandArg{keyArg}},
+	"hlen":  {"Returns the number of fields in a hash.", "2.0.0", "hash", []commandArg{keyArg}},
+	"lpush": {"Prepends one or more elements to a list. Creates the key if it doesn't exist.", "1.0.0", "list", []commandArg{
+		keyArg,
+		{name: "element", typ: "string", multiple: true},
+	}},
+	"rpush": {"Appends one or more elements to a list. Creates the key if it doesn't exist.", "1.0.0", "list", []commandArg{
+		keyArg,
+		{name: "element", typ: "string", multiple: true},
+	}},
+	"lpop": {"Returns the first element of a list after removing it. Deletes the list if the last element was popped.", "1.0.0", "list", []commandArg{keyArg}},
+	"rpop": {"Returns and removes the last element of a list. Deletes the list if the last element was popped.", "1.0.0", "list", []commandArg{keyArg}},
+	"llen": {"Returns the length of a list.", "1.0.0", "list", []commandArg{keyArg}},
+	"lrange": {"Returns a range of elements from a list.", "1.0.0", "list", []commandArg{
+		keyArg,
+		{name: "start", typ: "integer"},
+		{name: "stop", typ: "integer"},
+	}},
+	"lindex": {"Returns an element from a list by its index.", "1.0.0", "list", []commandArg{
+		keyArg,
+		{name: "index", typ: "integer"},
+	}},
+	"lmpop": {"Returns multiple elements from a list after removing them. Deletes the list if the last element was popped.", "7.0.0", "list", []commandArg{
+		{name: "numkeys", typ: "integer"},
+		{name: "key", typ: "key", multiple: true},
+		{name: "where", typ: "oneof", args: []commandArg{
+			{name: "left", typ: "pure-token", token: "LEFT"},
+			{name: "right", typ: "pure-token", token: "RIGHT"},
+		}},
+		{name: "count", typ: "integer", token: "COUNT", optional: true},
+	}},
+	"blmpop": {"Pops the first element from one of multiple lists. Blocks until an element is available otherwise. Deletes the list if the last element was popped.", "7.0.0", "list", []commandArg{
+		{name: "timeout", typ: "double"},
+		{name: "numkeys", typ: "integer"},
+		{name: "key", typ: "key", multiple: true},
+		{name: "where", typ: "oneof", args: []commandArg{
+			{name: "left", typ: "pure-token", token: "LEFT"},
+			{name: "right", typ: "pure-token", token: "RIGHT"},
+		}},
+		{name: "count", typ: "integer", token: "COUNT", optional: true},
+	}},
+	"sadd": {"Adds one or more members to a set. Creates the key if it doesn't exist.", "1.0.0", "set", []commandArg{
+		keyArg,
+		{name: "member", typ: "string", multiple: true},
+	}},
+	"srem": {"Removes one or more members from a set. Deletes the set if the last member was removed.", "1.0.0", "set", []commandArg{
+		keyArg,
+		{name: "member", typ: "string", multiple: true},
+	}},
+	"smembers": {"Returns all members of a set.", "1.0.0", "set", []commandArg{keyArg}},
+	"sismember": {"Determines whether a member belongs to a set.", "1.0.0", "set", []commandArg{
+		keyArg,
+		{name: "member", typ: "string"},
+	}},
+	"scard": {"Returns the number of members in a set.", "1.0.0", "set", []commandArg{keyArg}},
+	"sunion": {"Returns the union of multiple sets.", "1.0.0", "set", []commandArg{
+		{name: "key", typ: "key", multiple: true},
+	}},
+	"sinter": {"Returns the intersect of multiple sets.", "1.0.0", "set", []commandArg{
+		{name: "key", typ: "key", multiple: true},
+	}},
+	"sdiff": {"Returns the difference of multiple sets.", "1.0.0", "set", []commandArg{
+		{name: "key", typ: "key", multiple: true},
+	}},
+	"bitpos": {"Finds the first set (1) or clear (0) bit in a string.", "2.8.7", "bitmap", []commandArg{
+		keyArg,
+		{name: "bit", typ: "integer"},
+		{name: "range", typ: "block", optional: true, args: []commandArg{
+			{name: "start", typ: "integer"},
+			{name: "end-unit-block", typ: "block", optional: true, args: []commandArg{
+				{name: "end", typ: "integer"},
+				{name: "unit", typ: "oneof", optional: true, args: []commandArg{
+					{name: "byte", typ: "pure-token", token: "BYTE"},
+					{name: "bit", typ: "pure-token", token: "BIT"},
+				}},
+			}},
+		}},
+	}},
+	"bitfield": {"Performs arbitrary bitfield integer operations on strings.", "3.2.0", "bitmap", []commandArg{
+		keyArg,
+		{name: "operation", typ: "oneof", optional: true, multiple: true, args: []commandArg{
+			{name: "get-block", typ: "block", token: "GET", args: []commandArg{
+				{name: "encoding", typ: "string"},
+				{name: "offset", typ: "integer"},
+			}},
+			{name: "overflow-block", typ: "oneof", token: "OVERFLOW", args: []commandArg{
+				{name: "wrap", typ: "pure-token", token: "WRAP"},
+				{name: "sat", typ: "pure-token", token: "SAT"},
+				{name: "fail", typ: "pure-token", token: "FAIL"},
+			}},
+			{name: "set-block", typ: "block", token: "SET", args: []commandArg{
+				{name: "encoding", typ: "string"},
+				{name: "offset", typ: "integer"},
+				{name: "value", typ: "integer"},
+			}},
+			{name: "incrby-block", typ: "block", token: "INCRBY", args: []commandArg{
+				{name: "encoding", typ: "string"},
+				{name: "offset", typ: "integer"},
+				{name: "increment", typ: "integer"},
+			}},
+		}},
+	}},
+	"type": {"Determines the type of value stored at a key.", "1.0.0", "generic", []commandArg{keyArg}},
+	"object": {"A container for object introspection commands.", "2.2.3", "generic", []commandArg{
+		{name: "subcommand", typ: "oneof", args: []commandArg{
+			{name: "encoding", typ: "pure-token", token: "ENCODING"},
+			{name: "idletime", typ: "pure-token", token: "IDLETIME"},
+			{name: "refcount", typ: "pure-token", token: "REFCOUNT"},
+		}},
+		keyArg,
+	}},
+	"memory": {"A container for memory diagnostics commands.", "4.0.0", "server", []commandArg{
+		{name: "subcommand", typ: "oneof", args: []commandArg{
+			{name: "usage", typ: "block", token: "USAGE", args: []commandArg{
+				keyArg,
+				{name: "count", typ: "integer", token: "SAMPLES", optional: true},
+			}},
+			{name: "stats", typ: "pure-token", token: "STATS"},
+		}},
+	}},
+	"debug": {"A container for debugging commands.", "1.0.0", "server", []commandArg{
+		{name: "subcommand", typ: "oneof", args: []commandArg{
+			{name: "object", typ: "pure-token", token: "OBJECT"},
+			{name: "panic", typ: "pure-token", token: "PANIC"},
+			{name: "set-encoding", typ: "pure-token", token: "SET-ENCODING"},
+			{name: "reload", typ: "pure-token", token: "RELOAD"},
+		}},
+		{name: "key", typ: "key", optional: true},
+		{name: "encoding", typ: "string", optional: true},
+	}},
+	"save":   {"Synchronously saves the database to disk.", "1.0.0", "server", nil},
+	"bgsave": {"Asynchronously saves the database to disk.", "1.0.0", "server", nil},
+	"shutdown": {"Closes all connections and shuts down the server.", "1.0.0", "server", []commandArg{
+		{name: "save-selector", typ: "oneof", optional: true, args: []commandArg{
+			{name: "nosave", typ: "pure-token", token: "NOSAVE"},
+			{name: "save", typ: "pure-token", token: "SAVE"},
+		}},
+	}},
+	"command": {"Returns detailed information about all commands.", "2.8.13", "server", []commandArg{
+		{name: "subcommand", typ: "oneof", optional: true, args: []commandArg{
+			{name: "count", typ: "pure-token", token: "COUNT"},
+			{name: "info", typ: "pure-token", token: "INFO"},
+			{name: "docs", typ: "pure-token", token: "DOCS"},
+		}},
+		{name: "command-name", typ: "string", optional: true, multiple: true},
+	}},
+	"info": {"Returns information and statistics about the server.", "1.0.0", "server", []commandArg{
+		{name: "section", typ: "string", optional: true},
+	}},
+	"dbsize":   {"Returns the number of keys in the database.", "1.0.0", "server", nil},
+	"flushdb":  {"Removes all keys from the current database.", "1.0.0", "server", []commandArg{flushModeArg}},
+	"flushall": {"Removes all keys from all databases.", "1.0.0", "server", []commandArg{flushModeArg}},
+	"client": {"A container for client connection commands.", "2.4.0", "connection", []commandArg{
+		{name: "subcommand", typ: "oneof", args: []commandArg{
+			{name: "id", typ: "pure-token", token: "ID"},
+			{name: "getname", typ: "pure-token", token: "GETNAME"},
+			{name: "setname", typ: "string", token: "SETNAME"},
+			{name: "info", typ: "pure-token", token: "INFO"},
+			{name: "list", typ: "block", token: "LIST", args: []commandArg{
+				{name: "client-type", typ: "oneof", token: "TYPE", optional: true, args: []commandArg{
+					{name: "normal", typ: "pure-token", token: "NORMAL"},
+					{name: "master", typ: "pure-token", token: "MASTER"},
+					{name: "replica", typ: "pure-token", token: "REPLICA"},
+					{name: "pubsub", typ: "pure-token", token: "PUBSUB"},
+				}},
+			}},
+			{name: "kill", typ: "block", token: "KILL", args: []commandArg{
+				{name: "filter", typ: "oneof", args: []commandArg{
+					{name: "old-format", typ: "string"},
+					{name: "new-format", typ: "oneof", multiple: true, args: []commandArg{
+						{name: "client-id", typ: "integer", token: "ID"},
+						{name: "ip:port", typ: "string", token: "ADDR"},
+						{name: "client-type", typ: "string", token: "TYPE"},
+						{name: "yes/no", typ: "string", token: "SKIPME"},
+					}},
+				}},
+			}},
+		}},
+	}},
+	"subscribe": {"Listens for messages published to channels.", "2.0.0", "pubsub", []commandArg{
+		{name: "channel", typ: "string", multiple: true},
+	}},
+	"unsubscribe": {"Stops listening to messages posted to channels.", "2.0.0", "pubsub", []commandArg{
+		{name: "channel", typ: "string", optional: true, multiple: true},
+	}},
+	"psubscribe": {"Listens for messages published to channels that match one or more patterns.", "2.0.0", "pubsub", []commandArg{
+		{name: "pattern", typ: "pattern", multiple: true},
+	}},
+	"punsubscribe": {"Stops listening to messages published to channels that match one or more patterns.", "2.0.0", "pubsub", []commandArg{
+		{name: "pattern", typ: "pattern", optional: true, multiple: true},
+	}},
+	"publish": {"Posts a message to a channel.", "2.0.0", "pubsub", []commandArg{
+		{name: "channel", typ: "string"},
+		{name: "message", typ: "string"},
+	}},
+	"pubsub": {"A container for Pub/Sub introspection commands.", "2.8.0", "pubsub", []commandArg{
+		{name: "subcommand", typ: "oneof", args: []commandArg{
+			{name: "channels", typ: "pattern", token: "CHANNELS", optional: true},
+			{name: "numsub", typ: "string", token: "NUMSUB", optional: true, multiple: true},
+			{name: "numpat", typ: "pure-token", token: "NUMPAT"},
+			{name: "shardchannels", typ: "pattern", token: "SHARDCHANNELS", optional: true},
+			{name: "shardnumsub", typ: "string", token: "SHARDNUMSUB", optional: true, multiple: true},
+		}},
+	}},
+	"config": {"A container for server configuration commands.", "2.0.0", "server", []commandArg{
+		{name: "subcommand", typ: "oneof", args: []commandArg{
+			{name: "get", typ: "pattern", token: "GET"},
+			{name: "set", typ: "block", token: "SET", args: []commandArg{
+				{name: "parameter", typ: "string"},
+				{name: "value", typ: "string"},
+			}},
+		}},
+	}},
+	"cas": {"Sets the string value of a key only if its current value matches, or if it does not exist when the expected value is $-1. Not part of Redis.", "", "string", []commandArg{
+		keyArg,
+		{name: "expected", typ: "string"},
+		{name: "newvalue", typ: "string"},
+	}},
+	"incr": {"Increments the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.", "1.0.0", "string", []commandArg{keyArg}},
+	"decr": {"Decrements the integer value of a key by one. Uses 0 as initial value if the key doesn't exist.", "1.0.0", "string", []commandArg{keyArg}},
+	"incrby": {"Increments the integer value of a key by a number. Uses 0 as initial value if the key doesn't exist.", "1.0.0", "string", []commandArg{
+		keyArg,
+		{name: "increment", typ: "integer"},
+	}},
+	"decrby": {"Decrements a number from the integer value of a key. Uses 0 as initial value if the key doesn't exist.", "1.0.0", "string", []commandArg{
+		keyArg,
+		{name: "decrement", typ: "integer"},
+	}},
+	"incrbyfloat": {"Increment the floating point value of a key by a number. Uses 0 as initial value if the key doesn't exist.", "2.6.0", "string", []commandArg{
+		keyArg,
+		{name: "increment", typ: "double"},
+	}},
+	"increx": {"Increments the integer value of a key and sets its expiration time in seconds. Not part of Redis.", "", "string", []commandArg{
+		keyArg,
+		{name: "increment", typ: "integer"},
+		{name: "seconds", typ: "integer"},
+	}},
+	"quit":  {"Closes the connection.", "1.0.0", "connection", nil},
+	"reset": {"Resets the connection.", "6.2.0", "connection", nil},
+	"eval": {"Executes a server-side Lua script.", "2.6.0", "scripting", []commandArg{
+		{name: "script", typ: "string"},
+		{name: "numkeys", typ: "integer"},
+		{name: "key", typ: "key", optional: true, multiple: true},
+		{name: "arg", typ: "string", optional: true, multiple: true},
+	}},
+	"evalsha": {"Executes a server-side Lua script by SHA1 digest.", "2.6.0", "scripting", []commandArg{
+		{name: "sha1", typ: "string"},
+		{name: "numkeys", typ: "integer"},
+		{name: "key", typ: "key", optional: true, multiple: true},
+		{name: "arg", typ: "string", optional: true, multiple: true},
+	}},
+	"script": {"A container for Lua scripts management commands.", "2.6.0", "scripting", []commandArg{
+		{name: "subcommand", typ: "oneof", args: []commandArg{
+			{name: "load", typ: "string", token: "LOAD"},
+			{name: "exists", typ: "string", token: "EXISTS", multiple: true},
+			{name: "flush", typ: "block", token: "FLUSH", args: []commandArg{flushModeArg}},
+			{name: "kill", typ: "pure-token", token: "KILL"},
+		}},
+	}},
+	"pexpirepattern": {"Sets the expiration time in milliseconds of every key matching a pattern. Not part of Redis.", "", "generic", []commandArg{
+		{name: "pattern", typ: "pattern"},
+		{name: "milliseconds", typ: "integer"},
+	}},
+}
+
+func NewDatabase() *Database {
+	return NewDatabaseWithStore(newMapStore())
+}
+
+// NewDatabaseWithStore returns a Database whose string values are kept in
+// store.
+func NewDatabaseWithStore(store Store) *Database {
+	db := &Database{
+		data:      store,
+		expiry:    make(map[string]time.Time),
+		sortedSet: make(map[string]*zset),
+		hashes:    make(map[string]map[string]string),
+		lists:     make(map[string][]string),
+		sets:      make(map[string]map[string]struct{}),
+		accessed:  make(map[string]time.Time),
+		maxArgs:   defaultMaxArgs,
+		now:       time.Now,
+
+		ttlEntries:         make(map[string]*expiryEntry),
+		keysWarnThreshold:  defaultKeysWarnThreshold,
+		conns:              make(map[net.Conn]*client),
+		waiters:            make(map[string][]chan struct{}),
+		channels:           make(map[string][]*client),
+		patterns:           make(map[string][]*client),
+		forcedEncoding:     make(map[string]string),
+		scripts:            make(map[string]string),
+		pubsubQueueLimit:   defaultPubsubQueueLimit,
+		busyReplyThreshold: defaultBusyReplyThreshold,
+		pubsubOverflow:     overflowDisconnect,
+		dumpPath:           DefaultDumpPath,
+		lastSave:           time.Now(),
+		exit:               os.Exit,
+		lazyfreeWake:       make(chan struct{}, 1),
+		done:               make(chan struct{}),
+	}
+	go db.sweep()
+	go db.lazyfree()
+	go db.saveCron()
+	return db
+}
+
+// sweepInterval is how often the background sweeper removes expired keys.
+const sweepInterval = 100 * time.Millisecond
+
+// sweep removes expired keys every sweepInterval until Close is called.
+// Keys read before the sweeper reaches them are still removed lazily on
+// access.
+func (db *Database) sweep() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-db.done:
+			return
+		}
+		db.mu.Lock()
+		db.sweepExpired()
+		db.mu.Unlock()
+	}
+}
+
+// sweepExpired removes the keys whose TTL has passed, visiting only those.
+// The caller must hold db.mu.
+func (db *Database) sweepExpired() {
+	for len(db.ttlHeap) > 0 && db.isExpired(db.ttlHeap[0].key) {
+		db.expireKey(db.ttlHeap[0].key)
+	}
+}
+
+// Close stops the background sweeper, lazyfree worker and save points. Values still
+// queued for the worker are left to the collector. It is safe to call more than once.
+func (db *Database) Close() {
+	db.closeOnce.Do(func() { close(db.done) })
+}
+
+// handleCommand runs one command, already split into its arguments, for c.
+// c is nil for commands that do not come from a client connection.
+func (db *Database) handleCommand(c *client, parts []string) string {
+	if len(parts) == 0 {
+		return errorResponse("Empty Command")
+	}
+	if db.maxArgs > 0 && len(parts) > db.maxArgs {
+		return errorResponse("too many arguments")
+	}
+	if c != nil {
+		db.mu.Lock()
+		c.lastActive = time.Now()
+		c.lastCmd = strings.ToLower(parts[0])
+		limit := db.rateLimit
+		db.mu.Unlock()
+		if !c.allow(limit, c.lastActive) {
+			return errorResponse("rate limit exceeded")
+		}
+	}
+	name := strings.ToLower(parts[0])
+	spec, ok := commandTable[name]
+	if ok && !spec.acceptsArgs(len(parts)) {
+		return errorResponse(fmt.Sprintf("wrong number of arguments for '%s' command", strings.ToUpper(parts[0])))
+	}
+	if c != nil && c.subscriptionCount() > 0 {
+		switch strings.ToUpper(parts[0]) {
+		case "SUBSCRIBE", "UNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE", "QUIT", "RESET":
+		default:
+			return errorResponse(fmt.Sprintf("Can't execute '%s': only (P)SUBSCRIBE / (P)UNSUBSCRIBE / QUIT / RESET are allowed in this context", strings.ToLower(parts[0])))
+		}
+	}
+
+	// SCRIPT KILL has to run while the script holds scriptMu.
+	if name == "script" && len(parts) == 2 && strings.EqualFold(parts[1], "KILL") {
+		return db.scriptKill(false)
+	}
+	if reply, busy := db.waitForScript(); busy {
+		if name != "shutdown" || len(parts) != 2 || !strings.EqualFold(parts[1], "NOSAVE") {
+			return reply
+		}
+		// SHUTDOWN NOSAVE is the way out of a script that has written and
+		// so cannot be killed.
+		db.scriptKill(true)
+	}
+
+	if name == "eval" || name == "evalsha" {
+		db.scriptMu.Lock()
+		defer db.scriptMu.Unlock()
+	} else {
+		db.scriptMu.RLock()
+		defer db.scriptMu.RUnlock()
+	}
+	return db.call(c, spec, parts)
+}
+
+// call dispatches a checked command. A successful write counts towards
+// the save points and is logged to the AOF. The caller must hold
+// db.scriptMu.
+func (db *Database) call(c *client, spec commandSpec, parts []string) string {
+	write := slices.Contains(spec.flags, "write")
+	if write && db.aof != nil {
+		db.writeMu.Lock()
+		defer db.writeMu.Unlock()
+	}
+	response := db.dispatch(c, parts)
+	if write && !strings.HasPrefix(response, "-") {
+		db.dirty.Add(1)
+		if db.aof != nil {
+			db.propagate(spec, parts)
+		}
+	}
+	return response
+}
+
+// dispatch runs the handler for parts[0] once handleCommand has checked
+// the command may run.
+func (db *Database) dispatch(c *client, parts []string) string {
+	switch strings.ToUpper(parts[0]) {
+	case "GET":
+		return db.get(parts)
+	case "SET":
+		return db.set(parts)
+	case "MSET":
+		return db.mset(parts)
+	case "MGET":
+		return db.mget(parts)
+	case "SETNX":
+		return db.setnx(parts)
+	case "GETSET":
+		return db.getset(parts)
+	case "APPEND":
+		return db.appendString(parts)
+	case "STRLEN":
+		return db.strlen(parts)
+	case "GETRANGE":
+		return db.getrange(parts)
+	case "SETRANGE":
+		return db.setrange(parts)
+	case "DEL":
+		return db.del(parts)
+	case "EXISTS":
+		return db.exists(parts)
+	case "UNLINK":
+		return db.unlink(parts)
+	case "RENAME":
+		return db.rename(parts, false)
+	case "RENAMENX":
+		return db.rename(parts, true)
+	case "EXPIRE":
+		return db.expire(parts, time.Second)
+	case "PEXPIRE":
+		return db.expire(parts, time.Millisecond)
+	case "PEXPIREAT":
+		return db.pexpireat(parts)
+	case "PERSIST":
+		return db.persist(parts)
+	case "INCR":
+		return db.incr(parts, 1)
+	case "DECR":
+		return db.incr(parts, -1)
+	case "INCRBY":
+		return db.incrby(parts, false)
+	case "DECRBY":
+		return db.incrby(parts, true)
+	case "INCRBYFLOAT":
+		return db.incrbyfloat(parts)
+	case "INCREX":
+		return db.increx(parts)
+	case "PEXPIREPATTERN":
+		return db.pexpirePattern(parts)
+	case "CAS":
+		return db.cas(parts)
+	case "KEYS":
+		switch {
+		case len(parts) == 2:
+			return db.keys(parts[1], "")
+		case len(parts) == 4 && strings.ToUpper(parts[2]) == "TYPE":
+			return db.keys(parts[1], strings.ToLower(parts[3]))
+		case len(parts) == 4:
+			return errorResponse("syntax error")
+		}
+		return errorResponse("wrong number of arguments for 'KEYS' command")
+
+	case "SCAN":
+		return db.scan(parts)
+	case "TTL":
+		return db.ttl(parts, time.Second)
+	case "PTTL":
+		return db.ttl(parts, time.Millisecond)
+	case "ZADD":
+		return db.zadd(parts)
+	case "ZRANGE":
+		return db.zrange(parts)
+	case "ZREVRANGE", "ZRANGEBYSCORE", "ZREVRANGEBYSCORE", "ZRANGEBYLEX", "ZREVRANGEBYLEX":
+		return db.zrangeLegacy(parts)
+	case "ZINCRBY":
+		return db.zincrby(parts)
+	case "ZSCORE":
+		return db.zscore(parts)
+	case "ZREM":
+		return db.zrem(parts)
+	case "ZCARD":
+		return db.zcard(parts)
+	case "ZRANK":
+		return db.zrank(parts, false)
+	case "ZREVRANK":
+		return db.zrank(parts, true)
+	case "ZMPOP":
+		return db.zmpop(parts)
+	case "BZMPOP":
+		return db.bzmpop(c, parts)
+	case "GETEX":
+		return db.getex(parts)
+	case "HSET":
+		return db.hset(parts)
+	case "HINCRBYFLOAT":
+		return db.hincrbyfloat(parts)
+	case "HGET":
+		return db.hget(parts)
+	case "HDEL":
+		return db.hdel(parts)
+	case "HGETALL":
+		return db.hgetall(parts)
+	case "HEXISTS":
+		return db.hexists(parts)
+	case "HKEYS":
+		return db.hkeys(parts, false)
+	case "HVALS":
+		return db.hkeys(parts, true)
+	case "HLEN":
+		return db.hlen(parts)
+	case "LPUSH":
+		return db.push(parts, true)
+	case "RPUSH":
+		return db.push(parts, false)
+	case "LPOP":
+		return db.pop(parts, true)
+	case "RPOP":
+		return db.pop(parts, false)
+	case "LLEN":
+		return db.llen(parts)
+	case "LMPOP":
+		return db.lmpop(parts)
+	case "BLMPOP":
+		return db.blmpop(c, parts)
+	case "LRANGE":
+		return db.lrange(parts)
+	case "LINDEX":
+		return db.lindex(parts)
+	case "SADD":
+		return db.sadd(parts)
+	case "SREM":
+		return db.srem(parts)
+	case "SMEMBERS":
+		return db.smembers(parts)
+	case "SISMEMBER":
+		return db.sismember(parts)
+	case "SCARD":
+		return db.scard(parts)
+	case "SUNION":
+		return db.combineSets(parts, setUnion)
+	case "SINTER":
+		return db.combineSets(parts, setInter)
+	case "SDIFF":
+		return db.combineSets(parts, setDiff)
+	case "BITPOS":
+		return db.bitpos(parts)
+	case "BITFIELD":
+		return db.bitfield(parts)
+	case "TYPE":
+		return db.keyType(parts)
+	case "OBJECT":
+		return db.object(parts)
+	case "MEMORY":
+		return db.memory(parts)
+	case "DEBUG":
+		return db.debug(parts)
+	case "SHUTDOWN":
+		return db.shutdown(parts)
+	case "SAVE":
+		return db.save()
+	case "BGSAVE":
+		return db.bgsave()
+	case "COMMAND":
+		return db.command(parts)
+	case "INFO":
+		return db.info(parts)
+	case "DBSIZE":
+		return db.dbsize()
+	case "FLUSHDB", "FLUSHALL":
+		// There is a single logical database, so the two are the same.
+		return db.flush(parts)
+	case "CLIENT":
+		return db.clientCommand(c, parts)
+	case "CONFIG":
+		return db.config(parts)
+	case "SUBSCRIBE":
+		return db.subscribeCommand(c, parts, false)
+	case "UNSUBSCRIBE":
+		return db.unsubscribeCommand(c, parts, false)
+	case "PSUBSCRIBE":
+		return db.subscribeCommand(c, parts, true)
+	case "PUNSUBSCRIBE":
+		return db.unsubscribeCommand(c, parts, true)
+	case "PUBSUB":
+		return db.pubsubCommand(parts)
+	case "PUBLISH":
+		db.mu.RLock()
+		p := db.publication(parts[1], parts[2])
+		db.mu.RUnlock()
+		return fmt.Sprintf(":%d\r\n", p.deliver())
+	case "EVAL":
+		return db.eval(parts, false)
+	case "EVALSHA":
+		return db.eval(parts, true)
+	case "SCRIPT":
+		return db.scriptCommand(parts)
+	case "QUIT":
+		// handleConnection closes the connection once this is flushed.
+		return "+OK\r\n"
+	case "RESET":
+		if c == nil {
+			return errorResponse("RESET is only available on client connections")
+		}
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.resetConnState(c)
+		return "+RESET\r\n"
+	default:
+		return fmt.Sprintf("-ERR Unknown command '%s'\r\n", parts[0])
+	}
+}
+
+func (db *Database) command(parts []string) string {
+	if len(parts) == 1 {
+		return commandInfo(sortedCommandNames())
+	}
+	switch strings.ToUpper(parts[1]) {
+	case "COUNT":
+		return fmt.Sprintf(":%d\r\n", len(commandTable))
+	case "INFO":
+		return commandInfo(parts[2:])
+	case "DOCS":
+		names := parts[2:]
+		if len(names) == 0 {
+			names = sortedCommandNames()
+		}
+		return commandDocsReply(names)
+	default:
+		return errorResponse(fmt.Sprintf("unknown subcommand '%s'", parts[1]))
+	}
+}
+
+func sortedCommandNames() []string {
+	names := make([]string, 0, len(commandTable))
+	for name := range commandTable {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// commandDocsReply renders COMMAND DOCS for names as a flattened map of
+// command name to its documentation. Unknown names are left out.
+func commandDocsReply(names []string) string {
+	var entries []string
+	for _, name := range names {
+		name = strings.ToLower(name)
+		doc, ok := commandDocs[name]
+		if !ok {
+			continue
+		}
+		fields := []string{bulkString("summary"), bulkString(doc.summary)}
+		if doc.since != "" {
+			fields = append(fields, bulkString("since"), bulkString(doc.since))
+		}
+		fields = append(fields, bulkString("group"), bulkString(doc.group))
+		if len(doc.args) > 0 {
+			fields = append(fields, bulkString("arguments"), formatCommandArgs(doc.args))
+		}
+		entries = append(entries, bulkString(name), fmt.Sprintf("*%d\r\n", len(fields))+strings.Join(fields, ""))
+	}
+	return fmt.Sprintf("*%d\r\n", len(entries)) + strings.Join(entries, "")
+}
+
+func formatCommandArgs(args []commandArg) string {
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		fields := []string{bulkString("name"), bulkString(arg.name), bulkString("type"), bulkString(arg.typ)}
+		if arg.token != "" {
+			fields = append(fields, bulkString("token"), bulkString(arg.token))
+		}
+		var flags []string
+		if arg.optional {
+			flags = append(flags, "+optional\r\n")
+		}
+		if arg.multiple {
+			flags = append(flags, "+multiple\r\n")
+		}
+		if len(flags) > 0 {
+			fields = append(fields, bulkString("flags"), fmt.Sprintf("*%d\r\n", len(flags))+strings.Join(flags, ""))
+		}
+		if len(arg.args) > 0 {
+			fields = append(fields, bulkString("arguments"), formatCommandArgs(arg.args))
+		}
+		response.WriteString(fmt.Sprintf("*%d\r\n", len(fields)))
+		response.WriteString(strings.Join(fields, ""))
+	}
+	return response.String()
+}
+
+// commandInfo renders the registry entries for names in the classic
+// COMMAND INFO layout, with nil for names that are not registered.
+func commandInfo(names []string) string {
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(names)))
+	for _, name := range names {
+		name = strings.ToLower(name)
+		spec, ok := commandTable[name]
+		if !ok {
+			response.WriteString("*-1\r\n")
+			continue
+		}
+		response.WriteString("*6\r\n")
+		response.WriteString(bulkString(name))
+		response.WriteString(fmt.Sprintf(":%d\r\n", spec.arity))
+		response.WriteString(fmt.Sprintf("*%d\r\n", len(spec.flags)))
+		for _, flag := range spec.flags {
+			response.WriteString("+" + flag + "\r\n")
+		}
+		response.WriteString(fmt.Sprintf(":%d\r\n:%d\r\n:%d\r\n", spec.firstKey, spec.lastKey, spec.step))
+	}
+	return response.String()
+}
+
+// protocolError is a malformed request. The connection is closed once it
+// has been reported, since the rest of the stream cannot be trusted.
+type protocolError string
+
+func (e protocolError) Error() string {
+	return "Protocol error: " + string(e)
+}
+
+// maxBulkLen is the largest argument a multi-bulk request may carry, the
+// Redis default proto-max-bulk-len.
+const maxBulkLen = 512 * 1024 * 1024
+
+// readCommand reads the next request from reader and returns its
+// arguments. A request starting with '*' is a RESP multi-bulk array, as
+// redis-cli sends; anything else is an inline command line. Empty
+// multi-bulk arrays are skipped, as Redis does. maxArgs, if positive,
+// caps the number of elements a multi-bulk header may announce.
+func readCommand(reader *bufio.Reader, maxArgs int) ([]string, error) {
+	for {
+		first, err := reader.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if first[0] != '*' {
+			line, err := reader.ReadString('\n')
+			if err != nil {
+				return nil, err
+			}
+			parts, ok := splitCommand(line)
+			if !ok {
+				return nil, protocolError("unbalanced quotes in request")
+			}
+			return parts, nil
+		}
+
+		header, err := readLine(reader)
+		if err != nil {
+			return nil, err
+		}
+		n, err := strconv.Atoi(header[1:])
+		if err != nil || (maxArgs > 0 && n > maxArgs) {
+			return nil, protocolError("invalid multibulk length")
+		}
+		if n <= 0 {
+			continue
+		}
+		// Don't trust the header with a large allocation up front.
+		parts := make([]string, 0, min(n, 1024))
+		for len(parts) < n {
+			line, err := readLine(reader)
+			if err != nil {
+				return nil, err
+			}
+			if line == "" || line[0] != '$' {
+				got := ""
+				if line != "" {
+					got = line[:1]
+				}
+				return nil, protocolError(fmt.Sprintf("expected '$', got '%s'", got))
+			}
+			size, err := strconv.Atoi(line[1:])
+			if err != nil || size < 0 || size > maxBulkLen {
+				return nil, protocolError("invalid bulk length")
+			}
+			// Grow the buffer as the bytes arrive rather than allocating
+			// the claimed length, which a client can send without a body.
+			var arg bytes.Buffer
+			if _, err := io.CopyN(&arg, reader, int64(size)+2); err != nil {
+				if err == io.EOF && arg.Len() > 0 {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			if body := arg.Bytes(); body[size] != '\r' || body[size+1] != '\n' {
+				return nil, protocolError("bulk argument is not terminated by CRLF")
+			}
+			parts = append(parts, string(arg.Bytes()[:size]))
+		}
+		return parts, nil
+	}
+}
+
+// readLine reads a CRLF-terminated protocol line without its terminator.
+func readLine(reader *bufio.Reader) (string, error) {
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r"), nil
+}
+
+// splitCommand splits an inline command line into its arguments the way
+// redis-cli quotes them. An argument in double quotes may contain spaces
+// and the escapes \", \\, \n, \r, \t and \xHH; one in single quotes is
+// taken literally except for \'. A closing quote must end the argument.
+// It reports false for unbalanced quotes.
+func splitCommand(line string) ([]string, bool) {
+	parts := []string{}
+	i := 0
+	for {
+		for i < len(line) && isInlineSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return parts, true
+		}
+		var arg strings.Builder
+		for i < len(line) && !isInlineSpace(line[i]) {
+			quote := line[i]
+			if quote != '"' && quote != '\'' {
+				arg.WriteByte(quote)
+				i++
+				continue
+			}
+			closed := false
+			for i++; i < len(line); i++ {
+				c := line[i]
+				if c == quote {
+					closed = true
+					i++
+					break
+				}
+				if c == '\\' && i+1 < len(line) {
+					if next, n := inlineEscape(line[i+1:], quote); n > 0 {
+						arg.WriteByte(next)
+						i += n
+						continue
+					}
+				}
+				arg.WriteByte(c)
+			}
+			if !closed || (i < len(line) && !isInlineSpace(line[i])) {
+				return nil, false
+			}
+			break
+		}
+		parts = append(parts, arg.String())
+	}
+}
+
+func isInlineSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\r' || c == '\n'
+}
+
+// inlineEscape decodes the escape following a backslash inside quote,
+// returning the byte and how many bytes of s it used, or 0 if s does not
+// start a recognised escape.
+func inlineEscape(s string, quote byte) (byte, int) {
+	if quote == '\'' {
+		if s[0] == '\'' {
+			return '\'', 1
+		}
+		return 0, 0
+	}
+	switch s[0] {
+	case 'n':
+		return '\n', 1
+	case 'r':
+		return '\r', 1
+	case 't':
+		return '\t', 1
+	case 'b':
+		return '\b', 1
+	case 'a':
+		return '\a', 1
+	case 'x':
+		if len(s) >= 3 {
+			if b, err := strconv.ParseUint(s[1:3], 16, 8); err == nil {
+				return byte(b), 3
+			}
+		}
+	}
+	return s[0], 1
+}
+
+func (db *Database) get(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	value, ok := db.getString(parts[1], true)
+	if !ok {
+		db.notify(notifyKeyMiss, "keymiss", parts[1])
+		return "$-1\r\n" // Key not found or expired
+	}
+	return bulkString(value)
+}
+
+// getex is GET that can also change the key's TTL. Without options it is a
+// read that leaves the key's idle time alone.
+func (db *Database) getex(parts []string) string {
+	if len(parts) > 4 {
+		return errorResponse("syntax error")
+	}
+	var deadline time.Time
+	persist := false
+	switch {
+	case len(parts) == 3 && strings.ToUpper(parts[2]) == "PERSIST":
+		persist = true
+	case len(parts) == 4 && strings.ToUpper(parts[2]) == "EX":
+		var errReply string
+		if deadline, errReply = db.parseTTL(parts[3], time.Second, "getex", true); errReply != "" {
+			return errReply
+		}
+	case len(parts) == 4 && strings.ToUpper(parts[2]) == "PX":
+		var errReply string
+		if deadline, errReply = db.parseTTL(parts[3], time.Millisecond, "getex", true); errReply != "" {
+			return errReply
+		}
+	case len(parts) != 2:
+		return errorResponse("syntax error")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	value, ok := db.getString(key, len(parts) > 2)
+	if !ok {
+		db.notify(notifyKeyMiss, "keymiss", key)
+		return "$-1\r\n"
+	}
+	if persist {
+		if _, ok := db.expiry[key]; ok {
+			db.clearExpiry(key)
+			db.notify(notifyGeneric, "persist", key)
+		}
+	}
+	if !deadline.IsZero() {
+		db.setExpiry(key, deadline)
+		db.notify(notifyGeneric, "expire", key)
+	}
+	return bulkString(value)
+}
+
+// set implements SET. The options after the value may come in any order:
+// EX seconds or PX milliseconds give the key a TTL, KEEPTTL keeps the one
+// it has, and NX or XX only set the key if it does not or does already
+// exist, replying nil otherwise.
+func (db *Database) set(parts []string) string {
+	key := parts[1]
+	value := parts[2]
+	var deadline time.Time
+	keepTTL, nx, xx := false, false, false
+	for i := 3; i < len(parts); i++ {
+		switch opt := strings.ToUpper(parts[i]); {
+		case opt == "NX" && !xx:
+			nx = true
+		case opt == "XX" && !nx:
+			xx = true
+		case opt == "KEEPTTL" && deadline.IsZero():
+			keepTTL = true
+		case (opt == "EX" || opt == "PX") && !keepTTL && deadline.IsZero() && i+1 < len(parts):
+			unit := time.Second
+			if opt == "PX" {
+				unit = time.Millisecond
+			}
+			var errReply string
+			if deadline, errReply = db.parseTTL(parts[i+1], unit, "set", true); errReply != "" {
+				return errReply
+			}
+			i++
+		default:
+			return errorResponse("syntax error")
+		}
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	exists := db.keyExists(key)
+	if (nx && exists) || (xx && !exists) {
+		return "$-1\r\n"
+	}
+	db.setString(key, value)
+	db.touch(key)
+	if !keepTTL {
+		// Overwriting a key discards its old TTL.
+		db.clearExpiry(key)
+	}
+	if !deadline.IsZero() {
+		db.setExpiry(key, deadline)
+	}
+	if !exists {
+		db.notify(notifyNew, "new", key)
+	}
+	db.notify(notifyString, "set", key)
+	if !deadline.IsZero() {
+		db.notify(notifyGeneric, "expire", key)
+	}
+	return "+OK\r\n"
+}
+
+// mset sets every key/value pair under one lock, so no client sees some
+// of the keys set and others not. Like SET, it discards any old TTLs.
+func (db *Database) mset(parts []string) string {
+	if len(parts)%2 == 0 {
+		return errorResponse("wrong number of arguments for 'MSET' command")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for i := 1; i < len(parts); i += 2 {
+		key := parts[i]
+		created := !db.keyExists(key)
+		db.setString(key, parts[i+1])
+		db.touch(key)
+		db.clearExpiry(key)
+		if created {
+			db.notify(notifyNew, "new", key)
+		}
+		db.notify(notifyString, "set", key)
+	}
+	return "+OK\r\n"
+}
+
+// mget replies with the value of each key in argument order, with a nil
+// for keys that are missing, expired or not strings.
+func (db *Database) mget(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(parts)-1))
+	for _, key := range parts[1:] {
+		value, ok := db.getString(key, true)
+		if !ok {
+			db.notify(notifyKeyMiss, "keymiss", key)
+			response.WriteString("$-1\r\n")
+			continue
+		}
+		response.WriteString(bulkString(value))
+	}
+	return response.String()
+}
+
+// setnx sets key only if it does not already exist as any type, replying
+// 1 if it was set and 0 if not.
+func (db *Database) setnx(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	if db.keyExists(key) {
+		return ":0\r\n"
+	}
+	db.setString(key, parts[2])
+	db.touch(key)
+	db.notify(notifyNew, "new", key)
+	db.notify(notifyString, "set", key)
+	return ":1\r\n"
+}
+
+// getset sets key to value and replies with the string it held before, or
+// nil if it had none. Like SET, it replaces a value of another type and
+// discards any old TTL.
+func (db *Database) getset(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	old, ok := db.getString(key, false)
+	created := !db.keyExists(key)
+	db.setString(key, parts[2])
+	db.touch(key)
+	db.clearExpiry(key)
+	if created {
+		db.notify(notifyNew, "new", key)
+	}
+	db.notify(notifyString, "set", key)
+	if !ok {
+		return "$-1\r\n"
+	}
+	return bulkString(old)
+}
+
+// appendString implements APPEND, adding value to the end of the string at
+// key, or creating it, and replying with the new length. The key keeps its
+// TTL.
+func (db *Database) appendString(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	value, ok := db.getString(key, true)
+	if !ok && db.keyExists(key) {
+		return wrongTypeResponse
+	}
+	created := !ok
+	value += parts[2]
+	db.setString(key, value)
+	db.touch(key)
+	if created {
+		db.notify(notifyNew, "new", key)
+	}
+	db.notify(notifyString, "append", key)
+	return fmt.Sprintf(":%d\r\n", len(value))
+}
+
+// strlen replies with the length of the string at key, or 0 if there is
+// none.
+func (db *Database) strlen(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	value, _ := db.getString(parts[1], false)
+	return fmt.Sprintf(":%d\r\n", len(value))
+}
+
+// getrange replies with the bytes of the string at key from start to end
+// inclusive, counting negative indices from the end. A missing key or an
+// empty range gives an empty string.
+func (db *Database) getrange(parts []string) string {
+	start, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return errorResponse("value is not an integer or out of range")
+	}
+	end, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return errorResponse("value is not an integer or out of range")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	value, _ := db.getString(parts[1], true)
+	start, end, ok := normalizeRange(start, end, len(value))
+	if !ok {
+		return bulkString("")
+	}
+	return bulkString(value[start : end+1])
+}
+
+// setrange overwrites the string at key with value starting at offset,
+// padding with zero bytes if offset is past the end, and replies with the
+// new length. An empty value leaves the key untouched.
+func (db *Database) setrange(parts []string) string {
+	offset, err := strconv.Atoi(parts[2])
+	if err != nil || offset < 0 {
+		return errorResponse("offset is out of range")
+	}
+	value := parts[3]
+	// Compare without adding, so a huge offset can't overflow.
+	if offset > maxBulkLen-len(value) {
+		return errorResponse("string exceeds maximum allowed size (proto-max-bulk-len)")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	old, ok := db.getString(key, true)
+	if !ok && db.keyExists(key) {
+		return wrongTypeResponse
+	}
+	if value == "" {
+		return fmt.Sprintf(":%d\r\n", len(old))
+	}
+	created := !ok
+	buf := []byte(old)
+	if need := offset + len(value); need > len(buf) {
+		buf = append(buf, make([]byte, need-len(buf))...)
+	}
+	copy(buf[offset:], value)
+	db.setString(key, string(buf))
+	db.touch(key)
+	if created {
+		db.notify(notifyNew, "new", key)
+	}
+	db.notify(notifyString, "setrange", key)
+	return fmt.Sprintf(":%d\r\n", len(buf))
+}
+
+// incr implements INCR and DECR, which add delta to the integer at key.
+func (db *Database) incr(parts []string, delta int64) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n, errReply := db.incrBy(parts[1], delta)
+	if errReply != "" {
+		return errReply
+	}
+	return fmt.Sprintf(":%d\r\n", n)
+}
+
+// incrby implements INCRBY and DECRBY. negate is set for DECRBY, which
+// subtracts the delta argument instead of adding it.
+func (db *Database) incrby(parts []string, negate bool) string {
+	delta, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return errorResponse("value is not an integer or out of range")
+	}
+	if negate {
+		if delta == math.MinInt64 {
+			return errorResponse("decrement would overflow")
+		}
+		delta = -delta
+	}
+	return db.incr(parts[:2], delta)
+}
+
+// increx is a non-standard command that increments a counter and refreshes
+// its TTL in one step, as used by fixed-window rate limiters.
+func (db *Database) increx(parts []string) string {
+	delta, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return errorResponse("value is not an integer or out of range")
+	}
+	deadline, errReply := db.parseTTL(parts[3], time.Second, "increx", true)
+	if errReply != "" {
+		return errReply
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	n, errReply := db.incrBy(parts[1], delta)
+	if errReply != "" {
+		return errReply
+	}
+	db.setExpiry(parts[1], deadline)
+	db.notify(notifyGeneric, "expire", parts[1])
+	return fmt.Sprintf(":%d\r\n", n)
+}
+
+// casAbsent is the expected value CAS treats as "the key does not exist".
+const casAbsent = "$-1"
+
+// cas is a non-standard compare-and-set: it sets key to newvalue only if
+// its current value equals expected, or if expected is casAbsent and the
+// key does not exist. Like SET it discards any TTL.
+func (db *Database) cas(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key, expected := parts[1], parts[2]
+	value, ok := db.getString(key, true)
+	switch {
+	case expected == casAbsent && db.typeOf(key) != "none" && !db.isExpired(key):
+		return ":0\r\n"
+	case expected != casAbsent && (!ok || value != expected):
+		return ":0\r\n"
+	}
+	db.setString(key, parts[3])
+	db.touch(key)
+	db.clearExpiry(key)
+	if !ok {
+		db.notify(notifyNew, "new", key)
+	}
+	db.notify(notifyString, "set", key)
+	return ":1\r\n"
+}
+
+// incrBy adds delta to the integer stored at key, treating a missing key as
+// 0, and keeps any existing TTL. The caller must hold db.mu.
+func (db *Database) incrBy(key string, delta int64) (int64, string) {
+	var n int64
+	value, ok := db.getString(key, true)
+	if !ok && db.keyExists(key) {
+		return 0, wrongTypeResponse
+	}
+	if ok {
+		var err error
+		if n, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return 0, errorResponse("value is not an integer or out of range")
+		}
+	}
+	if (delta > 0 && n > math.MaxInt64-delta) || (delta < 0 && n < math.MinInt64-delta) {
+		return 0, errorResponse("value is not an integer or out of range")
+	}
+	n += delta
+	db.setString(key, strconv.FormatInt(n, 10))
+	db.touch(key)
+	if !ok {
+		db.notify(notifyNew, "new", key)
+	}
+	db.notify(notifyString, "incrby", key)
+	return n, ""
+}
+
+func (db *Database) incrbyfloat(parts []string) string {
+	delta, err := strconv.ParseFloat(parts[2], 64)
+	if err != nil || math.IsNaN(delta) {
+		return errorResponse("value is not a valid float")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	var n float64
+	value, ok := db.getString(key, true)
+	if !ok && db.keyExists(key) {
+		return wrongTypeResponse
+	}
+	if ok {
+		if n, err = strconv.ParseFloat(value, 64); err != nil || math.IsNaN(n) {
+			return errorResponse("value is not a valid float")
+		}
+	}
+	n += delta
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return errorResponse("increment would produce NaN or Infinity")
+	}
+	result := formatIncrFloat(n)
+	db.setString(key, result)
+	db.touch(key)
+	if !ok {
+		db.notify(notifyNew, "new", key)
+	}
+	db.notify(notifyString, "incrbyfloat", key)
+	return bulkString(result)
+}
+
+// formatIncrFloat formats the result of INCRBYFLOAT, HINCRBYFLOAT or
+// ZINCRBY without an exponent or trailing zeros. It uses the fewest
+// digits that parse back to f, never more than the 17 significant digits
+// Redis prints, so no increment is lost to rounding: the stored string is
+// what later increments start from. Only a sorted set score can be
+// infinite, and that prints as inf or -inf.
+func formatIncrFloat(f float64) string {
+	switch {
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+func (db *Database) del(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	count := 0
+	for _, key := range parts[1:] {
+		if db.keyExists(key) {
+			db.deleteKey(key)
+			db.notify(notifyGeneric, "del", key)
+			count++
+		}
+	}
+	return fmt.Sprintf(":%d\r\n", count)
+}
+
+// exists counts how many of the given keys exist. A key named more than
+// once is counted each time.
+func (db *Database) exists(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	count := 0
+	for _, key := range parts[1:] {
+		if db.isExpired(key) {
+			db.expireKey(key)
+			continue
+		}
+		if db.typeOf(key) != "none" {
+			count++
+		}
+	}
+	return fmt.Sprintf(":%d\r\n", count)
+}
+
+// rename implements RENAME and RENAMENX, moving the value and TTL at the
+// first key to the second. RENAME overwrites the destination and replies
+// +OK; with nx set the destination must not exist and the reply is 1 or 0.
+func (db *Database) rename(parts []string, nx bool) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	src, dst := parts[1], parts[2]
+	if !db.keyExists(src) {
+		return errorResponse("no such key")
+	}
+	if nx && db.keyExists(dst) {
+		return ":0\r\n"
+	}
+	if src != dst {
+		db.deleteKey(dst)
+		db.moveKey(src, dst)
+		db.notify(notifyGeneric, "rename_from", src)
+		db.notify(notifyGeneric, "rename_to", dst)
+		db.signalKey(dst)
+	}
+	if nx {
+		return ":1\r\n"
+	}
+	return "+OK\r\n"
+}
+
+// lazyfreeThreshold is the collection size above which UNLINK leaves a
+// value to the lazyfree worker rather than releasing it inline.
+const lazyfreeThreshold = 64
+
+// unlink removes keys like DEL but only detaches them from the keyspace
+// while holding db.mu. Large collections are queued for the lazyfree
+// worker so other clients are not stalled while they are released.
+func (db *Database) unlink(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	count := 0
+	for _, key := range parts[1:] {
+		if db.isExpired(key) {
+			db.expireKey(key)
+			continue
+		}
+		if db.typeOf(key) == "none" {
+			continue
+		}
+		if set, ok := db.sortedSet[key]; ok && set.len() > lazyfreeThreshold {
+			db.freeLater(set)
+		}
+		if hash, ok := db.hashes[key]; ok && len(hash) > lazyfreeThreshold {
+			db.freeLater(hash)
+		}
+		if list, ok := db.lists[key]; ok && len(list) > lazyfreeThreshold {
+			db.freeLater(list)
+		}
+		if set, ok := db.sets[key]; ok && len(set) > lazyfreeThreshold {
+			db.freeLater(set)
+		}
+		db.deleteKey(key)
+		db.notify(notifyGeneric, "del", key)
+		count++
+	}
+	return fmt.Sprintf(":%d\r\n", count)
+}
+
+// freeLater queues a value that is no longer reachable from the keyspace
+// for the lazyfree worker.
+func (db *Database) freeLater(value any) {
+	db.lazyfreeMu.Lock()
+	db.lazyfreeQueue = append(db.lazyfreeQueue, value)
+	db.lazyfreePending++
+	db.lazyfreeMu.Unlock()
+	select {
+	case db.lazyfreeWake <- struct{}{}:
+	default:
+	}
+}
+
+// lazyfree releases the values queued by freeLater, one at a time and
+// without db.mu, until Close is called.
+func (db *Database) lazyfree() {
+	for {
+		select {
+		case <-db.lazyfreeWake:
+		case <-db.done:
+			return
+		}
+		for {
+			db.lazyfreeMu.Lock()
+			if len(db.lazyfreeQueue) == 0 {
+				db.lazyfreeQueue = nil
+				db.lazyfreeMu.Unlock()
+				break
+			}
+			value := db.lazyfreeQueue[0]
+			db.lazyfreeQueue[0] = nil
+			db.lazyfreeQueue = db.lazyfreeQueue[1:]
+			db.lazyfreeMu.Unlock()
+
+			release(value)
+
+			db.lazyfreeMu.Lock()
+			db.lazyfreePending--
+			db.lazyfreed++
+			db.lazyfreeMu.Unlock()
+		}
+	}
+}
+
+// release drops every element of a value detached from the keyspace,
+// which is the work freeing it costs: proportional to its size, and so
+// kept off db.mu for large values. Containers of values, as detached by
+// FLUSHALL, release each value they hold.
+func release(value any) {
+	switch v := value.(type) {
+	case *zset:
+		clear(v.dict)
+		v.zsl = newSkiplist()
+	case map[string]string:
+		clear(v)
+	case []string:
+		clear(v)
+	case map[string]struct{}:
+		clear(v)
+	case map[string]*zset:
+		for _, set := range v {
+			release(set)
+		}
+		clear(v)
+	case map[string]map[string]string:
+		for _, hash := range v {
+			release(hash)
+		}
+		clear(v)
+	case map[string][]string:
+		for _, list := range v {
+			release(list)
+		}
+		clear(v)
+	case map[string]map[string]struct{}:
+		for _, set := range v {
+			release(set)
+		}
+		clear(v)
+	}
+}
+
+// expire implements EXPIRE and PEXPIRE, with the TTL given in unit. It
+// only sets a TTL on a key that exists, replying :1 if it did and :0 if
+// not.
+func (db *Database) expire(parts []string, unit time.Duration) string {
+	deadline, errReply := db.parseTTL(parts[2], unit, strings.ToLower(parts[0]), false)
+	if errReply != "" {
+		return errReply
+	}
+	return db.expireAt(parts[1], deadline)
+}
+
+// pexpireat sets a key's TTL to end at an absolute Unix time in
+// milliseconds. A time in the past expires the key. The AOF uses it to
+// record deadlines so replay does not restart them.
+func (db *Database) pexpireat(parts []string) string {
+	ms, err := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil {
+		return errorResponse("value is not an integer or out of range")
+	}
+	return db.expireAt(parts[1], time.UnixMilli(ms))
+}
+
+// expireAt gives key a TTL ending at deadline, replying 1, or 0 if there
+// is no such key.
+func (db *Database) expireAt(key string, deadline time.Time) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.isExpired(key) {
+		db.expireKey(key)
+		return ":0\r\n"
+	}
+	if db.typeOf(key) == "none" {
+		return ":0\r\n"
+	}
+	db.setExpiry(key, deadline)
+	db.notify(notifyGeneric, "expire", key)
+	return ":1\r\n"
+}
+
+func (db *Database) persist(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	if db.isExpired(key) {
+		db.expireKey(key)
+		return ":0\r\n"
+	}
+	if _, ok := db.expiry[key]; !ok || db.typeOf(key) == "none" {
+		return ":0\r\n"
+	}
+	db.clearExpiry(key)
+	db.notify(notifyGeneric, "persist", key)
+	return ":1\r\n"
+}
+
+// pexpirePattern is a non-standard admin command that sets a TTL in
+// milliseconds on every key matching a glob pattern. It logs a PEXPIREAT
+// for each key it changed to the AOF itself, since the pattern alone would
+// match different keys on replay; see propagate.
+func (db *Database) pexpirePattern(parts []string) string {
+	deadline, errReply := db.parseTTL(parts[2], time.Millisecond, "pexpirepattern", false)
+	if errReply != "" {
+		return errReply
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var entry strings.Builder
+	count := 0
+	db.forEachKey(func(key string) {
+		if match(parts[1], key) {
+			db.setExpiry(key, deadline)
+			db.notify(notifyGeneric, "expire", key)
+			count++
+			appendMultiBulk(&entry, []string{"PEXPIREAT", key, strconv.FormatInt(deadline.UnixMilli(), 10)})
+		}
+	})
+	if db.aof != nil && entry.Len() > 0 {
+		db.aof.write(entry.String())
+	}
+	return fmt.Sprintf(":%d\r\n", count)
+}
+
+// parseTTL converts a relative TTL argument counted in unit into an absolute
+// deadline. It returns an error reply for non-integers, for values that
+// would overflow time.Duration, and, when positive is set, for values that
+// are not greater than zero.
+func (db *Database) parseTTL(arg string, unit time.Duration, cmd string, positive bool) (time.Time, string) {
+	n, err := strconv.ParseInt(arg, 10, 64)
+	if err != nil {
+		return time.Time{}, errorResponse("value is not an integer or out of range")
+	}
+	max := int64(math.MaxInt64 / unit)
+	if n > max || n < -max || (positive && n <= 0) {
+		return time.Time{}, errorResponse(fmt.Sprintf("invalid expire time in '%s' command", cmd))
+	}
+	return db.now().Add(time.Duration(n) * unit), ""
+}
+
+// match reports whether key matches the glob pattern the way Redis's KEYS
+// does: '*' matches any run of bytes, '?' any single byte, "[abc]" one of
+// a set (with ranges like "[a-z]" and negation like "[^a]"), and '\\'
+// makes the next byte literal. '*' is matched greedily, backtracking to
+// the most recent star on a mismatch.
+func match(pattern, key string) bool {
+	i, j := 0, 0
+	star, mark := -1, 0
+	for j < len(key) {
+		if i < len(pattern) && pattern[i] == '*' {
+			star, mark = i, j
+			i++
+			continue
+		}
+		if i < len(pattern) {
+			if next, ok := matchByte(pattern, i, key[j]); ok {
+				i = next
+				j++
+				continue
+			}
+		}
+		if star < 0 {
+			return false
+		}
+		mark++
+		i, j = star+1, mark
+	}
+	for i < len(pattern) && pattern[i] == '*' {
+		i++
+	}
+	return i == len(pattern)
+}
+
+// matchByte matches c against the single non-star pattern element starting
+// at pattern[i], returning the index just past that element.
+func matchByte(pattern string, i int, c byte) (int, bool) {
+	switch pattern[i] {
+	case '?':
+		return i + 1, true
+	case '\\':
+		if i+1 < len(pattern) {
+			return i + 2, pattern[i+1] == c
+		}
+	case '[':
+		return matchClass(pattern, i+1, c)
+	}
+	return i + 1, pattern[i] == c
+}
+
+// matchClass matches c against the character class whose body starts at
+// pattern[i], just after the '['. An unterminated class runs to the end of
+// the pattern, as in Redis.
+func matchClass(pattern string, i int, c byte) (int, bool) {
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+	found := false
+	for ; i < len(pattern) && pattern[i] != ']'; i++ {
+		switch {
+		case pattern[i] == '\\' && i+1 < len(pattern):
+			i++
+			found = found || pattern[i] == c
+		case i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']':
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			found = found || (lo <= c && c <= hi)
+			i += 2
+		default:
+			found = found || pattern[i] == c
+		}
+	}
+	if i < len(pattern) {
+		i++ // skip ']'
+	}
+	return i, found != negate
+}
+
+// keys lists the keys matching pattern, optionally only those of type typ.
+func (db *Database) keys(pattern, typ string) string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var result []string
+	db.forEachKey(func(key string) {
+		if match(pattern, key) && (typ == "" || db.typeOf(key) == typ) {
+			result = append(result, key)
+		}
+	})
+	if db.keysWarnThreshold > 0 && len(result) > db.keysWarnThreshold {
+		fmt.Printf("Warning: KEYS %s returned %d keys; KEYS is O(N) and blocks every other client\n", pattern, len(result))
+	}
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(result)))
+	for _, key := range result {
+		response.WriteString(bulkString(key))
+	}
+	return response.String()
+}
+
+// scan implements SCAN. Keys are visited in sorted order and the cursor is
+// the hex-encoded last key examined, so each call resumes just after it.
+// Every key present for the whole scan is returned exactly once, however
+// many other keys are added or removed meanwhile. COUNT is how many keys
+// to examine per call; MATCH and TYPE filter those keys, so a batch may
+// hold fewer than COUNT, or none, before the end.
+func (db *Database) scan(parts []string) string {
+	started := parts[1] != "0"
+	after, err := hex.DecodeString(parts[1])
+	if started && err != nil {
+		return errorResponse("invalid cursor")
+	}
+	pattern, typ, count := "*", "", 10
+	for i := 2; i < len(parts); i += 2 {
+		if i+1 == len(parts) {
+			return errorResponse("syntax error")
+		}
+		switch strings.ToUpper(parts[i]) {
+		case "MATCH":
+			pattern = parts[i+1]
+		case "TYPE":
+			typ = strings.ToLower(parts[i+1])
+		case "COUNT":
+			count, err = strconv.Atoi(parts[i+1])
+			if err != nil {
+				return errorResponse("value is not an integer or out of range")
+			}
+			if count < 1 {
+				return errorResponse("syntax error")
+			}
+		default:
+			return errorResponse("syntax error")
+		}
+	}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	// Keep the count smallest keys after the cursor, in order, rather than
+	// sorting the whole keyspace.
+	var names []string
+	more := false
+	db.forEachKey(func(key string) {
+		if started && key <= string(after) {
+			return
+		}
+		if len(names) == count {
+			more = true
+			if key > names[count-1] {
+				return
+			}
+			names = names[:count-1]
+		}
+		i, _ := slices.BinarySearch(names, key)
+		names = slices.Insert(names, i, key)
+	})
+
+	var batch []string
+	for _, key := range names {
+		if match(pattern, key) && (typ == "" || db.typeOf(key) == typ) {
+			batch = append(batch, key)
+		}
+	}
+	next := "0"
+	if more {
+		next = hex.EncodeToString([]byte(names[len(names)-1]))
+	}
+	var response strings.Builder
+	response.WriteString("*2\r\n")
+	response.WriteString(bulkString(next))
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(batch)))
+	for _, key := range batch {
+		response.WriteString(bulkString(key))
+	}
+	return response.String()
+}
+
+// dbsize replies with the number of live keys of every type.
+func (db *Database) dbsize() string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	count := 0
+	db.forEachKey(func(string) {
+		count++
+	})
+	return fmt.Sprintf(":%d\r\n", count)
+}
+
+// flush implements FLUSHDB and FLUSHALL, removing every key. The keyspace
+// is swapped for an empty one under the lock; with ASYNC the old one is
+// then left to the lazyfree worker, otherwise it is released before the
+// reply.
+func (db *Database) flush(parts []string) string {
+	async := false
+	if len(parts) > 2 {
+		return errorResponse("syntax error")
+	}
+	if len(parts) == 2 {
+		switch strings.ToUpper(parts[1]) {
+		case "ASYNC":
+			async = true
+		case "SYNC":
+		default:
+			return errorResponse("syntax error")
+		}
+	}
+	db.mu.Lock()
+	detached := db.clearKeyspace()
+	db.mu.Unlock()
+
+	// The old keyspace is unreachable now, so it is released without
+	// the lock either way; SYNC only waits for that before replying.
+	for _, value := range detached {
+		if async {
+			db.freeLater(value)
+		} else {
+			release(value)
+		}
+	}
+	return "+OK\r\n"
+}
+
+// clearKeyspace empties the dataset and returns the value maps it
+// detached, for the caller to release. The caller must hold db.mu.
+func (db *Database) clearKeyspace() []any {
+	detached := []any{db.sortedSet, db.hashes, db.lists, db.sets}
+	db.data.Clear()
+	db.expiry = make(map[string]time.Time)
+	db.sortedSet = make(map[string]*zset)
+	db.hashes = make(map[string]map[string]string)
+	db.lists = make(map[string][]string)
+	db.sets = make(map[string]map[string]struct{})
+	db.accessed = make(map[string]time.Time)
+	db.ttlHeap = nil
+	db.ttlEntries = make(map[string]*expiryEntry)
+	db.forcedEncoding = make(map[string]string)
+	return detached
+}
+
+// ttl implements TTL and PTTL, reporting the remaining time in unit. It
+// replies -2 for a missing key and -1 for a key without a TTL.
+func (db *Database) ttl(parts []string, unit time.Duration) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	info := db.keyInfo(parts[1])
+	switch {
+	case !info.exists:
+		return ":-2\r\n"
+	case info.ttl < 0:
+		return ":-1\r\n"
+	}
+	return fmt.Sprintf(":%d\r\n", int64(info.ttl/unit))
+}
+
+const (
+	skiplistMaxLevel = 32
+	skiplistP        = 0.25
+)
+
+type skiplistLevel struct {
+	forward *skiplistNode
+	span    int // number of nodes skipped by forward
+}
+
+type skiplistNode struct {
+	member   string
+	score    float64
+	backward *skiplistNode
+	level    []skiplistLevel
+}
+
+// skiplist orders sorted set members by score, then member, and supports
+// insertion, deletion and rank lookups in O(log n).
+type skiplist struct {
+	header *skiplistNode
+	tail   *skiplistNode
+	length int
+	level  int
+}
+
+func newSkiplist() *skiplist {
+	return &skiplist{
+		header: &skiplistNode{level: make([]skiplistLevel, skiplistMaxLevel)},
+		level:  1,
+	}
+}
+
+func randomSkiplistLevel() int {
+	level := 1
+	for level < skiplistMaxLevel && rand.Float64() < skiplistP {
+		level++
+	}
+	return level
+}
+
+// before reports whether node sorts before (score, member).
+func (node *skiplistNode) before(score float64, member string) bool {
+	return node.score < score || (node.score == score && node.member < member)
+}
+
+func (zsl *skiplist) insert(score float64, member string) {
+	var update [skiplistMaxLevel]*skiplistNode
+	var rank [skiplistMaxLevel]int
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		if i < zsl.level-1 {
+			rank[i] = rank[i+1]
+		}
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			rank[i] += x.level[i].span
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+
+	level := randomSkiplistLevel()
+	if level > zsl.level {
+		for i := zsl.level; i < level; i++ {
+			update[i] = zsl.header
+			update[i].level[i].span = zsl.length
+		}
+		zsl.level = level
+	}
+	x = &skiplistNode{member: member, score: score, level: make([]skiplistLevel, level)}
+	for i := 0; i < level; i++ {
+		x.level[i].forward = update[i].level[i].forward
+		update[i].level[i].forward = x
+		x.level[i].span = update[i].level[i].span - (rank[0] - rank[i])
+		update[i].level[i].span = rank[0] - rank[i] + 1
+	}
+	for i := level; i < zsl.level; i++ {
+		update[i].level[i].span++
+	}
+
+	if update[0] != zsl.header {
+		x.backward = update[0]
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x
+	} else {
+		zsl.tail = x
+	}
+	zsl.length++
+}
+
+func (zsl *skiplist) delete(score float64, member string) bool {
+	var update [skiplistMaxLevel]*skiplistNode
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && x.level[i].forward.before(score, member) {
+			x = x.level[i].forward
+		}
+		update[i] = x
+	}
+	x = x.level[0].forward
+	if x == nil || x.score != score || x.member != member {
+		return false
+	}
+
+	for i := 0; i < zsl.level; i++ {
+		if update[i].level[i].forward == x {
+			update[i].level[i].span += x.level[i].span - 1
+			update[i].level[i].forward = x.level[i].forward
+		} else {
+			update[i].level[i].span--
+		}
+	}
+	if x.level[0].forward != nil {
+		x.level[0].forward.backward = x.backward
+	} else {
+		zsl.tail = x.backward
+	}
+	for zsl.level > 1 && zsl.header.level[zsl.level-1].forward == nil {
+		zsl.level--
+	}
+	zsl.length--
+	return true
+}
+
+// rank returns the 1-based rank of (score, member), or 0 if it is absent.
+func (zsl *skiplist) rank(score float64, member string) int {
+	rank := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !(score < x.level[i].forward.score ||
+			(score == x.level[i].forward.score && member < x.level[i].forward.member)) {
+			rank += x.level[i].span
+			x = x.level[i].forward
+		}
+		if x != zsl.header && x.member == member {
+			return rank
+		}
+	}
+	return 0
+}
+
+// firstWhere returns the first node for which ok holds, given that ok is
+// false for a prefix of the list and true for the rest.
+func (zsl *skiplist) firstWhere(ok func(*skiplistNode) bool) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && !ok(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	return x.level[0].forward
+}
+
+// lastWhere returns the last node for which ok holds, given that ok is true
+// for a prefix of the list and false for the rest.
+func (zsl *skiplist) lastWhere(ok func(*skiplistNode) bool) *skiplistNode {
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && ok(x.level[i].forward) {
+			x = x.level[i].forward
+		}
+	}
+	if x == zsl.header {
+		return nil
+	}
+	return x
+}
+
+// byRank returns the node at the given 1-based rank, or nil.
+func (zsl *skiplist) byRank(rank int) *skiplistNode {
+	traversed := 0
+	x := zsl.header
+	for i := zsl.level - 1; i >= 0; i-- {
+		for x.level[i].forward != nil && traversed+x.level[i].span <= rank {
+			traversed += x.level[i].span
+			x = x.level[i].forward
+		}
+		if traversed == rank {
+			return x
+		}
+	}
+	return nil
+}
+
+// zset is a sorted set: a member to score map for O(1) score lookups plus
+// a skiplist for ordered range and rank queries.
+type zset struct {
+	dict map[string]float64
+	zsl  *skiplist
+}
+
+func newZset() *zset {
+	return &zset{dict: make(map[string]float64), zsl: newSkiplist()}
+}
+
+func (z *zset) len() int {
+	return len(z.dict)
+}
+
+// add inserts member or moves it to its new score.
+func (z *zset) add(member string, score float64) {
+	if current, ok := z.dict[member]; ok {
+		if current == score {
+			return
+		}
+		z.zsl.delete(current, member)
+	}
+	z.dict[member] = score
+	z.zsl.insert(score, member)
+}
+
+func (z *zset) remove(member string) bool {
+	score, ok := z.dict[member]
+	if !ok {
+		return false
+	}
+	delete(z.dict, member)
+	z.zsl.delete(score, member)
+	return true
+}
+
+func (db *Database) zadd(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var nx, xx, gt, lt, ch, incr bool
+	i := 2
+flags:
+	for ; i < len(parts); i++ {
+		switch strings.ToUpper(parts[i]) {
+		case "NX":
+			nx = true
+		case "XX":
+			xx = true
+		case "GT":
+			gt = true
+		case "LT":
+			lt = true
+		case "CH":
+			ch = true
+		case "INCR":
+			incr = true
+		default:
+			break flags
+		}
+	}
+	pairs := parts[i:]
+	if len(pairs) == 0 || len(pairs)%2 != 0 {
+		return errorResponse("syntax error")
+	}
+	if nx && xx {
+		return errorResponse("XX and NX options at the same time are not compatible")
+	}
+	if (gt && lt) || (nx && (gt || lt)) {
+		return errorResponse("GT, LT, and/or NX options at the same time are not compatible")
+	}
+	if incr && len(pairs) > 2 {
+		return errorResponse("INCR option supports a single increment-element pair")
+	}
+
+	// Validate every score before applying any so a bad one leaves the
+	// set untouched.
+	scores := make([]float64, 0, len(pairs)/2)
+	for j := 0; j < len(pairs); j += 2 {
+		score, errReply := parseScore(pairs[j])
+		if errReply != "" {
+			return errReply
+		}
+		scores = append(scores, score)
+	}
+
+	key := parts[1]
+	set, ok := db.getSortedSet(key)
+	if !ok {
+		if db.keyExists(key) {
+			return wrongTypeResponse
+		}
+		if xx {
+			// Nothing can be added, so don't create an empty set.
+			if incr {
+				return "$-1\r\n"
+			}
+			return ":0\r\n"
+		}
+		set = newZset()
+		db.sortedSet[key] = set
+		db.notify(notifyNew, "new", key)
+	}
+	db.touch(key)
+	db.signalKey(key)
+
+	added, changed := 0, 0
+	for j, score := range scores {
+		member := pairs[2*j+1]
+		current, exists := set.dict[member]
+		if (nx && exists) || (xx && !exists) {
+			continue
+		}
+		if incr {
+			if exists {
+				score += current
+			}
+			if math.IsNaN(score) {
+				return errorResponse("resulting score is not a number (NaN)")
+			}
+		}
+		// GT and LT only restrict updates; new members are always added.
+		if exists && ((gt && score <= current) || (lt && score >= current)) {
+			continue
+		}
+		if !exists {
+			added++
+		} else if score != current {
+			changed++
+		}
+		set.add(member, score)
+		if incr {
+			db.notify(notifyZset, "zincr", key)
+			return bulkString(formatIncrFloat(score))
+		}
+	}
+	if added+changed > 0 {
+		db.notify(notifyZset, "zadd", key)
+	}
+	if incr {
+		// The NX/XX/GT/LT condition rejected the increment.
+		return "$-1\r\n"
+	}
+	if ch {
+		return fmt.Sprintf(":%d\r\n", added+changed)
+	}
+	return fmt.Sprintf(":%d\r\n", added)
+}
+
+// zincrby is ZADD with the INCR flag, as it is in Redis: it creates the
+// set and member as needed and replies with the new score.
+func (db *Database) zincrby(parts []string) string {
+	return db.zadd([]string{"ZADD", parts[1], "INCR", parts[2], parts[3]})
+}
+
+func (db *Database) zscore(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	set, ok := db.getSortedSet(parts[1])
+	if !ok {
+		db.notify(notifyKeyMiss, "keymiss", parts[1])
+		return "$-1\r\n"
+	}
+	db.touch(parts[1])
+	score, ok := set.dict[parts[2]]
+	if !ok {
+		return "$-1\r\n"
+	}
+	return bulkString(formatScore(score))
+}
+
+// zrem removes members from a sorted set, deleting the key once it is
+// empty.
+func (db *Database) zrem(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	set, ok := db.getSortedSet(key)
+	if !ok {
+		return ":0\r\n"
+	}
+	removed := 0
+	for _, member := range parts[2:] {
+		if set.remove(member) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		db.notify(notifyZset, "zrem", key)
+	}
+	if set.len() == 0 {
+		db.deleteKey(key)
+		db.notify(notifyGeneric, "del", key)
+	} else {
+		db.touch(key)
+	}
+	return fmt.Sprintf(":%d\r\n", removed)
+}
+
+func (db *Database) zcard(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	set, ok := db.getSortedSet(parts[1])
+	if !ok {
+		return ":0\r\n"
+	}
+	db.touch(parts[1])
+	return fmt.Sprintf(":%d\r\n", set.len())
+}
+
+// zrank implements ZRANK and ZREVRANK, replying with the member's 0-based
+// position in the same order ZRANGE and ZREVRANGE return.
+func (db *Database) zrank(parts []string, rev bool) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	set, ok := db.getSortedSet(parts[1])
+	if !ok {
+		return "$-1\r\n"
+	}
+	db.touch(parts[1])
+	score, ok := set.dict[parts[2]]
+	if !ok {
+		return "$-1\r\n"
+	}
+	rank := set.zsl.rank(score, parts[2]) - 1
+	if rev {
+		rank = set.len() - 1 - rank
+	}
+	return fmt.Sprintf(":%d\r\n", rank)
+}
+
+func (db *Database) zmpop(parts []string) string {
+	keys, min, count, errReply := parseMpopArgs(parts[1:], [2]string{"MIN", "MAX"})
+	if errReply != "" {
+		return errReply
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, key := range keys {
+		if popped := db.zpop(key, !min, count); len(popped) > 0 {
+			return formatZpop(key, popped)
+		}
+	}
+	return "*-1\r\n"
+}
+
+func (db *Database) bzmpop(c *client, parts []string) string {
+	deadline, errReply := parseBlockTimeout(parts[1])
+	if errReply != "" {
+		return errReply
+	}
+	keys, min, count, errReply := parseMpopArgs(parts[2:], [2]string{"MIN", "MAX"})
+	if errReply != "" {
+		return errReply
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for {
+		for _, key := range keys {
+			if popped := db.zpop(key, !min, count); len(popped) > 0 {
+				return formatZpop(key, popped)
+			}
+		}
+		if !db.block(c, keys, deadline) {
+			return "*-1\r\n"
+		}
+	}
+}
+
+// parseBlockTimeout parses a blocking command's timeout in seconds into a
+// deadline. A timeout of zero blocks forever and yields the zero time.
+func parseBlockTimeout(arg string) (time.Time, string) {
+	seconds, err := strconv.ParseFloat(arg, 64)
+	if err != nil || math.IsNaN(seconds) || math.IsInf(seconds, 0) {
+		return time.Time{}, errorResponse("timeout is not a float or out of range")
+	}
+	if seconds < 0 {
+		return time.Time{}, errorResponse("timeout is negative")
+	}
+	if seconds == 0 {
+		return time.Time{}, ""
+	}
+	return time.Now().Add(time.Duration(seconds * float64(time.Second))), ""
+}
+
+// block waits until one of keys is signalled or deadline passes, reporting
+// whether it was signalled. A zero deadline waits forever. c, if not nil,
+// is marked blocked meanwhile and stops waiting when it is killed. The
+// caller must hold db.scriptMu for reading, db.mu, and db.writeMu while
+// the AOF is on; all are released while waiting and held again on return.
+func (db *Database) block(c *client, keys []string, deadline time.Time) bool {
+	ch := make(chan struct{}, 1)
+	for _, key := range keys {
+		db.waiters[key] = append(db.waiters[key], ch)
+	}
+	var killed <-chan struct{}
+	if c != nil {
+		c.blocked = true
+		killed = c.killed
+	}
+	db.mu.Unlock()
+	if db.aof != nil {
+		db.writeMu.Unlock()
+	}
+	db.scriptMu.RUnlock()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timer := time.NewTimer(time.Until(deadline))
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	woken := true
+	select {
+	case <-ch:
+	case <-timeout:
+		woken = false
+	case <-killed:
+		woken = false
+	}
+
+	db.scriptMu.RLock()
+	if db.aof != nil {
+		db.writeMu.Lock()
+	}
+	db.mu.Lock()
+	if c != nil {
+		c.blocked = false
+	}
+	for _, key := range keys {
+		waiting := db.waiters[key]
+		for i, w := range waiting {
+			if w == ch {
+				waiting = append(waiting[:i], waiting[i+1:]...)
+				break
+			}
+		}
+		if len(waiting) == 0 {
+			delete(db.waiters, key)
+		} else {
+			db.waiters[key] = waiting
+		}
+	}
+	return woken
+}
+
+// signalKey wakes every client blocked on key. Woken clients retry once
+// they reacquire db.mu, so a client that loses the race blocks again. The
+// caller must hold db.mu.
+func (db *Database) signalKey(key string) {
+	for _, ch := range db.waiters[key] {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// parseMpopArgs parses the "numkeys key [key ...] where [COUNT count]"
+// arguments shared by the multi-key pop commands. where lists the two
+// accepted direction words; first reports whether the first one was given.
+func parseMpopArgs(args []string, where [2]string) (keys []string, first bool, count int, errReply string) {
+	numkeys, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, false, 0, errorResponse("value is not an integer or out of range")
+	}
+	if numkeys <= 0 {
+		return nil, false, 0, errorResponse("numkeys should be greater than 0")
+	}
+	rest := args[1:]
+	if len(rest) < numkeys+1 {
+		return nil, false, 0, errorResponse("syntax error")
+	}
+	keys, rest = rest[:numkeys], rest[numkeys:]
+	switch strings.ToUpper(rest[0]) {
+	case where[0]:
+		first = true
+	case where[1]:
+	default:
+		return nil, false, 0, errorResponse("syntax error")
+	}
+	count = 1
+	switch {
+	case len(rest) == 3 && strings.ToUpper(rest[1]) == "COUNT":
+		if count, err = strconv.Atoi(rest[2]); err != nil || count <= 0 {
+			return nil, false, 0, errorResponse("count should be greater than 0")
+		}
+	case len(rest) != 1:
+		return nil, false, 0, errorResponse("syntax error")
+	}
+	return keys, first, count, ""
+}
+
+// zpop removes up to count members with the lowest scores, or the highest
+// when max is set, from the sorted set at key, deleting the key once it is
+// empty. The caller must hold db.mu.
+func (db *Database) zpop(key string, max bool, count int) []*skiplistNode {
+	set, ok := db.getSortedSet(key)
+	if !ok {
+		return nil
+	}
+	var popped []*skiplistNode
+	for len(popped) < count && set.len() > 0 {
+		node := set.zsl.header.level[0].forward
+		if max {
+			node = set.zsl.tail
+		}
+		set.remove(node.member)
+		popped = append(popped, node)
+	}
+	if len(popped) > 0 {
+		if max {
+			db.notify(notifyZset, "zpopmax", key)
+		} else {
+			db.notify(notifyZset, "zpopmin", key)
+		}
+	}
+	if set.len() == 0 {
+		db.deleteKey(key)
+		db.notify(notifyGeneric, "del", key)
+	}
+	return popped
+}
+
+// formatZpop renders a multi-key pop reply: the key followed by its popped
+// member and score pairs.
+func formatZpop(key string, popped []*skiplistNode) string {
+	var response strings.Builder
+	response.WriteString("*2\r\n")
+	response.WriteString(bulkString(key))
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(popped)))
+	for _, node := range popped {
+		response.WriteString("*2\r\n")
+		response.WriteString(bulkString(node.member))
+		response.WriteString(bulkString(formatScore(node.score)))
+	}
+	return response.String()
+}
+
+// getSortedSet returns the sorted set stored at key, lazily removing it if
+// it has expired. The caller must hold db.mu.
+func (db *Database) getSortedSet(key string) (*zset, bool) {
+	set, ok := db.sortedSet[key]
+	if !ok {
+		return nil, false
+	}
+	if db.isExpired(key) {
+		db.expireKey(key)
+		return nil, false
+	}
+	return set, true
+}
+
+// formatScore formats a score the way Redis replies with it: the shortest
+// representation that round-trips, and inf/-inf for the infinities.
+func formatScore(score float64) string {
+	switch {
+	case math.IsInf(score, 1):
+		return "inf"
+	case math.IsInf(score, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(score, 'g', -1, 64)
+}
+
+// parseScore parses a sorted set score. Like Redis it accepts inf, +inf and
+// -inf, but rejects NaN since it cannot be ordered.
+func parseScore(s string) (float64, string) {
+	score, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, "-ERR invalid score\r\n"
+	}
+	if math.IsNaN(score) {
+		return 0, errorResponse("not a valid float")
+	}
+	return score, ""
+}
+
+const (
+	zrangeByRank = iota
+	zrangeByScore
+	zrangeByLex
+)
+
+// zrangeQuery is a parsed ZRANGE request. The legacy ZREVRANGE,
+// ZRANGEBYSCORE and ZRANGEBYLEX families build one directly, so every
+// range command shares the same implementation.
+type zrangeQuery struct {
+	key        string
+	start      string // start index or the first bound as given
+	stop       string // stop index or the second bound as given
+	by         int
+	rev        bool
+	withScores bool
+	limited    bool
+	offset     int
+	count      int
+}
+
+func (db *Database) zrange(parts []string) string {
+	q := zrangeQuery{key: parts[1], start: parts[2], stop: parts[3]}
+	if errReply := parseZrangeOptions(&q, parts[4:], true); errReply != "" {
+		return errReply
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.runZrange(q)
+}
+
+// zrangeLegacy serves ZREVRANGE, ZRANGEBYSCORE, ZREVRANGEBYSCORE,
+// ZRANGEBYLEX and ZREVRANGEBYLEX as their ZRANGE equivalents.
+func (db *Database) zrangeLegacy(parts []string) string {
+	name := strings.ToUpper(parts[0])
+	q := zrangeQuery{key: parts[1], start: parts[2], stop: parts[3]}
+	q.rev = strings.HasPrefix(name, "ZREV")
+	switch {
+	case strings.HasSuffix(name, "BYSCORE"):
+		q.by = zrangeByScore
+	case strings.HasSuffix(name, "BYLEX"):
+		q.by = zrangeByLex
+	}
+	if errReply := parseZrangeOptions(&q, parts[4:], false); errReply != "" {
+		return errReply
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.runZrange(q)
+}
+
+// parseZrangeOptions applies the trailing ZRANGE options to q. BYSCORE,
+// BYLEX and REV are only accepted when allowBy is set, as the legacy
+// commands imply them by name.
+func parseZrangeOptions(q *zrangeQuery, args []string, allowBy bool) string {
+	for i := 0; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "BYSCORE":
+			if !allowBy {
+				return errorResponse("syntax error")
+			}
+			q.by = zrangeByScore
+		case "BYLEX":
+			if !allowBy {
+				return errorResponse("syntax error")
+			}
+			q.by = zrangeByLex
+		case "REV":
+			if !allowBy {
+				return errorResponse("syntax error")
+			}
+			q.rev = true
+		case "WITHSCORES":
+			q.withScores = true
+		case "LIMIT":
+			if i+2 >= len(args) {
+				return errorResponse("syntax error")
+			}
+			offset, err1 := strconv.Atoi(args[i+1])
+			count, err2 := strconv.Atoi(args[i+2])
+			if err1 != nil || err2 != nil {
+				return errorResponse("value is not an integer or out of range")
+			}
+			q.limited, q.offset, q.count = true, offset, count
+			i += 2
+		default:
+			return errorResponse("syntax error")
+		}
+	}
+	if q.limited && q.by == zrangeByRank {
+		return errorResponse("syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX")
+	}
+	if q.withScores && q.by == zrangeByLex {
+		return errorResponse("syntax error, WITHSCORES not supported in combination with BYLEX")
+	}
+	return ""
+}
+
+// normalizeRange resolves an inclusive start..end range over length
+// elements, counting negative indices from the tail and clamping to the
+// bounds. It reports false when the range selects nothing.
+func normalizeRange(start, end, length int) (int, int, bool) {
+	if start < 0 {
+		start += length
+	}
+	if end < 0 {
+		end += length
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end >= length {
+		end = length - 1
+	}
+	if start > end || start >= length {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// runZrange executes q and renders the matching members as an array. The
+// caller must hold db.mu.
+func (db *Database) runZrange(q zrangeQuery) string {
+	var nodes []*skiplistNode
+	set, ok := db.getSortedSet(q.key)
+
+	if q.by == zrangeByRank {
+		start, err := strconv.Atoi(q.start)
+		if err != nil {
+			return "-ERR invalid start index\r\n"
+		}
+		end, err := strconv.Atoi(q.stop)
+		if err != nil {
+			return "-ERR invalid end index\r\n"
+		}
+		if !ok {
+			return "*0\r\n"
+		}
+		db.touch(q.key)
+		length := set.len()
+		start, end, ok = normalizeRange(start, end, length)
+		if !ok {
+			return "*0\r\n"
+		}
+		// In reverse, rank 0 is the highest score.
+		if q.rev {
+			node := set.zsl.byRank(length - start)
+			for i := start; i <= end; i++ {
+				nodes = append(nodes, node)
+				node = node.backward
+			}
+		} else {
+			node := set.zsl.byRank(start + 1)
+			for i := start; i <= end; i++ {
+				nodes = append(nodes, node)
+				node = node.level[0].forward
+			}
+		}
+		return formatZrange(nodes, q.withScores)
+	}
+
+	// In reverse the bounds are given highest first.
+	low, high := q.start, q.stop
+	if q.rev {
+		low, high = high, low
+	}
+	var aboveLow, belowHigh func(*skiplistNode) bool
+	if q.by == zrangeByScore {
+		min, minOK := parseScoreBound(low)
+		max, maxOK := parseScoreBound(high)
+		if !minOK || !maxOK {
+			return errorResponse("min or max is not a float")
+		}
+		aboveLow = func(n *skiplistNode) bool {
+			return n.score > min.value || (!min.exclusive && n.score == min.value)
+		}
+		belowHigh = func(n *skiplistNode) bool {
+			return n.score < max.value || (!max.exclusive && n.score == max.value)
+		}
+	} else {
+		min, minOK := parseLexBound(low)
+		max, maxOK := parseLexBound(high)
+		if !minOK || !maxOK {
+			return errorResponse("min or max not valid string range item")
+		}
+		aboveLow = min.below
+		belowHigh = max.above
+	}
+	if !ok || (q.limited && q.offset < 0) {
+		return "*0\r\n"
+	}
+	db.touch(q.key)
+
+	var node *skiplistNode
+	inRange := belowHigh
+	if q.rev {
+		node = set.zsl.lastWhere(belowHigh)
+		inRange = aboveLow
+	} else {
+		node = set.zsl.firstWhere(aboveLow)
+	}
+	skip := q.offset
+	for node != nil && inRange(node) {
+		if q.limited && q.count >= 0 && len(nodes) >= q.count {
+			break
+		}
+		if skip > 0 {
+			skip--
+		} else {
+			nodes = append(nodes, node)
+		}
+		if q.rev {
+			node = node.backward
+		} else {
+			node = node.level[0].forward
+		}
+	}
+	return formatZrange(nodes, q.withScores)
+}
+
+func formatZrange(nodes []*skiplistNode, withScores bool) string {
+	var response strings.Builder
+	if withScores {
+		response.WriteString(fmt.Sprintf("*%d\r\n", 2*len(nodes)))
+	} else {
+		response.WriteString(fmt.Sprintf("*%d\r\n", len(nodes)))
+	}
+	for _, node := range nodes {
+		response.WriteString(bulkString(node.member))
+		if withScores {
+			response.WriteString(bulkString(formatScore(node.score)))
+		}
+	}
+	return response.String()
+}
+
+// scoreBound is a BYSCORE range bound such as 1.5, (1.5 or -inf.
+type scoreBound struct {
+	value     float64
+	exclusive bool
+}
+
+func parseScoreBound(s string) (scoreBound, bool) {
+	var bound scoreBound
+	if strings.HasPrefix(s, "(") {
+		bound.exclusive = true
+		s = s[1:]
+	}
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(value) {
+		return bound, false
+	}
+	bound.value = value
+	return bound, true
+}
+
+// lexBound is a BYLEX range bound: [member, (member, - or +.
+type lexBound struct {
+	value     string
+	exclusive bool
+	minusInf  bool
+	plusInf   bool
+}
+
+func parseLexBound(s string) (lexBound, bool) {
+	switch {
+	case s == "-":
+		return lexBound{minusInf: true}, true
+	case s == "+":
+		return lexBound{plusInf: true}, true
+	case strings.HasPrefix(s, "["):
+		return lexBound{value: s[1:]}, true
+	case strings.HasPrefix(s, "("):
+		return lexBound{value: s[1:], exclusive: true}, true
+	}
+	return lexBound{}, false
+}
+
+// below reports whether n is at or above b when b is used as a minimum.
+func (b lexBound) below(n *skiplistNode) bool {
+	switch {
+	case b.minusInf:
+		return true
+	case b.plusInf:
+		return false
+	}
+	return n.member > b.value || (!b.exclusive && n.member == b.value)
+}
+
+// above reports whether n is at or below b when b is used as a maximum.
+func (b lexBound) above(n *skiplistNode) bool {
+	switch {
+	case b.plusInf:
+		return true
+	case b.minusInf:
+		return false
+	}
+	return n.member < b.value || (!b.exclusive && n.member == b.value)
+}
+
+func (db *Database) hset(parts []string) string {
+	if len(parts)%2 != 0 {
+		return errorResponse("wrong number of arguments for 'HSET' command")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	hash, ok := db.getHash(key)
+	if !ok {
+		if db.keyExists(key) {
+			return wrongTypeResponse
+		}
+		hash = make(map[string]string)
+		db.hashes[key] = hash
+		db.notify(notifyNew, "new", key)
+	}
+	added := 0
+	for i := 2; i < len(parts); i += 2 {
+		if _, exists := hash[parts[i]]; !exists {
+			added++
+		}
+		hash[parts[i]] = parts[i+1]
+	}
+	db.touch(key)
+	db.notify(notifyHash, "hset", key)
+	return fmt.Sprintf(":%d\r\n", added)
+}
+
+// hincrbyfloat adds increment to the float stored in a hash field,
+// treating a missing field as 0, and replies with the result.
+func (db *Database) hincrbyfloat(parts []string) string {
+	delta, err := strconv.ParseFloat(parts[3], 64)
+	if err != nil || math.IsNaN(delta) {
+		return errorResponse("value is not a valid float")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key, field := parts[1], parts[2]
+	hash, ok := db.getHash(key)
+	if !ok && db.keyExists(key) {
+		return wrongTypeResponse
+	}
+	var n float64
+	value, exists := hash[field]
+	if exists {
+		if n, err = strconv.ParseFloat(value, 64); err != nil || math.IsNaN(n) {
+			return errorResponse("hash value is not a float")
+		}
+	}
+	n += delta
+	if math.IsNaN(n) || math.IsInf(n, 0) {
+		return errorResponse("increment would produce NaN or Infinity")
+	}
+	if !ok {
+		hash = make(map[string]string)
+		db.hashes[key] = hash
+		db.notify(notifyNew, "new", key)
+	}
+	result := formatIncrFloat(n)
+	hash[field] = result
+	db.touch(key)
+	db.notify(notifyHash, "hincrbyfloat", key)
+	return bulkString(result)
+}
+
+func (db *Database) hget(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	hash, ok := db.getHash(parts[1])
+	if !ok {
+		db.notify(notifyKeyMiss, "keymiss", parts[1])
+		return "$-1\r\n"
+	}
+	db.touch(parts[1])
+	value, ok := hash[parts[2]]
+	if !ok {
+		return "$-1\r\n"
+	}
+	return bulkString(value)
+}
+
+// hdel removes fields from a hash, deleting the key once it is empty.
+func (db *Database) hdel(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	hash, ok := db.getHash(key)
+	if !ok {
+		return ":0\r\n"
+	}
+	removed := 0
+	for _, field := range parts[2:] {
+		if _, exists := hash[field]; exists {
+			delete(hash, field)
+			removed++
+		}
+	}
+	if removed > 0 {
+		db.notify(notifyHash, "hdel", key)
+	}
+	if len(hash) == 0 {
+		db.deleteKey(key)
+		db.notify(notifyGeneric, "del", key)
+	} else {
+		db.touch(key)
+	}
+	return fmt.Sprintf(":%d\r\n", removed)
+}
+
+// hgetall replies with the hash's fields and values, alternating, ordered
+// by field so the reply is stable.
+func (db *Database) hgetall(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	hash, ok := db.getHash(parts[1])
+	if !ok {
+		return "*0\r\n"
+	}
+	db.touch(parts[1])
+	fields := sortedFields(hash)
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", 2*len(fields)))
+	for _, field := range fields {
+		response.WriteString(bulkString(field))
+		response.WriteString(bulkString(hash[field]))
+	}
+	return response.String()
+}
+
+func (db *Database) hexists(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	hash, ok := db.getHash(parts[1])
+	if !ok {
+		return ":0\r\n"
+	}
+	db.touch(parts[1])
+	if _, ok := hash[parts[2]]; !ok {
+		return ":0\r\n"
+	}
+	return ":1\r\n"
+}
+
+// hkeys implements HKEYS and HVALS. Both are ordered by field, like
+// HGETALL, so the two replies line up.
+func (db *Database) hkeys(parts []string, values bool) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	hash, ok := db.getHash(parts[1])
+	if !ok {
+		return "*0\r\n"
+	}
+	db.touch(parts[1])
+	fields := sortedFields(hash)
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(fields)))
+	for _, field := range fields {
+		if values {
+			response.WriteString(bulkString(hash[field]))
+		} else {
+			response.WriteString(bulkString(field))
+		}
+	}
+	return response.String()
+}
+
+func (db *Database) hlen(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	hash, ok := db.getHash(parts[1])
+	if !ok {
+		return ":0\r\n"
+	}
+	db.touch(parts[1])
+	return fmt.Sprintf(":%d\r\n", len(hash))
+}
+
+// sortedFields returns the fields of hash in ascending order.
+func sortedFields[V any](hash map[string]V) []string {
+	fields := make([]string, 0, len(hash))
+	for field := range hash {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	return fields
+}
+
+// getHash returns the hash stored at key, lazily removing it if it has
+// expired. The caller must hold db.mu.
+func (db *Database) getHash(key string) (map[string]string, bool) {
+	hash, ok := db.hashes[key]
+	if !ok {
+		return nil, false
+	}
+	if db.isExpired(key) {
+		db.expireKey(key)
+		return nil, false
+	}
+	return hash, true
+}
+
+// push implements LPUSH and RPUSH. LPUSH inserts the values one at a time
+// at the head, so the last one given ends up first.
+func (db *Database) push(parts []string, left bool) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	list, ok := db.getList(key)
+	if !ok {
+		if db.keyExists(key) {
+			return wrongTypeResponse
+		}
+		db.notify(notifyNew, "new", key)
+	}
+	values := parts[2:]
+	if left {
+		head := make([]string, 0, len(values)+len(list))
+		for i := len(values) - 1; i >= 0; i-- {
+			head = append(head, values[i])
+		}
+		list = append(head, list...)
+	} else {
+		list = append(list, values...)
+	}
+	db.lists[key] = list
+	db.touch(key)
+	db.signalKey(key)
+	if left {
+		db.notify(notifyList, "lpush", key)
+	} else {
+		db.notify(notifyList, "rpush", key)
+	}
+	return fmt.Sprintf(":%d\r\n", len(list))
+}
+
+// pop implements LPOP and RPOP, deleting the key once the list is empty.
+func (db *Database) pop(parts []string, left bool) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	popped := db.popList(parts[1], left, 1)
+	if len(popped) == 0 {
+		return "$-1\r\n"
+	}
+	return bulkString(popped[0])
+}
+
+// lmpop implements LMPOP, popping from the first non-empty list among the
+// given keys.
+func (db *Database) lmpop(parts []string) string {
+	keys, left, count, errReply := parseMpopArgs(parts[1:], [2]string{"LEFT", "RIGHT"})
+	if errReply != "" {
+		return errReply
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for _, key := range keys {
+		if popped := db.popList(key, left, count); len(popped) > 0 {
+			return formatLmpop(key, popped)
+		}
+	}
+	return "*-1\r\n"
+}
+
+// blmpop implements BLMPOP, which blocks until one of the lists can be
+// popped or the timeout passes.
+func (db *Database) blmpop(c *client, parts []string) string {
+	deadline, errReply := parseBlockTimeout(parts[1])
+	if errReply != "" {
+		return errReply
+	}
+	keys, left, count, errReply := parseMpopArgs(parts[2:], [2]string{"LEFT", "RIGHT"})
+	if errReply != "" {
+		return errReply
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	for {
+		for _, key := range keys {
+			if popped := db.popList(key, left, count); len(popped) > 0 {
+				return formatLmpop(key, popped)
+			}
+		}
+		if !db.block(c, keys, deadline) {
+			return "*-1\r\n"
+		}
+	}
+}
+
+// popList removes up to count elements from the head of the list at key,
+// or from its tail unless left is set, in the order they are popped. The
+// key is deleted once the list is empty. The caller must hold db.mu.
+func (db *Database) popList(key string, left bool, count int) []string {
+	list, ok := db.getList(key)
+	if !ok {
+		return nil
+	}
+	count = min(count, len(list))
+	popped := make([]string, count)
+	if left {
+		copy(popped, list)
+		list = list[count:]
+		db.notify(notifyList, "lpop", key)
+	} else {
+		for i := range popped {
+			popped[i] = list[len(list)-1-i]
+		}
+		list = list[:len(list)-count]
+		db.notify(notifyList, "rpop", key)
+	}
+	if len(list) == 0 {
+		db.deleteKey(key)
+		db.notify(notifyGeneric, "del", key)
+	} else {
+		db.lists[key] = list
+		db.touch(key)
+	}
+	return popped
+}
+
+// formatLmpop renders a multi-key list pop reply: the key followed by the
+// popped elements.
+func formatLmpop(key string, popped []string) string {
+	var response strings.Builder
+	response.WriteString("*2\r\n")
+	response.WriteString(bulkString(key))
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(popped)))
+	for _, element := range popped {
+		response.WriteString(bulkString(element))
+	}
+	return response.String()
+}
+
+func (db *Database) lrange(parts []string) string {
+	start, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return errorResponse("value is not an integer or out of range")
+	}
+	end, err := strconv.Atoi(parts[3])
+	if err != nil {
+		return errorResponse("value is not an integer or out of range")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	list, ok := db.getList(parts[1])
+	if !ok {
+		return "*0\r\n"
+	}
+	db.touch(parts[1])
+	start, end, ok = normalizeRange(start, end, len(list))
+	if !ok {
+		return "*0\r\n"
+	}
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", end-start+1))
+	for _, element := range list[start : end+1] {
+		response.WriteString(bulkString(element))
+	}
+	return response.String()
+}
+
+func (db *Database) lindex(parts []string) string {
+	index, err := strconv.Atoi(parts[2])
+	if err != nil {
+		return errorResponse("value is not an integer or out of range")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	list, ok := db.getList(parts[1])
+	if !ok {
+		db.notify(notifyKeyMiss, "keymiss", parts[1])
+		return "$-1\r\n"
+	}
+	db.touch(parts[1])
+	if index < 0 {
+		index += len(list)
+	}
+	if index < 0 || index >= len(list) {
+		return "$-1\r\n"
+	}
+	return bulkString(list[index])
+}
+
+func (db *Database) llen(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	list, ok := db.getList(parts[1])
+	if !ok {
+		return ":0\r\n"
+	}
+	db.touch(parts[1])
+	return fmt.Sprintf(":%d\r\n", len(list))
+}
+
+// getList returns the list stored at key, lazily removing it if it has
+// expired. The caller must hold db.mu.
+func (db *Database) getList(key string) ([]string, bool) {
+	list, ok := db.lists[key]
+	if !ok {
+		return nil, false
+	}
+	if db.isExpired(key) {
+		db.expireKey(key)
+		return nil, false
+	}
+	return list, true
+}
+
+// sadd adds members to a set, creating it if needed, and replies with how
+// many were not already present.
+func (db *Database) sadd(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	set, ok := db.getSet(key)
+	if !ok {
+		if db.keyExists(key) {
+			return wrongTypeResponse
+		}
+		set = make(map[string]struct{})
+		db.sets[key] = set
+		db.notify(notifyNew, "new", key)
+	}
+	added := 0
+	for _, member := range parts[2:] {
+		if _, exists := set[member]; !exists {
+			set[member] = struct{}{}
+			added++
+		}
+	}
+	db.touch(key)
+	if added > 0 {
+		db.notify(notifySet, "sadd", key)
+	}
+	return fmt.Sprintf(":%d\r\n", added)
+}
+
+// srem removes members from a set, deleting the key once it is empty.
+func (db *Database) srem(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	key := parts[1]
+	set, ok := db.getSet(key)
+	if !ok {
+		return ":0\r\n"
+	}
+	removed := 0
+	for _, member := range parts[2:] {
+		if _, exists := set[member]; exists {
+			delete(set, member)
+			removed++
+		}
+	}
+	if removed > 0 {
+		db.notify(notifySet, "srem", key)
+	}
+	if len(set) == 0 {
+		db.deleteKey(key)
+		db.notify(notifyGeneric, "del", key)
+	} else {
+		db.touch(key)
+	}
+	return fmt.Sprintf(":%d\r\n", removed)
+}
+
+// smembers replies with the set's members.
+func (db *Database) smembers(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	set, ok := db.getSet(parts[1])
+	if !ok {
+		return "*0\r\n"
+	}
+	db.touch(parts[1])
+	return formatMembers(set)
+}
+
+// Set operations for combineSets.
+const (
+	setUnion = iota
+	setInter
+	setDiff
+)
+
+// combineSets implements SUNION, SINTER and SDIFF over the sets named in
+// parts, treating a missing key as the empty set. SDIFF subtracts every
+// other set from the first.
+func (db *Database) combineSets(parts []string, op int) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	sets := make([]map[string]struct{}, 0, len(parts)-1)
+	for _, key := range parts[1:] {
+		set, ok := db.getSet(key)
+		if ok {
+			db.touch(key)
+		}
+		sets = append(sets, set)
+	}
+
+	result := make(map[string]struct{})
+	switch op {
+	case setUnion:
+		for _, set := range sets {
+			for member := range set {
+				result[member] = struct{}{}
+			}
+		}
+	case setInter:
+		// Probe from the smallest set; an empty one empties the result.
+		smallest := sets[0]
+		for _, set := range sets[1:] {
+			if len(set) < len(smallest) {
+				smallest = set
+			}
+		}
+		if len(smallest) == 0 {
+			return "*0\r\n"
+		}
+	members:
+		for member := range smallest {
+			for _, set := range sets {
+				if _, ok := set[member]; !ok {
+					continue members
+				}
+			}
+			result[member] = struct{}{}
+		}
+	case setDiff:
+		for member := range sets[0] {
+			result[member] = struct{}{}
+		}
+		for _, set := range sets[1:] {
+			if len(result) == 0 {
+				break
+			}
+			for member := range set {
+				delete(result, member)
+			}
+		}
+	}
+	return formatMembers(result)
+}
+
+// formatMembers renders a set as an array of its members, sorted so the
+// reply is stable.
+func formatMembers(set map[string]struct{}) string {
+	members := sortedFields(set)
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(members)))
+	for _, member := range members {
+		response.WriteString(bulkString(member))
+	}
+	return response.String()
+}
+
+func (db *Database) sismember(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	set, ok := db.getSet(parts[1])
+	if !ok {
+		return ":0\r\n"
+	}
+	db.touch(parts[1])
+	if _, ok := set[parts[2]]; !ok {
+		return ":0\r\n"
+	}
+	return ":1\r\n"
+}
+
+func (db *Database) scard(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	set, ok := db.getSet(parts[1])
+	if !ok {
+		return ":0\r\n"
+	}
+	db.touch(parts[1])
+	return fmt.Sprintf(":%d\r\n", len(set))
+}
+
+// getSet returns the set stored at key, lazily removing it if it has
+// expired. The caller must hold db.mu.
+func (db *Database) getSet(key string) (map[string]struct{}, bool) {
+	set, ok := db.sets[key]
+	if !ok {
+		return nil, false
+	}
+	if db.isExpired(key) {
+		db.expireKey(key)
+		return nil, false
+	}
+	return set, true
+}
+
+// getString returns the string stored at key, lazily removing it if it has
+// expired. touch says whether the read counts as an access for OBJECT
+// IDLETIME. The caller must hold db.mu.
+func (db *Database) getString(key string, touch bool) (string, bool) {
+	value, ok := db.data.Get(key)
+	if !ok {
+		return "", false
+	}
+	if db.isExpired(key) {
+		db.expireKey(key)
+		return "", false
+	}
+	if touch {
+		db.touch(key)
+	}
+	return value, true
+}
+
+func (db *Database) bitpos(parts []string) string {
+	if len(parts) > 6 {
+		return errorResponse("syntax error")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	bit, err := strconv.Atoi(parts[2])
+	if err != nil || (bit != 0 && bit != 1) {
+		return errorResponse("The bit argument must be 1 or 0.")
+	}
+	value, ok := db.getString(parts[1], true)
+	if !ok {
+		// A missing key is an empty string: no set bits, and the first
+		// clear bit is at position 0.
+		if bit == 1 {
+			return ":-1\r\n"
+		}
+		return ":0\r\n"
+	}
+
+	isBit := false
+	if len(parts) == 6 {
+		switch strings.ToUpper(parts[5]) {
+		case "BYTE":
+		case "BIT":
+			isBit = true
+		default:
+			return errorResponse("syntax error")
+		}
+	}
+
+	total := len(value)
+	if isBit {
+		total = len(value) * 8
+	}
+	start, end := 0, total-1
+	endGiven := len(parts) >= 5
+	if len(parts) >= 4 {
+		if start, err = strconv.Atoi(parts[3]); err != nil {
+			return errorResponse("value is not an integer or out of range")
+		}
+	}
+	if endGiven {
+		if end, err = strconv.Atoi(parts[4]); err != nil {
+			return errorResponse("value is not an integer or out of range")
+		}
+	}
+	if start < 0 {
+		start += total
+	}
+	if end < 0 {
+		end += total
+	}
+	if start < 0 {
+		start = 0
+	}
+	if end < 0 {
+		end = 0
+	}
+	if end >= total {
+		end = total - 1
+	}
+	if start > end {
+		return ":-1\r\n"
+	}
+
+	first, last := start, end
+	if !isBit {
+		first, last = start*8, end*8+7
+	}
+	for pos := first; pos <= last; pos++ {
+		if int(value[pos/8]>>(7-uint(pos%8))&1) == bit {
+			return fmt.Sprintf(":%d\r\n", pos)
+		}
+	}
+	// Without an explicit end the string is treated as padded with zeros
+	// on the right, so a clear bit is always found just past the end.
+	if bit == 0 && !endGiven {
+		return fmt.Sprintf(":%d\r\n", last+1)
+	}
+	return ":-1\r\n"
+}
+
+const (
+	overflowWrap = iota
+	overflowSat
+	overflowFail
+)
+
+type bitfieldOp struct {
+	cmd    string
+	signed bool
+	bits   int
+	offset uint64
+	arg    int64
+}
+
+func (db *Database) bitfield(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	// Parse every sub-command up front so a syntax error anywhere leaves
+	// the key untouched.
+	var ops []bitfieldOp
+	var overflows []int
+	overflow := overflowWrap
+	writes := false
+	for i := 2; i < len(parts); {
+		sub := strings.ToUpper(parts[i])
+		switch sub {
+		case "OVERFLOW":
+			if i+1 >= len(parts) {
+				return errorResponse("syntax error")
+			}
+			switch strings.ToUpper(parts[i+1]) {
+			case "WRAP":
+				overflow = overflowWrap
+			case "SAT":
+				overflow = overflowSat
+			case "FAIL":
+				overflow = overflowFail
+			default:
+				return errorResponse("Invalid OVERFLOW type specified")
+			}
+			i += 2
+			continue
+		case "GET", "SET", "INCRBY":
+		default:
+			return errorResponse("syntax error")
+		}
+
+		argc := 3
+		if sub == "GET" {
+			argc = 2
+		}
+		if i+argc >= len(parts) {
+			return errorResponse("syntax error")
+		}
+		signed, bits, ok := parseBitfieldType(parts[i+1])
+		if !ok {
+			return errorResponse("Invalid bitfield type. Use something like i16 u8. Note that u64 is not supported but i64 is.")
+		}
+		offset, ok := parseBitfieldOffset(parts[i+2], bits)
+		if !ok {
+			return errorResponse("bit offset is not an integer or out of range")
+		}
+		op := bitfieldOp{cmd: sub, signed: signed, bits: bits, offset: offset}
+		if sub != "GET" {
+			arg, err := strconv.ParseInt(parts[i+3], 10, 64)
+			if err != nil {
+				return errorResponse("value is not an integer or out of range")
+			}
+			op.arg = arg
+			writes = true
+		}
+		ops = append(ops, op)
+		overflows = append(overflows, overflow)
+		i += argc + 1
+	}
+
+	key := parts[1]
+	value, exists := db.getString(key, true)
+	if !exists && db.keyExists(key) {
+		return wrongTypeResponse
+	}
+	buf := []byte(value)
+
+	var response strings.Builder
+	response.WriteString(fmt.Sprintf("*%d\r\n", len(ops)))
+	for n, op := range ops {
+		if need := int((op.offset + uint64(op.bits) + 7) / 8); op.cmd != "GET" && need > len(buf) {
+			buf = append(buf, make([]byte, need-len(buf))...)
+		}
+		old := readBitfield(buf, op.offset, op.bits, op.signed)
+		if op.cmd == "GET" {
+			response.WriteString(fmt.Sprintf(":%d\r\n", old))
+			continue
+		}
+
+		var result int64
+		var ok bool
+		if op.cmd == "SET" {
+			result, ok = bitfieldAdd(0, op.arg, op.bits, op.signed, overflows[n])
+		} else {
+			result, ok = bitfieldAdd(old, op.arg, op.bits, op.signed, overflows[n])
+		}
+		if !ok {
+			response.WriteString("$-1\r\n")
+			continue
+		}
+		writeBitfield(buf, op.offset, op.bits, uint64(result))
+		if op.cmd == "SET" {
+			response.WriteString(fmt.Sprintf(":%d\r\n", old))
+		} else {
+			response.WriteString(fmt.Sprintf(":%d\r\n", result))
+		}
+	}
+	if writes && (exists || len(buf) > 0) {
+		db.setString(key, string(buf))
+		if !exists {
+			db.notify(notifyNew, "new", key)
+		}
+		db.notify(notifyString, "setbit", key)
+	}
+	return response.String()
+}
+
+// parseBitfieldType parses a BITFIELD type such as i8 or u16. Signed fields
+// may be up to 64 bits wide, unsigned ones up to 63 so they fit an int64.
+func parseBitfieldType(t string) (signed bool, bits int, ok bool) {
+	if len(t) < 2 {
+		return false, 0, false
+	}
+	switch t[0] {
+	case 'i', 'I':
+		signed = true
+	case 'u', 'U':
+	default:
+		return false, 0, false
+	}
+	bits, err := strconv.Atoi(t[1:])
+	if err != nil || bits < 1 || (signed && bits > 64) || (!signed && bits > 63) {
+		return false, 0, false
+	}
+	return signed, bits, true
+}
+
+// parseBitfieldOffset parses a bit offset, where a leading '#' multiplies
+// the offset by the field width.
+func parseBitfieldOffset(s string, bits int) (uint64, bool) {
+	multiply := strings.HasPrefix(s, "#")
+	if multiply {
+		s = s[1:]
+	}
+	offset, err := strconv.ParseUint(s, 10, 64)
+	if err != nil {
+		return 0, false
+	}
+	if multiply {
+		offset *= uint64(bits)
+	}
+	// Strings are limited to 512MB, the same limit Redis applies.
+	if offset >= 512*1024*1024*8 {
+		return 0, false
+	}
+	return offset, true
+}
+
+func readBitfield(buf []byte, offset uint64, bits int, signed bool) int64 {
+	var v uint64
+	for i := uint64(0); i < uint64(bits); i++ {
+		pos := offset + i
+		v <<= 1
+		if pos/8 < uint64(len(buf)) {
+			v |= uint64(buf[pos/8]>>(7-pos%8)) & 1
+		}
+	}
+	if signed && bits < 64 && v&(1<<(bits-1)) != 0 {
+		v |= ^uint64(0) << bits // sign-extend
+	}
+	return int64(v)
+}
+
+func writeBitfield(buf []byte, offset uint64, bits int, v uint64) {
+	for i := uint64(0); i < uint64(bits); i++ {
+		pos := offset + i
+		mask := byte(1) << (7 - pos%8)
+		if v>>(uint64(bits)-1-i)&1 == 1 {
+			buf[pos/8] |= mask
+		} else {
+			buf[pos/8] &^= mask
+		}
+	}
+}
+
+// bitfieldAdd computes old+incr for a field of the given width, applying
+// the overflow policy. It reports false when the policy is FAIL and the
+// result does not fit.
+func bitfieldAdd(old, incr int64, bits int, signed bool, overflow int) (int64, bool) {
+	var min, max int64
+	if signed {
+		max = int64(^uint64(0) >> (65 - bits))
+		min = -max - 1
+	} else {
+		max = int64(uint64(1)<<bits - 1)
+	}
+
+	up := incr > 0 && old > max-incr
+	down := incr < 0 && old < min-incr
+	if !up && !down {
+		return old + incr, true
+	}
+	switch overflow {
+	case overflowSat:
+		if up {
+			return max, true
+		}
+		return min, true
+	case overflowFail:
+		return 0, false
+	}
+	wrapped := uint64(old) + uint64(incr)
+	if bits < 64 {
+		wrapped &= uint64(1)<<bits - 1
+		if signed && wrapped&(1<<(bits-1)) != 0 {
+			wrapped |= ^uint64(0) << bits
+		}
+	}
+	return int64(wrapped), true
+}
+
+// isExpired reports whether key has a TTL that has passed. It is the one
+// expiry check: every read path and the sweeper go through it, and a key
+// for which it returns true must be treated as absent. The caller must
+// hold db.mu.
+func (db *Database) isExpired(key string) bool {
+	expiry, ok := db.expiry[key]
+	if !ok {
+		return false
+	}
+	return db.now().After(expiry)
+}
+
+// keyExists reports whether key holds a value of any type, lazily removing
+// it if it has expired. The caller must hold db.mu.
+func (db *Database) keyExists(key string) bool {
+	if db.isExpired(key) {
+		db.expireKey(key)
+		return false
+	}
+	return db.typeOf(key) != "none"
+}
+
+// expireKey removes a key whose TTL has passed and raises its expired
+// event. The caller must hold db.mu.
+func (db *Database) expireKey(key string) {
+	db.deleteKey(key)
+	db.notify(notifyExpired, "expired", key)
+}
+
+// entryOverhead is a rough per-entry cost of the map bucket and string
+// headers, used to estimate memory usage.
+const entryOverhead = 48
+
+// keyInfo describes a key as seen by the introspection commands. OBJECT,
+// TYPE, TTL, DEBUG OBJECT and MEMORY USAGE all go through db.keyInfo so
+// they always agree on whether a key exists and what it holds.
+type keyInfo struct {
+	exists   bool
+	kind     string
+	encoding string
+	size     int           // estimated memory usage in bytes
+	ttl      time.Duration // negative when the key has no expiry
+	idle     time.Duration
+}
+
+// keyInfo looks up key across every value type, lazily removing it if it
+// has expired. The caller must hold db.mu.
+func (db *Database) keyInfo(key string) keyInfo {
+	if db.isExpired(key) {
+		db.expireKey(key)
+	}
+	info := keyInfo{kind: db.typeOf(key), ttl: -1}
+	switch info.kind {
+	case "string":
+		value, _ := db.data.Get(key)
+		info.encoding = stringEncoding(value)
+		info.size = len(key) + len(value) + entryOverhead
+	case "zset":
+		set := db.sortedSet[key]
+		info.encoding = "listpack"
+		info.size = len(key) + entryOverhead
+		for member := range set.dict {
+			if len(member) > 64 {
+				info.encoding = "skiplist"
+			}
+			info.size += len(member) + 8 + entryOverhead
+		}
+		if set.len() > 128 {
+			info.encoding = "skiplist"
+		}
+	case "hash":
+		hash := db.hashes[key]
+		info.encoding = "listpack"
+		info.size = len(key) + entryOverhead
+		for field, value := range hash {
+			if len(field) > 64 || len(value) > 64 {
+				info.encoding = "hashtable"
+			}
+			info.size += len(field) + len(value) + entryOverhead
+		}
+		if len(hash) > 128 {
+			info.encoding = "hashtable"
+		}
+	case "list":
+		list := db.lists[key]
+		info.encoding = "listpack"
+		info.size = len(key) + entryOverhead
+		for _, element := range list {
+			if len(element) > 64 {
+				info.encoding = "quicklist"
+			}
+			info.size += len(element) + entryOverhead
+		}
+		if len(list) > 128 {
+			info.encoding = "quicklist"
+		}
+	case "set":
+		set := db.sets[key]
+		info.encoding = "intset"
+		info.size = len(key) + entryOverhead
+		for member := range set {
+			if _, err := strconv.ParseInt(member, 10, 64); err != nil && info.encoding == "intset" {
+				info.encoding = "listpack"
+			}
+			if len(member) > 64 {
+				info.encoding = "hashtable"
+			}
+			info.size += len(member) + entryOverhead
+		}
+		if (info.encoding == "intset" && len(set) > 512) || (info.encoding == "listpack" && len(set) > 128) {
+			info.encoding = "hashtable"
+		}
+	default:
+		return info
+	}
+	info.exists = true
+	if forced, ok := db.forcedEncoding[key]; ok && slices.Contains(typeEncodings[info.kind], forced) {
+		info.encoding = forced
+	}
+	if expiry, ok := db.expiry[key]; ok {
+		info.ttl = expiry.Sub(db.now())
+	}
+	if accessed, ok := db.accessed[key]; ok {
+		info.idle = db.now().Sub(accessed)
+	}
+	return info
+}
+
+// typeEncodings lists the encodings keyInfo can report for each type.
+var typeEncodings = map[string][]string{
+	"string": {"int", "embstr", "raw"},
+	"zset":   {"listpack", "skiplist"},
+	"hash":   {"listpack", "hashtable"},
+	"list":   {"listpack", "quicklist"},
+	"set":    {"intset", "listpack", "hashtable"},
+}
+
+// typeOf reports which type of value is stored at key, without checking
+// expiry. Writes keep each key in one map: SET and the like replace a value
+// of another type through setString, and every other write replies
+// WRONGTYPE. Reads are not checked the same way; HGET, LPOP, SMEMBERS and
+// the rest treat a key of another type as missing. The caller must hold
+// db.mu.
+func (db *Database) typeOf(key string) string {
+	if _, ok := db.data.Get(key); ok {
+		return "string"
+	}
+	if _, ok := db.sortedSet[key]; ok {
+		return "zset"
+	}
+	if _, ok := db.hashes[key]; ok {
+		return "hash"
+	}
+	if _, ok := db.lists[key]; ok {
+		return "list"
+	}
+	if _, ok := db.sets[key]; ok {
+		return "set"
+	}
+	return "none"
+}
+
+// stringEncoding reports the encoding Redis would use for a string value.
+func stringEncoding(value string) string {
+	if len(value) <= 20 {
+		if _, err := strconv.ParseInt(value, 10, 64); err == nil {
+			return "int"
+		}
+	}
+	if len(value) <= 44 {
+		return "embstr"
+	}
+	return "raw"
+}
+
+// forEachKey calls fn once for every live key of any type, skipping keys
+// that have expired. Each key is in one map, so it is visited once. fn may
+// change a key's TTL but must not add or remove keys. The caller must hold
+// db.mu.
+func (db *Database) forEachKey(fn func(key string)) {
+	db.data.Iterate(func(key, _ string) bool {
+		if !db.isExpired(key) {
+			fn(key)
+		}
+		return true
+	})
+	for key := range db.sortedSet {
+		if !db.isExpired(key) {
+			fn(key)
+		}
+	}
+	for key := range db.hashes {
+		if !db.isExpired(key) {
+			fn(key)
+		}
+	}
+	for key := range db.lists {
+		if !db.isExpired(key) {
+			fn(key)
+		}
+	}
+	for key := range db.sets {
+		if !db.isExpired(key) {
+			fn(key)
+		}
+	}
+}
+
+// touch records an access to key for OBJECT IDLETIME. The caller must hold
+// db.mu.
+func (db *Database) touch(key string) {
+	db.accessed[key] = db.now()
+}
+
+// deleteKey removes key from every map. The caller must hold db.mu.
+func (db *Database) deleteKey(key string) {
+	db.data.Del(key)
+	delete(db.sortedSet, key)
+	delete(db.hashes, key)
+	delete(db.lists, key)
+	delete(db.sets, key)
+	db.clearExpiry(key)
+	delete(db.accessed, key)
+	delete(db.forcedEncoding, key)
+}
+
+// setString stores value at key as a string, replacing a value of any
+// other type, as SET, MSET and GETSET do. Commands that change the string
+// already there check that the key does not hold another type first. The
+// TTL and access time are left for the caller. The caller must hold db.mu.
+func (db *Database) setString(key, value string) {
+	delete(db.sortedSet, key)
+	delete(db.hashes, key)
+	delete(db.lists, key)
+	delete(db.sets, key)
+	delete(db.forcedEncoding, key)
+	db.data.Set(key, value)
+}
+
+// moveKey moves whatever is stored at src, in every map, to dst, which the
+// caller must already have cleared. The caller must hold db.mu.
+func (db *Database) moveKey(src, dst string) {
+	if value, ok := db.data.Get(src); ok {
+		db.data.Set(dst, value)
+		db.data.Del(src)
+	}
+	if zs, ok := db.sortedSet[src]; ok {
+		db.sortedSet[dst] = zs
+		delete(db.sortedSet, src)
+	}
+	if hash, ok := db.hashes[src]; ok {
+		db.hashes[dst] = hash
+		delete(db.hashes, src)
+	}
+	if list, ok := db.lists[src]; ok {
+		db.lists[dst] = list
+		delete(db.lists, src)
+	}
+	if set, ok := db.sets[src]; ok {
+		db.sets[dst] = set
+		delete(db.sets, src)
+	}
+	if deadline, ok := db.expiry[src]; ok {
+		db.clearExpiry(src)
+		db.setExpiry(dst, deadline)
+	}
+	if at, ok := db.accessed[src]; ok {
+		db.accessed[dst] = at
+		delete(db.accessed, src)
+	}
+	if encoding, ok := db.forcedEncoding[src]; ok {
+		db.forcedEncoding[dst] = encoding
+		delete(db.forcedEncoding, src)
+	}
+}
+
+// expiryEntry is a key's place in the TTL index.
+type expiryEntry struct {
+	key      string
+	deadline time.Time
+	index    int
+}
+
+// expiryHeap is a min-heap of expiryEntry by deadline, for container/heap.
+type expiryHeap []*expiryEntry
+
+func (h expiryHeap) Len() int           { return len(h) }
+func (h expiryHeap) Less(i, j int) bool { return h[i].deadline.Before(h[j].deadline) }
+
+func (h expiryHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *expiryHeap) Push(x any) {
+	entry := x.(*expiryEntry)
+	entry.index = len(*h)
+	*h = append(*h, entry)
+}
+
+func (h *expiryHeap) Pop() any {
+	old := *h
+	entry := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return entry
+}
+
+// setExpiry gives key a TTL ending at deadline, replacing any earlier one.
+// The caller must hold db.mu.
+func (db *Database) setExpiry(key string, deadline time.Time) {
+	db.expiry[key] = deadline
+	if entry, ok := db.ttlEntries[key]; ok {
+		entry.deadline = deadline
+		heap.Fix(&db.ttlHeap, entry.index)
+		return
+	}
+	entry := &expiryEntry{key: key, deadline: deadline}
+	heap.Push(&db.ttlHeap, entry)
+	db.ttlEntries[key] = entry
+}
+
+// clearExpiry removes any TTL from key. The caller must hold db.mu.
+func (db *Database) clearExpiry(key string) {
+	delete(db.expiry, key)
+	if entry, ok := db.ttlEntries[key]; ok {
+		heap.Remove(&db.ttlHeap, entry.index)
+		delete(db.ttlEntries, key)
+	}
+}
+
+// keyType implements TYPE, replying string, zset, hash, list, set or none.
+func (db *Database) keyType(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return "+" + db.keyInfo(parts[1]).kind + "\r\n"
+}
+
+func (db *Database) object(parts []string) string {
+	if len(parts) != 3 {
+		return errorResponse("wrong number of arguments for 'OBJECT' command")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	info := db.keyInfo(parts[2])
+	if !info.exists {
+		return "$-1\r\n"
+	}
+	switch strings.ToUpper(parts[1]) {
+	case "ENCODING":
+		return bulkString(info.encoding)
+	case "IDLETIME":
+		return fmt.Sprintf(":%d\r\n", int(info.idle.Seconds()))
+	case "REFCOUNT":
+		return ":1\r\n"
+	default:
+		return errorResponse(fmt.Sprintf("unknown subcommand '%s'", parts[1]))
+	}
+}
+
+func (db *Database) memory(parts []string) string {
+	switch strings.ToUpper(parts[1]) {
+	case "USAGE":
+	case "STATS":
+		if len(parts) != 2 {
+			return errorResponse("wrong number of arguments for 'MEMORY|stats' command")
+		}
+		return db.memoryStats()
+	default:
+		return errorResponse(fmt.Sprintf("unknown subcommand '%s'", parts[1]))
+	}
+	// The SAMPLES option is accepted for compatibility; the estimate
+	// always covers every element.
+	if len(parts) != 3 && (len(parts) != 5 || strings.ToUpper(parts[3]) != "SAMPLES") {
+		return errorResponse("syntax error")
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	info := db.keyInfo(parts[2])
+	if !info.exists {
+		return "$-1\r\n"
+	}
+	return fmt.Sprintf(":%d\r\n", info.size)
+}
+
+// memoryStats reports allocator figures from the Go runtime next to the
+// keyspace estimates used by MEMORY USAGE. The runtime does not record a
+// true peak, so peak.allocated is the heap it has obtained from the OS,
+// which it rarely gives back.
+func (db *Database) memoryStats() string {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	keys, dataset := 0, 0
+	db.forEachKey(func(key string) {
+		keys++
+		dataset += db.keyInfo(key).size
+	})
+	overhead := int(ms.HeapAlloc) - dataset
+	if overhead < 0 {
+		overhead = 0
+	}
+	fragmentation := 1.0
+	if ms.HeapAlloc > 0 {
+		fragmentation = float64(ms.HeapInuse) / float64(ms.HeapAlloc)
+	}
+
+	var response strings.Builder
+	response.WriteString("*12\r\n")
+	for _, stat := range []struct {
+		name  string
+		value int
+	}{
+		{"peak.allocated", int(ms.HeapSys)},
+		{"total.allocated", int(ms.HeapAlloc)},
+		{"overhead.total", overhead},
+		{"keys.count", keys},
+		{"dataset.bytes", dataset},
+	} {
+		response.WriteString(bulkString(stat.name))
+		response.WriteString(fmt.Sprintf(":%d\r\n", stat.value))
+	}
+	response.WriteString(bulkString("fragmentation"))
+	response.WriteString(bulkString(strconv.FormatFloat(fragmentation, 'f', 4, 64)))
+	return response.String()
+}
+
+func (db *Database) debug(parts []string) string {
+	switch strings.ToUpper(parts[1]) {
+	case "OBJECT":
+		if len(parts) != 3 {
+			return errorResponse("wrong number of arguments for 'DEBUG OBJECT' command")
+		}
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		info := db.keyInfo(parts[2])
+		if !info.exists {
+			return errorResponse("no such key")
+		}
+		return fmt.Sprintf("+Value at:0 refcount:1 encoding:%s serializedlength:%d lru_seconds_idle:%d%s\r\n",
+			info.encoding, info.size, int(info.idle.Seconds()), db.debugObjectDetails(parts[2], info))
+	case "PANIC":
+		if !db.debugCommands {
+			return errorResponse("DEBUG PANIC is disabled; start the server with -enable-debug-command")
+		}
+		panic("DEBUG PANIC")
+	case "SET-ENCODING":
+		// Lets encoding-dependent checks pin OBJECT ENCODING instead of
+		// relying on the size thresholds.
+		if !db.debugCommands {
+			return errorResponse("DEBUG SET-ENCODING is disabled; start the server with -enable-debug-command")
+		}
+		if len(parts) != 4 {
+			return errorResponse("wrong number of arguments for 'DEBUG SET-ENCODING' command")
+		}
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		info := db.keyInfo(parts[2])
+		if !info.exists {
+			return errorResponse("no such key")
+		}
+		encoding := strings.ToLower(parts[3])
+		if !slices.Contains(typeEncodings[info.kind], encoding) {
+			return errorResponse(fmt.Sprintf("encoding '%s' is not valid for a %s", parts[3], info.kind))
+		}
+		db.forcedEncoding[parts[2]] = encoding
+		return "+OK\r\n"
+	case "RELOAD":
+		if len(parts) != 2 {
+			return errorResponse("wrong number of arguments for 'DEBUG RELOAD' command")
+		}
+		return db.debugReload()
+	default:
+		return errorResponse(fmt.Sprintf("unknown subcommand '%s'", parts[1]))
+	}
+}
+
+// quicklistNodeBytes is the listpack size limit of a quicklist node, the
+// default list-max-listpack-size of -2.
+const quicklistNodeBytes = 8192
+
+// debugObjectDetails returns the container-specific fields DEBUG OBJECT
+// appends after the common ones, computed from the live value. The caller
+// must hold db.mu.
+func (db *Database) debugObjectDetails(key string, info keyInfo) string {
+	switch info.kind {
+	case "list":
+		// Lay the elements out in quicklist nodes as Redis would fill
+		// them, each entry costing its length plus a 2 byte header.
+		list := db.lists[key]
+		nodes, nodeSize, total := 0, 0, 0
+		for _, element := range list {
+			size := len(element) + 2
+			if nodes == 0 || nodeSize+size > quicklistNodeBytes {
+				nodes++
+				nodeSize = 0
+			}
+			nodeSize += size
+			total += size
+		}
+		return fmt.Sprintf(" ql_nodes:%d ql_avg_node:%.2f ql_listpack_max:-2 ql_compressed:0 ql_uncompressed_size:%d",
+			nodes, float64(len(list))/float64(nodes), total)
+	case "hash":
+		return fmt.Sprintf(" entries:%d", len(db.hashes[key]))
+	case "set":
+		return fmt.Sprintf(" entries:%d", len(db.sets[key]))
+	case "zset":
+		return fmt.Sprintf(" entries:%d", db.sortedSet[key].len())
+	}
+	return ""
+}
+
+// avgTTLSamples bounds how many volatile keys INFO inspects to estimate
+// avg_ttl.
+const avgTTLSamples = 1000
+
+func (db *Database) info(parts []string) string {
+	if len(parts) > 2 {
+		return errorResponse("syntax error")
+	}
+	section := "all"
+	if len(parts) == 2 {
+		section = strings.ToLower(parts[1])
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	var response strings.Builder
+	if section == "all" || section == "default" || section == "memory" {
+		db.lazyfreeMu.Lock()
+		response.WriteString("# Memory\r\n")
+		response.WriteString(fmt.Sprintf("lazyfree_pending_objects:%d\r\n", db.lazyfreePending))
+		response.WriteString(fmt.Sprintf("lazyfreed_objects:%d\r\n", db.lazyfreed))
+		db.lazyfreeMu.Unlock()
+		response.WriteString("\r\n")
+	}
+	if section == "all" || section == "default" || section == "persistence" {
+		response.WriteString("# Persistence\r\n")
+		response.WriteString(fmt.Sprintf("rdb_changes_since_last_save:%d\r\n", db.dirty.Load()))
+		bgsaveInProgress := 0
+		if db.bgsaving {
+			bgsaveInProgress = 1
+		}
+		response.WriteString(fmt.Sprintf("rdb_bgsave_in_progress:%d\r\n", bgsaveInProgress))
+		response.WriteString(fmt.Sprintf("rdb_last_save_time:%d\r\n", db.lastSave.Unix()))
+		response.WriteString("\r\n")
+	}
+	if section == "all" || section == "default" || section == "stats" {
+		response.WriteString("# Stats\r\n")
+		response.WriteString(fmt.Sprintf("pubsub_channels:%d\r\n", len(db.channels)))
+		response.WriteString(fmt.Sprintf("pubsub_patterns:%d\r\n", len(db.patterns)))
+		response.WriteString("\r\n")
+	}
+	if section == "all" || section == "default" || section == "keyspace" {
+		response.WriteString("# Keyspace\r\n")
+		keys := 0
+		db.forEachKey(func(string) { keys++ })
+		if keys > 0 {
+			expires, avgTTL := db.expiryStats()
+			response.WriteString(fmt.Sprintf("db0:keys=%d,expires=%d,avg_ttl=%d\r\n", keys, expires, avgTTL))
+		}
+	}
+	return bulkString(response.String())
+}
+
+// expiryStats returns the number of live keys with a TTL and their average
+// remaining TTL in milliseconds, estimated from at most avgTTLSamples keys.
+// The caller must hold db.mu.
+func (db *Database) expiryStats() (expires int, avgTTL int64) {
+	now := db.now()
+	var total time.Duration
+	sampled := 0
+	for key, deadline := range db.expiry {
+		if db.typeOf(key) == "none" || !deadline.After(now) {
+			continue
+		}
+		expires++
+		if sampled < avgTTLSamples {
+			total += deadline.Sub(now)
+			sampled++
+		}
+	}
+	if sampled == 0 {
+		return expires, 0
+	}
+	return expires, (total / time.Duration(sampled)).Milliseconds()
+}
+
+func (db *Database) clientCommand(c *client, parts []string) string {
+	if c == nil {
+		return errorResponse("CLIENT is only available on client connections")
+	}
+	switch sub := strings.ToUpper(parts[1]); {
+	case sub == "ID" && len(parts) == 2:
+		return fmt.Sprintf(":%d\r\n", c.id)
+	case sub == "GETNAME" && len(parts) == 2:
+		if c.name == "" {
+			return "$-1\r\n"
+		}
+		return bulkString(c.name)
+	case sub == "SETNAME" && len(parts) == 3:
+		for _, r := range parts[2] {
+			if r < '!' || r > '~' {
+				return errorResponse("Client names cannot contain spaces, newlines or special characters.")
+			}
+		}
+		db.mu.Lock()
+		c.name = parts[2]
+		db.mu.Unlock()
+		return "+OK\r\n"
+	case sub == "INFO" && len(parts) == 2:
+		return bulkString(c.info())
+	case sub == "LIST":
+		return db.clientList(parts[2:])
+	case sub == "KILL" && len(parts) >= 3:
+		return db.clientKill(c, parts[2:])
+	case sub == "ID" || sub == "GETNAME" || sub == "SETNAME" || sub == "INFO" || sub == "KILL":
+		return errorResponse(fmt.Sprintf("wrong number of arguments for 'CLIENT|%s' command", strings.ToLower(sub)))
+	default:
+		return errorResponse(fmt.Sprintf("unknown subcommand '%s'", parts[1]))
+	}
+}
+
+// clientTypes are the client types CLIENT LIST and CLIENT KILL accept.
+// There is no replication, so no client is ever a master or replica.
+var clientTypes = []string{"normal", "master", "replica", "pubsub"}
+
+// clientType reports c's type for CLIENT LIST TYPE and CLIENT KILL TYPE.
+func (c *client) clientType() string {
+	if c.subscriptionCount() > 0 {
+		return "pubsub"
+	}
+	return "normal"
+}
+
+// clientList implements CLIENT LIST [TYPE type], one CLIENT INFO line per
+// connection ordered by id.
+func (db *Database) clientList(args []string) string {
+	typ := ""
+	switch {
+	case len(args) == 2 && strings.ToUpper(args[0]) == "TYPE":
+		typ = strings.ToLower(args[1])
+		if !slices.Contains(clientTypes, typ) {
+			return errorResponse(fmt.Sprintf("Unknown client type '%s'", args[1]))
+		}
+	case len(args) != 0:
+		return errorResponse("syntax error")
+	}
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var clients []*client
+	for _, c := range db.conns {
+		if typ == "" || c.clientType() == typ {
+			clients = append(clients, c)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].id < clients[j].id })
+	var b strings.Builder
+	for _, c := range clients {
+		b.WriteString(c.info())
+	}
+	return bulkString(b.String())
+}
+
+// clientKill implements CLIENT KILL. The old form takes a single addr and
+// replies +OK; the filter form takes ID, ADDR, TYPE and SKIPME pairs and
+// replies with the number of clients killed. Killing a blocked client
+// wakes it so its command returns before the connection goes away.
+func (db *Database) clientKill(self *client, args []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if len(args) == 1 {
+		for _, c := range db.conns {
+			if c.addr == args[0] {
+				db.killClient(self, c)
+				return "+OK\r\n"
+			}
+		}
+		return errorResponse("No such client")
+	}
+	if len(args)%2 != 0 {
+		return errorResponse("syntax error")
+	}
+	var id int64
+	addr, typ, skipMe := "", "", true
+	for i := 0; i < len(args); i += 2 {
+		value := args[i+1]
+		switch strings.ToUpper(args[i]) {
+		case "ID":
+			n, err := strconv.ParseInt(value, 10, 64)
+			if err != nil || n <= 0 {
+				return errorResponse("client-id should be greater than 0")
+			}
+			id = n
+		case "ADDR":
+			addr = value
+		case "TYPE":
+			typ = strings.ToLower(value)
+			if !slices.Contains(clientTypes, typ) {
+				return errorResponse(fmt.Sprintf("Unknown client type '%s'", value))
+			}
+		case "SKIPME":
+			switch strings.ToLower(value) {
+			case "yes":
+				skipMe = true
+			case "no":
+				skipMe = false
+			default:
+				return errorResponse("syntax error")
+			}
+		default:
+			return errorResponse("syntax error")
+		}
+	}
+	killed := 0
+	for _, c := range db.conns {
+		if (id != 0 && c.id != id) || (addr != "" && c.addr != addr) || (typ != "" && c.clientType() != typ) {
+			continue
+		}
+		if skipMe && c == self {
+			continue
+		}
+		db.killClient(self, c)
+		killed++
+	}
+	return fmt.Sprintf(":%d\r\n", killed)
+}
+
+// killClient kills c on behalf of self. A client killing itself is only
+// closed after its reply is written. The caller must hold db.mu.
+func (db *Database) killClient(self, c *client) {
+	if c == self {
+		c.closeAfterReply = true
+		return
+	}
+	c.kill()
+}
+
+// allow takes a token from c's bucket and reports whether one was
+// available. The bucket holds up to limit tokens and refills at limit
+// tokens per second. A limit of zero allows every command.
+func (c *client) allow(limit int, now time.Time) bool {
+	if limit <= 0 {
+		return true
+	}
+	if c.refilled.IsZero() {
+		c.tokens = float64(limit)
+	} else {
+		c.tokens = math.Min(float64(limit), c.tokens+now.Sub(c.refilled).Seconds()*float64(limit))
+	}
+	c.refilled = now
+	if c.tokens < 1 {
+		return false
+	}
+	c.tokens--
+	return true
+}
+
+// configParam is a setting CONFIG GET and CONFIG SET understand. set
+// returns why a value was rejected.
+type configParam struct {
+	get func() string
+	set func(value string) error
+}
+
+// intParam is a configParam for a non-negative integer setting.
+func intParam(setting *int) configParam {
+	return configParam{
+		get: func() string { return strconv.Itoa(*setting) },
+		set: func(value string) error {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return errors.New("argument must be a non-negative integer")
+			}
+			*setting = n
+			return nil
+		},
+	}
+}
+
+// configParams maps the parameters CONFIG GET and CONFIG SET understand to
+// the settings they control. The caller must hold db.mu.
+func (db *Database) configParams() map[string]configParam {
+	return map[string]configParam{
+		"client-rate-limit":    intParam(&db.rateLimit),
+		"keys-warn-threshold":  intParam(&db.keysWarnThreshold),
+		"pubsub-queue-limit":   intParam(&db.pubsubQueueLimit),
+		"busy-reply-threshold": intParam(&db.busyReplyThreshold),
+		"pubsub-overflow-policy": {
+			get: func() string { return db.pubsubOverflow },
+			set: func(value string) error {
+				switch value = strings.ToLower(value); value {
+				case overflowDisconnect, overflowDropOldest:
+					db.pubsubOverflow = value
+					return nil
+				}
+				return fmt.Errorf("argument must be %s or %s", overflowDisconnect, overflowDropOldest)
+			},
+		},
+		"save": {
+			get: func() string { return formatSavePoints(db.savePoints) },
+			set: func(value string) error {
+				points, err := parseSavePoints(value)
+				if err != nil {
+					return err
+				}
+				db.savePoints = points
+				return nil
+			},
+		},
+		"notify-keyspace-events": {
+			get: func() string { return formatKeyspaceEvents(db.keyspaceEvents) },
+			set: func(value string) error {
+				flags, ok := parseKeyspaceEvents(value)
+				if !ok {
+					return errors.New("Invalid event class character. Use 'Ag$lshzxeKEtmn'.")
+				}
+				db.keyspaceEvents = flags
+				return nil
+			},
+		},
+	}
+}
+
+func (db *Database) config(parts []string) string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	params := db.configParams()
+	switch sub := strings.ToUpper(parts[1]); {
+	case sub == "GET" && len(parts) == 3:
+		var names []string
+		for name := range params {
+			if pattern := strings.ToLower(parts[2]); pattern == "*" || match(pattern, name) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		var response strings.Builder
+		response.WriteString(fmt.Sprintf("*%d\r\n", 2*len(names)))
+		for _, name := range names {
+			response.WriteString(bulkString(name))
+			response.WriteString(bulkString(params[name].get()))
+		}
+		return response.String()
+	case sub == "SET" && len(parts) == 4:
+		param, ok := params[strings.ToLower(parts[2])]
+		if !ok {
+			return errorResponse(fmt.Sprintf("Unknown option or number of arguments for CONFIG SET - '%s'", parts[2]))
+		}
+		if err := param.set(parts[3]); err != nil {
+			return errorResponse(fmt.Sprintf("CONFIG SET failed (possibly related to argument '%s') - %v", parts[2], err))
+		}
+		return "+OK\r\n"
+	case sub == "GET" || sub == "SET":
+		return errorResponse(fmt.Sprintf("wrong number of arguments for 'CONFIG|%s' command", strings.ToLower(sub)))
+	default:
+		return errorResponse(fmt.Sprintf("unknown subcommand '%s'", parts[1]))
+	}
+}
+
+// info describes c in the CLIENT INFO line format. There is a single
+// logical database and no transactions, so db and multi always report
+// their defaults.
+func (c *client) info() string {
+	now := time.Now()
+	flags := ""
+	if c.subscriptionCount() > 0 {
+		flags += "P"
+	}
+	if c.blocked {
+		flags += "b"
+	}
+	if flags == "" {
+		flags = "N"
+	}
+	// sub-lag counts the messages queued but not yet written, so a
+	// subscriber falling behind shows a growing number.
+	return fmt.Sprintf("id=%d addr=%s name=%s age=%d idle=%d flags=%s db=0 sub=%d psub=%d multi=-1 cmd=%s sub-lag=%d\n",
+		c.id, c.addr, c.name, int(now.Sub(c.created).Seconds()), int(now.Sub(c.lastActive).Seconds()), flags, len(c.subscriptions), len(c.patterns), c.lastCmd, c.queuedMessages())
+}
+
+// subscribeCommand implements SUBSCRIBE, or PSUBSCRIBE when pattern is
+// set, replying with one confirmation per channel or pattern. Naming one
+// the client already has is only confirmed again, so a message is never
+// delivered twice for the same subscription.
+func (db *Database) subscribeCommand(c *client, parts []string, pattern bool) string {
+	kind := "subscribe"
+	if pattern {
+		kind = "psubscribe"
+	}
+	if c == nil {
+		return errorResponse(fmt.Sprintf("%s is only available on client connections", strings.ToUpper(kind)))
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if c.subscriptions == nil {
+		c.subscriptions = make(map[string]bool)
+		c.patterns = make(map[string]bool)
+	}
+	mine, all := c.subscriptions, db.channels
+	if pattern {
+		mine, all = c.patterns, db.patterns
+	}
+	var response strings.Builder
+	for _, name := range parts[1:] {
+		if !mine[name] {
+			mine[name] = true
+			all[name] = append(slices.Clip(all[name]), c)
+		}
+		response.WriteString(subscriptionReply(kind, name, c.subscriptionCount()))
+	}
+	return response.String()
+}
+
+// unsubscribeCommand implements UNSUBSCRIBE, or PUNSUBSCRIBE when pattern
+// is set, dropping the given channels or patterns, or all of them when
+// none are named.
+func (db *Database) unsubscribeCommand(c *client, parts []string, pattern bool) string {
+	kind := "unsubscribe"
+	if pattern {
+		kind = "punsubscribe"
+	}
+	if c == nil {
+		return errorResponse(fmt.Sprintf("%s is only available on client connections", strings.ToUpper(kind)))
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	mine := c.subscriptions
+	if pattern {
+		mine = c.patterns
+	}
+	names := parts[1:]
+	if len(names) == 0 {
+		if len(mine) == 0 {
+			return "*3\r\n" + bulkString(kind) + "$-1\r\n" + fmt.Sprintf(":%d\r\n", c.subscriptionCount())
+		}
+		for name := range mine {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+	var response strings.Builder
+	for _, name := range names {
+		db.unsubscribe(c, []string{name}, pattern)
+		response.WriteString(subscriptionReply(kind, name, c.subscriptionCount()))
+	}
+	return response.String()
+}
+
+// unsubscribe removes c from channels, or from patterns when pattern is
+// set. A nil list means every one c is subscribed to. The caller must hold
+// db.mu.
+func (db *Database) unsubscribe(c *client, names []string, pattern bool) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	mine, all := c.subscriptions, db.channels
+	if pattern {
+		mine, all = c.patterns, db.patterns
+	}
+	if names == nil {
+		for name := range mine {
+			names = append(names, name)
+		}
+	}
+	for _, name := range names {
+		if !mine[name] {
+			continue
+		}
+		delete(mine, name)
+		// A publisher may still be delivering to the old list.
+		rest := slices.DeleteFunc(slices.Clone(all[name]), func(other *client) bool { return other == c })
+		if len(rest) == 0 {
+			delete(all, name)
+		} else {
+			all[name] = rest
+		}
+	}
+}
+
+// pubsubCommand implements PUBSUB CHANNELS, NUMSUB and NUMPAT. There is
+// no sharded pub/sub, so SHARDCHANNELS lists nothing and SHARDNUMSUB counts
+// no subscribers.
+func (db *Database) pubsubCommand(parts []string) string {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	var response strings.Builder
+	switch sub := strings.ToUpper(parts[1]); {
+	case (sub == "CHANNELS" || sub == "SHARDCHANNELS") && len(parts) <= 3:
+		var names []string
+		if sub == "CHANNELS" {
+			for name := range db.channels {
+				if len(parts) == 2 || match(parts[2], name) {
+					names = append(names, name)
+				}
+			}
+		}
+		sort.Strings(names)
+		fmt.Fprintf(&response, "*%d\r\n", len(names))
+		for _, name := range names {
+			response.WriteString(bulkString(name))
+		}
+	case sub == "NUMSUB" || sub == "SHARDNUMSUB":
+		fmt.Fprintf(&response, "*%d\r\n", 2*(len(parts)-2))
+		for _, name := range parts[2:] {
+			count := 0
+			if sub == "NUMSUB" {
+				count = len(db.channels[name])
+			}
+			response.WriteString(bulkString(name))
+			fmt.Fprintf(&response, ":%d\r\n", count)
+		}
+	case sub == "NUMPAT" && len(parts) == 2:
+		fmt.Fprintf(&response, ":%d\r\n", len(db.patterns))
+	default:
+		return errorResponse(fmt.Sprintf("unknown subcommand or wrong number of arguments for '%s'. Try PUBSUB HELP.", parts[1]))
+	}
+	return response.String()
+}
+
+func subscriptionReply(kind, channel string, count int) string {
+	return "*3\r\n" + bulkString(kind) + bulkString(channel) + fmt.Sprintf(":%d\r\n", count)
+}
+
+// publication is a message on its way to the subscribers its channel and
+// the patterns matching it had when it was published. It is taken while
+// holding db.mu and delivered after, so a channel with many subscribers
+// does not hold up every other command.
+type publication struct {
+	channel, message string
+	subscribers      []*client
+	patterns         []string
+	patternClients   [][]*client
+
+	// limit and policy are pubsub-queue-limit and pubsub-overflow-policy
+	// as they were when the message was published.
+	limit  int
+	policy string
+}
+
+// publication collects the subscribers a message published to channel
+// goes to. The caller must hold db.mu, for reading at least.
+func (db *Database) publication(channel, message string) *publication {
+	p := &publication{
+		channel:     channel,
+		message:     message,
+		subscribers: db.channels[channel],
+		limit:       db.pubsubQueueLimit,
+		policy:      db.pubsubOverflow,
+	}
+	for pattern, clients := range db.patterns {
+		if match(pattern, channel) {
+			p.patterns = append(p.patterns, pattern)
+			p.patternClients = append(p.patternClients, clients)
+		}
+	}
+	return p
+}
+
+// deliver sends p to its subscribers and returns how many deliveries were
+// made. A client subscribed to the channel and to a matching pattern
+// receives both a message and a pmessage, as in Redis. It does not need
+// db.mu.
+func (p *publication) deliver() int {
+	received := 0
+	if len(p.subscribers) > 0 {
+		reply := "*3\r\n" + bulkString("message") + bulkString(p.channel) + bulkString(p.message)
+		for _, c := range p.subscribers {
+			if p.queue(c, false, p.channel, reply) {
+				received++
+			}
+		}
+	}
+	for i, pattern := range p.patterns {
+		reply := "*4\r\n" + bulkString("pmessage") + bulkString(pattern) + bulkString(p.channel) + bulkString(p.message)
+		for _, c := range p.patternClients[i] {
+			if p.queue(c, true, pattern, reply) {
+				received++
+			}
+		}
+	}
+	return received
+}
+
+// publish sends message to every subscriber of channel and of each pattern
+// matching it, and returns how many deliveries were made. It is for
+// keyspace events, raised in the middle of a command; PUBLISH delivers
+// after releasing db.mu instead. The caller must hold db.mu.
+func (db *Database) publish(channel, message string) int {
+	return db.publication(channel, message).deliver()
+}
+
+// Subscriber overflow policies for pubsub-overflow-policy. Disconnecting
+// is what Redis does once a client passes its pub/sub output buffer limit;
+// dropping the oldest message keeps the subscriber but loses messages.
+const (
+	overflowDisconnect = "disconnect"
+	overflowDropOldest = "drop-oldest"
+)
+
+// queue adds a message for c, sent because of its subscription to the
+// channel or pattern name, without blocking, so a slow subscriber never holds up the
+// publisher. It reports whether the message was queued: a client that has
+// since unsubscribed or is being closed is skipped. A subscriber whose
+// queue is full is disconnected or loses its oldest message, as p.policy
+// says.
+func (p *publication) queue(c *client, pattern bool, name, message string) bool {
+	select {
+	case <-c.killed:
+		// Its connection is closing; it is unsubscribed once that is done.
+		return false
+	default:
+	}
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	subscribed := c.subscriptions
+	if pattern {
+		subscribed = c.patterns
+	}
+	if !subscribed[name] {
+		return false
+	}
+	if p.limit > 0 && len(c.messages) >= p.limit {
+		if p.policy == overflowDisconnect {
+			fmt.Printf("Closing client %d: pub/sub output queue full\n", c.id)
+			c.kill()
+			return false
+		}
+		c.messages[0] = ""
+		c.messages = c.messages[1:]
+	}
+	c.messages = append(c.messages, message)
+	select {
+	case c.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// nextMessage removes and returns the oldest message queued for c.
+func (c *client) nextMessage() (string, bool) {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	if len(c.messages) == 0 {
+		return "", false
+	}
+	message := c.messages[0]
+	c.messages[0] = ""
+	c.messages = c.messages[1:]
+	return message, true
+}
+
+// queuedMessages is how many messages are waiting for c's writer.
+func (c *client) queuedMessages() int {
+	c.outMu.Lock()
+	defer c.outMu.Unlock()
+	return len(c.messages)
+}
+
+// Keyspace notification flags, one per notify-keyspace-events character.
+// notifyKeyspace and notifyKeyevent select the channels events go to; the
+// rest select which events are raised at all.
+const (
+	notifyKeyspace = 1 << iota // K: __keyspace@0__:<key>
+	notifyKeyevent             // E: __keyevent@0__:<event>
+	notifyGeneric              // g: DEL, EXPIRE, PERSIST and the like
+	notifyString               // $
+	notifyList                 // l
+	notifySet                  // s
+	notifyHash                 // h
+	notifyZset                 // z
+	notifyExpired              // x: a key's TTL passed
+	notifyEvicted              // e: never raised, there is no eviction
+	notifyStream               // t: never raised, there are no streams
+	notifyKeyMiss              // m: a single-value read found no key
+	notifyNew                  // n: a key was created
+
+	// notifyAll is what A stands for. Like Redis it leaves out m and n.
+	notifyAll = notifyGeneric | notifyString | notifyList | notifySet | notifyHash |
+		notifyZset | notifyExpired | notifyEvicted | notifyStream
+)
+
+// keyspaceEventClasses lists the class characters in the order
+// formatKeyspaceEvents writes them.
+var keyspaceEventClasses = []struct {
+	char rune
+	flag int
+}{
+	{'g', notifyGeneric}, {'$', notifyString}, {'l', notifyList}, {'s', notifySet},
+	{'h', notifyHash}, {'z', notifyZset}, {'x', notifyExpired}, {'e', notifyEvicted},
+	{'t', notifyStream}, {'K', notifyKeyspace}, {'E', notifyKeyevent},
+	{'m', notifyKeyMiss}, {'n', notifyNew},
+}
+
+// parseKeyspaceEvents parses a notify-keyspace-events value such as "KEA"
+// or "Elg".
+func parseKeyspaceEvents(value string) (int, bool) {
+	flags := 0
+next:
+	for _, r := range value {
+		if r == 'A' {
+			flags |= notifyAll
+			continue
+		}
+		for _, class := range keyspaceEventClasses {
+			if class.char == r {
+				flags |= class.flag
+				continue next
+			}
+		}
+		return 0, false
+	}
+	return flags, true
+}
+
+// formatKeyspaceEvents renders flags the way Redis does, writing A when
+// every class it covers is enabled.
+func formatKeyspaceEvents(flags int) string {
+	var b strings.Builder
+	if flags&notifyAll == notifyAll {
+		b.WriteByte('A')
+	}
+	for _, class := range keyspaceEventClasses {
+		if flags&class.flag == 0 || (class.flag&notifyAll != 0 && flags&notifyAll == notifyAll) {
+			continue
+		}
+		b.WriteRune(class.char)
+	}
+	return b.String()
+}
+
+// notify raises a keyspace event of the given class for key, publishing it
+// to the keyspace and keyevent channels notify-keyspace-events enables.
+// The caller must hold db.mu.
+func (db *Database) notify(class int, event, key string) {
+	if db.keyspaceEvents&class == 0 {
+		return
+	}
+	if db.keyspaceEvents&notifyKeyspace != 0 {
+		db.publish("__keyspace@0__:"+key, event)
+	}
+	if db.keyspaceEvents&notifyKeyevent != 0 {
+		db.publish("__keyevent@0__:"+event, key)
+	}
+}
+
+// shutdown closes the listener and every client connection, then exits.
+// SHUTDOWN SAVE writes the snapshot first and refuses to exit if that
+// fails; NOSAVE, or no argument, exits without saving. The AOF, if on, is
+// flushed either way.
+func (db *Database) shutdown(parts []string) string {
+	if len(parts) > 2 {
+		return errorResponse("syntax error")
+	}
+	if len(parts) == 2 {
+		switch strings.ToUpper(parts[1]) {
+		case "SAVE":
+			if reply := db.save(); reply != "+OK\r\n" {
+				return errorResponse("Errors trying to SHUTDOWN. Check logs.")
+			}
+		case "NOSAVE":
+		default:
+			return errorResponse("syntax error")
+		}
+	}
+
+	db.Shutdown()
+	db.exit(0)
+	return ""
+}
+
+// Shutdown stops the server as SHUTDOWN NOSAVE does, without exiting the
+// process: it flushes the AOF, closes the listener and every client
+// connection, and stops the background work. It is meant to be called
+// once.
+func (db *Database) Shutdown() {
+	fmt.Println("Shutting down")
+	if db.aof != nil {
+		// Let a write being logged finish, then flush the file to disk.
+		db.writeMu.Lock()
+		db.aof.close()
+		db.writeMu.Unlock()
+	}
+	// Closing the listener also lets main return, so anything that must
+	// finish before the process ends has to happen above this point.
+	db.mu.Lock()
+	db.ready.Store(false)
+	if db.listener != nil {
+		db.listener.Close()
+	}
+	for conn := range db.conns {
+		conn.Close()
+	}
+	db.mu.Unlock()
+	db.Close()
+}
+
+// runningScript is a script in progress, as the BUSY check and SCRIPT
+// KILL see it.
+type runningScript struct {
+	started time.Time
+	done    chan struct{} // closed once the script has returned
+	cancel  context.CancelFunc
+
+	// mu guards wrote and killed, so a script that starts writing cannot
+	// also be killed.
+	mu     sync.Mutex
+	wrote  bool
+	killed bool
+}
+
+// startWrite records that the script is about to run a write command,
+// which makes it unkillable. It reports false if it was killed first.
+func (s *runningScript) startWrite() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.killed {
+		return false
+	}
+	s.wrote = true
+	return true
+}
+
+// isKilled reports whether SCRIPT KILL stopped the script.
+func (s *runningScript) isKilled() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.killed
+}
+
+// busyResponse is the reply to commands sent while a script has been
+// running for longer than busy-reply-threshold.
+const busyResponse = "-BUSY Redis is busy running a script. You can only call SCRIPT KILL or SHUTDOWN NOSAVE.\r\n"
+
+// waitForScript waits for a running script to return before another
+// command takes scriptMu. Once the script has run for longer than
+// busy-reply-threshold it gives up and returns busyResponse.
+func (db *Database) waitForScript() (string, bool) {
+	for {
+		script := db.script.Load()
+		if script == nil {
+			return "", false
+		}
+		db.mu.RLock()
+		threshold := time.Duration(db.busyReplyThreshold) * time.Millisecond
+		db.mu.RUnlock()
+		if threshold == 0 {
+			<-script.done
+			continue
+		}
+		timer := time.NewTimer(time.Until(script.started.Add(threshold)))
+		select {
+		case <-script.done:
+			timer.Stop()
+		case <-timer.C:
+			return busyResponse, true
+		}
+	}
+}
+
+// scriptKill implements SCRIPT KILL, stopping the running script unless
+// it has run a write command, since the dataset would be left with half
+// its effects. force stops it anyway, for SHUTDOWN NOSAVE. It returns
+// once the script has stopped.
+func (db *Database) scriptKill(force bool) string {
+	script := db.script.Load()
+	if script == nil {
+		return "-NOTBUSY No scripts in execution right now.\r\n"
+	}
+	script.mu.Lock()
+	if script.wrote && !force {
+		script.mu.Unlock()
+		return "-UNKILLABLE Sorry the script already executed write commands against the dataset. You can either wait the script termination or kill the server in a hard way using the SHUTDOWN NOSAVE command.\r\n"
+	}
+	script.killed = true
+	script.mu.Unlock()
+	script.cancel()
+	<-script.done
+	return "+OK\r\n"
+}
+
+// scriptSHA returns the SHA1 digest EVALSHA knows a script by.
+func scriptSHA(script string) string {
+	sum := sha1.Sum([]byte(script))
+	return hex.EncodeToString(sum[:])
+}
+
+// eval runs EVAL script numkeys key... arg..., or EVALSHA sha1 numkeys
+// ... when sha is true. The caller holds db.scriptMu for writing, so no
+// other command runs until the script returns.
+func (db *Database) eval(parts []string, sha bool) string {
+	db.mu.Lock()
+	source, ok := parts[1], true
+	if sha {
+		source, ok = db.scripts[strings.ToLower(parts[1])]
+	} else {
+		db.scripts[scriptSHA(source)] = source
+	}
+	db.mu.Unlock()
+	if !ok {
+		return "-NOSCRIPT No matching script. Please use EVAL.\r\n"
+	}
+
+	numkeys, err := strconv.Atoi(parts[2])
+	switch {
+	case err != nil:
+		return errorResponse("value is not an integer or out of range")
+	case numkeys < 0:
+		return errorResponse("Number of keys can't be negative")
+	case numkeys > len(parts)-3:
+		return errorResponse("Number of keys can't be greater than number of args")
+	}
+	keys, args := parts[3:3+numkeys], parts[3+numkeys:]
+
+	L := lua.NewState(lua.Options{SkipOpenLibs: true})
+	defer L.Close()
+	for _, lib := range []struct {
+		name string
+		open lua.LGFunction
+	}{
+		{lua.BaseLibName, lua.OpenBase},
+		{lua.TabLibName, lua.OpenTable},
+		{lua.StringLibName, lua.OpenString},
+		{lua.MathLibName, lua.OpenMath},
+	} {
+		L.Push(L.NewFunction(lib.open))
+		L.Push(lua.LString(lib.name))
+		L.Call(1, 0)
+	}
+	// Scripts get no access to the filesystem.
+	for _, name := range []string{"dofile", "loadfile"} {
+		L.SetGlobal(name, lua.LNil)
+	}
+	L.SetGlobal("KEYS", luaStrings(L, keys))
+	L.SetGlobal("ARGV", luaStrings(L, args))
+	redis := L.NewTable()
+	script := &runningScript{started: time.Now(), done: make(chan struct{})}
+	L.SetField(redis, "call", L.NewFunction(func(L *lua.LState) int { return db.scriptCall(L, script, true) }))
+	L.SetField(redis, "pcall", L.NewFunction(func(L *lua.LState) int { return db.scriptCall(L, script, false) }))
+	L.SetField(redis, "status_reply", L.NewFunction(func(L *lua.LState) int {
+		return luaReplyTable(L, "ok", L.CheckString(1))
+	}))
+	L.SetField(redis, "error_reply", L.NewFunction(func(L *lua.LState) int {
+		return luaReplyTable(L, "err", L.CheckString(1))
+	}))
+	L.SetGlobal("redis", redis)
+
+	fn, err := L.LoadString(source)
+	if err != nil {
+		return errorResponse("Error compiling script: " + oneLine(err.Error()))
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	L.SetContext(ctx)
+	script.cancel = cancel
+	db.script.Store(script)
+	defer func() {
+		db.script.Store(nil)
+		close(script.done)
+	}()
+
+	L.Push(fn)
+	if err := L.PCall(0, 1, nil); err != nil {
+		if script.isKilled() {
+			return errorResponse("Script killed by user with SCRIPT KILL...")
+		}
+		var apiErr *lua.ApiError
+		if errors.As(err, &apiErr) {
+			if t, ok := apiErr.Object.(*lua.LTable); ok {
+				if msg, ok := t.RawGetString("err").(lua.LString); ok {
+					return "-" + oneLine(string(msg)) + "\r\n"
+				}
+			}
+			return errorResponse("Error running script: " + oneLine(apiErr.Object.String()))
+		}
+		return errorResponse("Error running script: " + oneLine(err.Error()))
+	}
+	return scriptReply(L.Get(-1))
+}
+
+// scriptCall implements redis.call and redis.pcall for script. It runs
+// the command its arguments name and returns the reply converted to Lua.
+// An error reply is raised when raise is true, as redis.call does, and
+// returned as an {err=...} table otherwise.
+func (db *Database) scriptCall(L *lua.LState, script *runningScript, raise bool) int {
+	parts := make([]string, L.GetTop())
+	for i := range parts {
+		switch arg := L.Get(i + 1).(type) {
+		case lua.LString:
+			parts[i] = string(arg)
+		case lua.LNumber:
+			parts[i] = arg.String()
+		default:
+			L.RaiseError("Lua redis lib command arguments must be strings or integers")
+		}
+	}
+
+	if len(parts) == 0 {
+		L.RaiseError("Please specify at least one argument for this redis lib call")
+	}
+
+	var reply string
+	spec, ok := commandTable[strings.ToLower(parts[0])]
+	switch {
+	case !ok:
+		reply = errorResponse("Unknown Redis command called from script")
+	case !spec.acceptsArgs(len(parts)):
+		reply = errorResponse("Wrong number of args calling Redis command from script")
+	case slices.Contains(spec.flags, "noscript") || slices.Contains(spec.flags, "blocking"):
+		reply = errorResponse("This Redis command is not allowed from script")
+	case slices.Contains(spec.flags, "write") && !script.startWrite():
+		L.RaiseError("Script killed by user with SCRIPT KILL...")
+	default:
+		// Each command is logged to the AOF on its own, so replaying the
+		// file repeats the script's effects rather than the script.
+		reply = db.call(nil, spec, parts)
+	}
+
+	value, err := luaReply(L, bufio.NewReader(strings.NewReader(reply)))
+	if err != nil {
+		L.RaiseError("%s", err.Error())
+	}
+	if t, ok := value.(*lua.LTable); ok && raise && t.RawGetString("err") != lua.LNil {
+		L.Error(t, 1)
+	}
+	L.Push(value)
+	return 1
+}
+
+// luaReply reads one RESP reply and converts it to Lua the way Redis
+// does: status and error replies become {ok=...} and {err=...} tables,
+// integers numbers, bulk strings strings, arrays tables, and nil replies
+// false.
+func luaReply(L *lua.LState, reader *bufio.Reader) (lua.LValue, error) {
+	line, err := readLine(reader)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, errors.New("empty reply")
+	}
+	switch line[0] {
+	case '+':
+		t := L.NewTable()
+		t.RawSetString("ok", lua.LString(line[1:]))
+		return t, nil
+	case '-':
+		t := L.NewTable()
+		t.RawSetString("err", lua.LString(line[1:]))
+		return t, nil
+	case ':':
+		n, err := strconv.ParseInt(line[1:], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		return lua.LNumber(n), nil
+	case '$':
+		size, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if size < 0 {
+			return lua.LFalse, nil
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(reader, data); err != nil {
+			return nil, err
+		}
+		return lua.LString(data[:size]), nil
+	case '*':
+		count, err := strconv.Atoi(line[1:])
+		if err != nil {
+			return nil, err
+		}
+		if count < 0 {
+			return lua.LFalse, nil
+		}
+		t := L.NewTable()
+		for i := 0; i < count; i++ {
+			item, err := luaReply(L, reader)
+			if err != nil {
+				return nil, err
+			}
+			t.Append(item)
+		}
+		return t, nil
+	}
+	return nil, fmt.Errorf("unexpected reply %q", line)
+}
+
+// scriptReply converts a script's return value to RESP the way Redis
+// does: numbers are truncated to integers, true is 1, false and nil are
+// nil, {ok=...} and {err=...} tables are status and error replies, and
+// any other table is an array up to its first nil.
+func scriptReply(value lua.LValue) string {
+	switch v := value.(type) {
+	case lua.LString:
+		return bulkString(string(v))
+	case lua.LNumber:
+		return fmt.Sprintf(":%d\r\n", int64(v))
+	case lua.LBool:
+		if v {
+			return ":1\r\n"
+		}
+	case *lua.LTable:
+		if ok, isString := v.RawGetString("ok").(lua.LString); isString {
+			return "+" + oneLine(string(ok)) + "\r\n"
+		}
+		if msg, isString := v.RawGetString("err").(lua.LString); isString {
+			return "-" + oneLine(string(msg)) + "\r\n"
+		}
+		var items []string
+		for i := 1; ; i++ {
+			item := v.RawGetInt(i)
+			if item == lua.LNil {
+				break
+			}
+			items = append(items, scriptReply(item))
+		}
+		return fmt.Sprintf("*%d\r\n%s", len(items), strings.Join(items, ""))
+	}
+	return "$-1\r\n"
+}
+
+// luaStrings returns values as a Lua array.
+func luaStrings(L *lua.LState, values []string) *lua.LTable {
+	t := L.CreateTable(len(values), 0)
+	for _, v := range values {
+		t.Append(lua.LString(v))
+	}
+	return t
+}
+
+// luaReplyTable pushes a {field=msg} table, as redis.status_reply and
+// redis.error_reply return.
+func luaReplyTable(L *lua.LState, field, msg string) int {
+	t := L.NewTable()
+	t.RawSetString(field, lua.LString(msg))
+	L.Push(t)
+	return 1
+}
+
+// oneLine replaces line breaks so msg fits in a status or error reply.
+func oneLine(msg string) string {
+	return strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+}
+
+// scriptCommand implements SCRIPT LOAD, EXISTS and FLUSH. SCRIPT KILL is
+// handled by handleCommand, as it has to run while a script holds
+// scriptMu.
+func (db *Database) scriptCommand(parts []string) string {
+	sub := strings.ToUpper(parts[1])
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	switch {
+	case sub == "LOAD" && len(parts) == 3:
+		sha := scriptSHA(parts[2])
+		db.scripts[sha] = parts[2]
+		return bulkString(sha)
+	case sub == "EXISTS" && len(parts) > 2:
+		var b strings.Builder
+		fmt.Fprintf(&b, "*%d\r\n", len(parts)-2)
+		for _, sha := range parts[2:] {
+			if _, ok := db.scripts[strings.ToLower(sha)]; ok {
+				b.WriteString(":1\r\n")
+			} else {
+				b.WriteString(":0\r\n")
+			}
+		}
+		return b.String()
+	case sub == "FLUSH" && len(parts) <= 3:
+		if len(parts) == 3 {
+			if mode := strings.ToUpper(parts[2]); mode != "ASYNC" && mode != "SYNC" {
+				return errorResponse("SCRIPT FLUSH only support SYNC|ASYNC option")
+			}
+		}
+		db.scripts = make(map[string]string)
+		return "+OK\r\n"
+	}
+	return errorResponse(fmt.Sprintf("unknown subcommand or wrong number of arguments for '%s'. Try SCRIPT HELP.", parts[1]))
+}
+
+// AOF fsync policies, as in Redis's appendfsync setting.
+const (
+	FsyncAlways   = "always"
+	FsyncEverysec = "everysec"
+	FsyncNo       = "no"
+)
+
+// aof is an append-only file of write commands in RESP multi-bulk form.
+// Replaying it through handleCommand rebuilds the dataset. Writes to it
+// are serialized by db.writeMu.
+type aof struct {
+	file  *os.File
+	fsync string
+}
+
+// write appends data, syncing it to disk first under the always policy.
+func (f *aof) write(data string) {
+	if _, err := f.file.WriteString(data); err != nil {
+		fmt.Println("Error writing AOF:", err)
+		return
+	}
+	if f.fsync == FsyncAlways {
+		if err := f.file.Sync(); err != nil {
+			fmt.Println("Error syncing AOF:", err)
+		}
+	}
+}
+
+// syncEverySecond syncs the file once a second until done is closed, for
+// the everysec policy.
+func (f *aof) syncEverySecond(done <-chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+		if err := f.file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+			fmt.Println("Error syncing AOF:", err)
+		}
+	}
+}
+
+// close syncs and closes the file.
+func (f *aof) close() {
+	if err := f.file.Sync(); err != nil {
+		fmt.Println("Error syncing AOF:", err)
+	}
+	f.file.Close()
+}
+
+// appendMultiBulk writes parts to b as a RESP multi-bulk array.
+func appendMultiBulk(b *strings.Builder, parts []string) {
+	b.WriteString(fmt.Sprintf("*%d\r\n", len(parts)))
+	for _, part := range parts {
+		b.WriteString(bulkString(part))
+	}
+}
+
+// propagate logs a write command that has just succeeded to the AOF. Each
+// of its keys that now has a TTL is followed by a PEXPIREAT, so replay
+// restores the absolute deadline rather than restarting a relative one.
+// The caller must hold db.writeMu but not db.mu.
+func (db *Database) propagate(spec commandSpec, parts []string) {
+	switch strings.ToUpper(parts[0]) {
+	case "PEXPIREPATTERN":
+		// Already logged key by key.
+		return
+	case "BZMPOP", "BLMPOP":
+		// The pop has happened by now, so replay it without blocking:
+		// drop the B and the timeout.
+		parts = append([]string{parts[0][1:]}, parts[2:]...)
+	}
+	var entry strings.Builder
+	appendMultiBulk(&entry, parts)
+	db.mu.RLock()
+	for _, key := range spec.keys(parts) {
+		if deadline, ok := db.expiry[key]; ok {
+			appendMultiBulk(&entry, []string{"PEXPIREAT", key, strconv.FormatInt(deadline.UnixMilli(), 10)})
+		}
+	}
+	db.mu.RUnlock()
+	db.aof.write(entry.String())
+}
+
+// OpenAOF replays the append-only file at path, if there is one, and then
+// logs every successful write command to it. fsync is when the file is
+// synced to disk: always, everysec or no, leaving it to the OS. It must be
+// called before the server accepts connections.
+func (db *Database) OpenAOF(path, fsync string) error {
+	switch fsync {
+	case FsyncAlways, FsyncEverysec, FsyncNo:
+	default:
+		return fmt.Errorf("invalid appendfsync policy %q", fsync)
+	}
+	if err := db.loadAOF(path); err != nil {
+		return err
+	}
+	// Replayed writes are already on disk.
+	db.dirty.Store(0)
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	db.aof = &aof{file: file, fsync: fsync}
+	if fsync == FsyncEverysec {
+		go db.aof.syncEverySecond(db.done)
+	}
+	return nil
+}
+
+// loadAOF runs every command in the file at path. A command cut short at
+// the end of the file, as a crash mid-write leaves it, is dropped and
+// truncated away so later appends start on a clean boundary. Any other
+// malformed content is an error.
+func (db *Database) loadAOF(path string) error {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	counter := &countingReader{r: file}
+	reader := bufio.NewReader(counter)
+	var valid int64
+	loaded := 0
+	for {
+		parts, err := readCommand(reader, 0)
+		consumed := counter.n - int64(reader.Buffered())
+		if err == io.EOF && consumed == valid {
+			break
+		}
+		if errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+			fmt.Printf("AOF %s ends with a truncated command; dropping its last %d bytes\n", path, consumed-valid)
+			file.Close()
+			return os.Truncate(path, valid)
+		}
+		if err != nil {
+			return fmt.Errorf("AOF %s is corrupt at byte %d: %w", path, valid, err)
+		}
+		if reply := db.handleCommand(nil, parts); strings.HasPrefix(reply, "-") {
+			fmt.Printf("AOF %s: %q failed on replay: %s", path, parts, reply)
+		}
+		valid = consumed
+		loaded++
+	}
+	fmt.Printf("Loaded %d commands from AOF %s\n", loaded, path)
+	return nil
+}
+
+// countingReader counts the bytes read through it.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.n += int64(n)
+	return n, err
+}
+
+// snapshot is a point-in-time copy of the dataset, as SAVE writes it with
+// encoding/gob, which keeps values binary-safe and infinite scores intact.
+// Deadlines are absolute Unix milliseconds, so TTLs keep running while the
+// server is down.
+//
+// gob matches fields by name, so a type added here later is simply absent
+// from older dumps, and a field an older build does not know is skipped.
+// Changes gob cannot absorb that way need a new snapshotVersion and a step
+// in upgradeSnapshot.
+type snapshot struct {
+	Strings    map[string]string
+	SortedSets map[string]map[string]float64
+	Hashes     map[string]map[string]string
+	Lists      map[string][]string
+	Sets       map[string][]string
+	Expiry     map[string]int64
+}
+
+// snapshot copies every live key so it can be written without the lock.
+// The caller must hold db.mu.
+func (db *Database) snapshot() *snapshot {
+	snap := &snapshot{
+		Strings:    make(map[string]string),
+		SortedSets: make(map[string]map[string]float64),
+		Hashes:     make(map[string]map[string]string),
+		Lists:      make(map[string][]string),
+		Sets:       make(map[string][]string),
+		Expiry:     make(map[string]int64),
+	}
+	db.data.Iterate(func(key, value string) bool {
+		if !db.isExpired(key) {
+			snap.Strings[key] = value
+		}
+		return true
+	})
+	for key, zs := range db.sortedSet {
+		if !db.isExpired(key) {
+			snap.SortedSets[key] = maps.Clone(zs.dict)
+		}
+	}
+	for key, hash := range db.hashes {
+		if !db.isExpired(key) {
+			snap.Hashes[key] = maps.Clone(hash)
+		}
+	}
+	for key, list := range db.lists {
+		if !db.isExpired(key) {
+			snap.Lists[key] = slices.Clone(list)
+		}
+	}
+	for key, set := range db.sets {
+		if !db.isExpired(key) {
+			members := make([]string, 0, len(set))
+			for member := range set {
+				members = append(members, member)
+			}
+			snap.Sets[key] = members
+		}
+	}
+	for key, deadline := range db.expiry {
+		if !db.isExpired(key) {
+			snap.Expiry[key] = deadline.UnixMilli()
+		}
+	}
+	return snap
+}
+
+// restore loads snap into the keyspace, replacing any value already held
+// by a key it names. A key holds one type, so a snapshot naming a key
+// under two types is rejected before anything is loaded. The caller must
+// hold db.mu.
+func (db *Database) restore(snap *snapshot) error {
+	types := make(map[string]string)
+	claim := func(key, typ string) error {
+		if other, ok := types[key]; ok {
+			return fmt.Errorf("key %q is stored as both a %s and a %s", key, other, typ)
+		}
+		types[key] = typ
+		return nil
+	}
+	var err error
+	for key := range snap.Strings {
+		err = errors.Join(err, claim(key, "string"))
+	}
+	for key := range snap.SortedSets {
+		err = errors.Join(err, claim(key, "zset"))
+	}
+	for key := range snap.Hashes {
+		err = errors.Join(err, claim(key, "hash"))
+	}
+	for key := range snap.Lists {
+		err = errors.Join(err, claim(key, "list"))
+	}
+	for key := range snap.Sets {
+		err = errors.Join(err, claim(key, "set"))
+	}
+	if err != nil {
+		return err
+	}
+	for key := range types {
+		db.deleteKey(key)
+	}
+
+	for key, value := range snap.Strings {
+		db.data.Set(key, value)
+	}
+	for key, members := range snap.SortedSets {
+		zs := newZset()
+		for member, score := range members {
+			zs.add(member, score)
+		}
+		db.sortedSet[key] = zs
+	}
+	for key, hash := range snap.Hashes {
+		db.hashes[key] = hash
+	}
+	for key, list := range snap.Lists {
+		db.lists[key] = list
+	}
+	for key, members := range snap.Sets {
+		set := make(map[string]struct{}, len(members))
+		for _, member := range members {
+			set[member] = struct{}{}
+		}
+		db.sets[key] = set
+	}
+	for key, ms := range snap.Expiry {
+		if _, ok := types[key]; ok {
+			db.setExpiry(key, time.UnixMilli(ms))
+		}
+	}
+	return nil
+}
+
+// snapshotMagic starts every snapshot file, followed by the format version
+// as four digits, as in Redis's "REDIS0011". Version 1 dumps predate the
+// header and start straight with the gob data.
+const (
+	snapshotMagic   = "INMEMDB"
+	snapshotVersion = 2
+)
+
+// readSnapshotHeader reads the header at the start of a snapshot and
+// returns its format version, leaving reader at the gob data. A file
+// without the header is version 1.
+func readSnapshotHeader(reader *bufio.Reader) (int, error) {
+	header, err := reader.Peek(len(snapshotMagic) + 4)
+	if err != nil || string(header[:len(snapshotMagic)]) != snapshotMagic {
+		return 1, nil
+	}
+	version, err := strconv.Atoi(string(header[len(snapshotMagic):]))
+	if err != nil || version < 2 {
+		return 0, fmt.Errorf("invalid format version %q", header[len(snapshotMagic):])
+	}
+	if version > snapshotVersion {
+		return 0, fmt.Errorf("format version %d is newer than this build supports (%d)", version, snapshotVersion)
+	}
+	reader.Discard(len(header))
+	return version, nil
+}
+
+// upgradeSnapshot brings a snapshot decoded from an older format version
+// up to the current one.
+func upgradeSnapshot(snap *snapshot, version int) {
+	for ; version < snapshotVersion; version++ {
+		switch version {
+		case 1:
+			// Version 2 only added the header. The types a version 1
+			// dump predates decode as nil maps, which restore skips.
+		}
+	}
+}
+
+// writeSnapshot writes snap to path through a temporary file, so a crash
+// mid-save leaves the previous snapshot in place.
+func writeSnapshot(path string, snap *snapshot) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), "temp-*.gob")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := fmt.Fprintf(tmp, "%s%04d", snapshotMagic, snapshotVersion); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := gob.NewEncoder(tmp).Encode(snap); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// readSnapshot reads the snapshot at path, whichever format version wrote
+// it.
+func readSnapshot(path string) (*snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	reader := bufio.NewReader(file)
+	version, err := readSnapshotHeader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("snapshot %s: %w", path, err)
+	}
+	var snap snapshot
+	if err := gob.NewDecoder(reader).Decode(&snap); err != nil {
+		return nil, fmt.Errorf("snapshot %s is corrupt: %w", path, err)
+	}
+	upgradeSnapshot(&snap, version)
+	return &snap, nil
+}
+
+// LoadSnapshot restores the snapshot at path, if there is one. It must be
+// called before the server accepts connections.
+func (db *Database) LoadSnapshot(path string) error {
+	snap, err := readSnapshot(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if err := db.restore(snap); err != nil {
+		return fmt.Errorf("snapshot %s is corrupt: %w", path, err)
+	}
+	fmt.Printf("Loaded snapshot %s\n", path)
+	return nil
+}
+
+// saved records a successful save of a snapshot taken when dirty writes
+// had happened. Writes made since still count towards the save points.
+// The caller must hold db.mu.
+func (db *Database) saved(dirty int64) {
+	db.dirty.Add(-dirty)
+	db.lastSave = time.Now()
+	db.saveRetryAt = time.Time{}
+}
+
+// debugReload implements DEBUG RELOAD: it saves the snapshot, empties the
+// dataset and loads the file back, all under the lock, so what a restart
+// would bring back can be checked without one. Deadlines are absolute, so
+// TTLs come back unchanged. Forced encodings are not saved and are derived
+// from the values again.
+func (db *Database) debugReload() string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.bgsaving {
+		return errorResponse("Background save already in progress")
+	}
+	dirty := db.dirty.Load()
+	if err := writeSnapshot(db.dumpPath, db.snapshot()); err != nil {
+		return errorResponse("Error trying to save the snapshot: " + err.Error())
+	}
+	db.saved(dirty)
+	snap, err := readSnapshot(db.dumpPath)
+	if err != nil {
+		return errorResponse("Error trying to load the snapshot: " + err.Error())
+	}
+	for _, value := range db.clearKeyspace() {
+		db.freeLater(value)
+	}
+	if err := db.restore(snap); err != nil {
+		return errorResponse("Error trying to load the snapshot: " + err.Error())
+	}
+	return "+OK\r\n"
+}
+
+// save implements SAVE, writing the snapshot while holding the lock so no
+// write can run until it is on disk.
+func (db *Database) save() string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.bgsaving {
+		return errorResponse("Background save already in progress")
+	}
+	dirty := db.dirty.Load()
+	if err := writeSnapshot(db.dumpPath, db.snapshot()); err != nil {
+		fmt.Println("Error saving snapshot:", err)
+		return errorResponse(err.Error())
+	}
+	db.saved(dirty)
+	return "+OK\r\n"
+}
+
+// bgsave implements BGSAVE. The dataset is copied under the lock, so the
+// snapshot is consistent, and written in the background.
+func (db *Database) bgsave() string {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.bgsaving {
+		return errorResponse("Background save already in progress")
+	}
+	db.bgsaving = true
+	dirty := db.dirty.Load()
+	snap := db.snapshot()
+	go func() {
+		err := writeSnapshot(db.dumpPath, snap)
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		db.bgsaving = false
+		if err != nil {
+			fmt.Println("Error saving snapshot:", err)
+			db.saveRetryAt = time.Now().Add(saveRetryDelay)
+			return
+		}
+		fmt.Println("Background saving terminated with success")
+		db.saved(dirty)
+	}()
+	return "+Background saving started\r\n"
+}
+
+// savePoint is a -save rule: BGSAVE once changes writes have happened and
+// seconds have passed since the last save.
+type savePoint struct {
+	seconds int
+	changes int64
+}
+
+// saveRetryDelay is how long the save points wait after a failed BGSAVE
+// before trying again.
+const saveRetryDelay = 5 * time.Second
+
+// parseSavePoints parses save points written as in redis.conf, "seconds
+// changes [seconds changes ...]". An empty string means none.
+func parseSavePoints(s string) ([]savePoint, error) {
+	fields := strings.Fields(s)
+	if len(fields)%2 != 0 {
+		return nil, errors.New("save points must be pairs of seconds and changes")
+	}
+	var points []savePoint
+	for i := 0; i < len(fields); i += 2 {
+		seconds, err := strconv.Atoi(fields[i])
+		if err != nil || seconds < 0 {
+			return nil, fmt.Errorf("invalid save seconds %q", fields[i])
+		}
+		changes, err := strconv.ParseInt(fields[i+1], 10, 64)
+		if err != nil || changes < 1 {
+			return nil, fmt.Errorf("invalid save changes %q", fields[i+1])
+		}
+		points = append(points, savePoint{seconds, changes})
+	}
+	return points, nil
+}
+
+// formatSavePoints formats save points the way parseSavePoints reads them.
+func formatSavePoints(points []savePoint) string {
+	fields := make([]string, 0, 2*len(points))
+	for _, point := range points {
+		fields = append(fields, strconv.Itoa(point.seconds), strconv.FormatInt(point.changes, 10))
+	}
+	return strings.Join(fields, " ")
+}
+
+// saveCron starts a BGSAVE whenever a save point is reached, checking
+// every sweepInterval until Close is called.
+func (db *Database) saveCron() {
+	ticker := time.NewTicker(sweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-db.done:
+			return
+		}
+		if point, ok := db.savePointReached(time.Now()); ok {
+			fmt.Printf("%d changes in %d seconds. Saving...\n", point.changes, point.seconds)
+			// Go through handleCommand so a running script finishes first.
+			db.handleCommand(nil, []string{"BGSAVE"})
+		}
+	}
+}
+
+// savePointReached returns the first save point whose changes have
+// happened and whose seconds have passed since the last save, unless a
+// BGSAVE is running or waiting to retry.
+func (db *Database) savePointReached(now time.Time) (savePoint, bool) {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	if db.bgsaving || now.Before(db.saveRetryAt) {
+		return savePoint{}, false
+	}
+	dirty := db.dirty.Load()
+	for _, point := range db.savePoints {
+		if dirty >= point.changes && now.Sub(db.lastSave) >= time.Duration(point.seconds)*time.Second {
+			return point, true
+		}
+	}
+	return savePoint{}, false
+}
+
+// execute runs a command, turning a panic in its handler into an error
+// reply so one bad command cannot bring down every client.
+func (db *Database) execute(c *client, parts []string) (response string) {
+	defer func() {
+		if r := recover(); r != nil {
+			fmt.Printf("Panic handling command %q: %v\n%s", parts, r, debug.Stack())
+			response = errorResponse("internal error")
+		}
+	}()
+	return db.handleCommand(c, parts)
+}
+
+func handleConnection(conn net.Conn, db *Database) {
+	db.mu.Lock()
+	db.nextClientID++
+	now := time.Now()
+	replies := make(chan string, replyQueueSize)
+	c := &client{id: db.nextClientID, conn: conn, addr: conn.RemoteAddr().String(), created: now, lastActive: now, replies: replies, wake: make(chan struct{}, 1), killed: make(chan struct{})}
+	db.conns[conn] = c
+	db.mu.Unlock()
+	defer func() {
+		db.mu.Lock()
+		delete(db.conns, conn)
+		db.mu.Unlock()
+		conn.Close()
+	}()
+
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		writeReplies(conn, c, replies)
+	}()
+	// Let the writer send the queued replies before the connection
+	// closes. Dropping the subscriptions first, under db.mu, guarantees no
+	// publisher sends on the closed channel.
+	defer func() {
+		db.mu.Lock()
+		db.resetConnState(c)
+		db.mu.Unlock()
+		close(replies)
+		<-written
+	}()
+
+	reader := bufio.NewReader(conn)
+	for {
+		parts, err := readCommand(reader, db.maxArgs)
+		if err != nil {
+			var protoErr protocolError
+			if errors.As(err, &protoErr) {
+				c.replies <- errorResponse(protoErr.Error())
+			}
+			return
+		}
+		quit := len(parts) > 0 && strings.EqualFold(parts[0], "QUIT")
+
+		c.replies <- db.execute(c, parts)
+		if quit || c.closeAfterReply {
+			return
+		}
+	}
+}
+
+// writeReplies writes each reply from replies, and each pub/sub message
+// queued for c, to conn until replies is closed, flushing whenever nothing
+// more is waiting so pipelined commands share a write.
+func writeReplies(conn net.Conn, c *client, replies <-chan string) {
+	writer := bufio.NewWriter(conn)
+	for open := true; open; {
+		select {
+		case reply, ok := <-replies:
+			if !ok {
+				open = false
+				break
+			}
+			writer.WriteString(reply)
+		case <-c.wake:
+		}
+		for message, ok := c.nextMessage(); ok; message, ok = c.nextMessage() {
+			writer.WriteString(message)
+		}
+		if open && len(replies) > 0 {
+			continue
+		}
+		// A failed flush means the client went away. Closing the
+		// connection stops the reader; keep draining so it never blocks
+		// on a full channel.
+		if err := writer.Flush(); err != nil {
+			fmt.Println("Error writing to client:", err)
+			conn.Close()
+			for range replies {
+			}
+			return
+		}
+	}
+}
+
+// Health answers the HTTP health check: 200 once the server is accepting
+// commands, 503 before that and while it shuts down.
+func (db *Database) Health(w http.ResponseWriter, r *http.Request) {
+	if !db.ready.Load() {
+		http.Error(w, "not ready", http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "OK")
+}
+
+func errorResponse(message string) string {
+	return "-ERR " + message + "\r\n"
+}
+
+// wrongTypeResponse is the reply to a command that would change a key
+// holding a value of another type.
+const wrongTypeResponse = "-WRONGTYPE Operation against a key holding the wrong kind of value\r\n"
+
+// bulkString encodes s as a RESP bulk string: its byte length, then the
+// bytes themselves, so values may contain spaces or CRLF.
+func bulkString(s string) string {
+	return fmt.Sprintf("$%d\r\n%s\r\n", len(s), s)
+}
+
+// EnableDebugCommands allows the DEBUG subcommands that can disrupt the
+// server, such as DEBUG PANIC. It must be called before the server accepts
+// connections.
+func (db *Database) EnableDebugCommands() {
+	db.debugCommands = true
+}
+
+// SetClock replaces the clock key expiry, TTLs and idle times are measured
+// against, so tests can move time forward instead of sleeping. Timeouts of
+// blocking commands and background work still use real time. It must be
+// called before any key is written.
+func (db *Database) SetClock(now func() time.Time) {
+	db.now = now
+}
+
+// SetDumpPath sets the snapshot file SAVE and BGSAVE write. It must be
+// called before the server accepts connections.
+func (db *Database) SetDumpPath(path string) {
+	db.dumpPath = path
+}
+
+// SetSavePoints sets the save points from a string in redis.conf form,
+// "seconds changes [seconds changes ...]", as CONFIG SET save does.
+func (db *Database) SetSavePoints(s string) error {
+	points, err := parseSavePoints(s)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	db.savePoints = points
+	db.mu.Unlock()
+	return nil
+}
+
+// Listen opens a TCP listener on addr, which may use port 0 for any free
+// port, and marks the server ready.
+func (db *Database) Listen(addr string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	fmt.Println("Listening on", listener.Addr())
+	db.mu.Lock()
+	db.listener = listener
+	db.ready.Store(true)
+	db.mu.Unlock()
+	return listener, nil
+}
+
+// Serve handles connections accepted on listener until it is closed.
+func (db *Database) Serve(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+		if err != nil {
+			fmt.Println("Error accepting connection:", err)
+			continue
+		}
+		go handleConnection(conn, db)
+	}
+}
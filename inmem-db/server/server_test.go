@@ -0,0 +1,3412 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io"
+	"maps"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestDatabase returns a Database whose sweeper stops when the test
+// ends.
+func newTestDatabase(t testing.TB) *Database {
+	t.Helper()
+	db := NewDatabase()
+	t.Cleanup(db.Close)
+	return db
+}
+
+// run sends one command straight to handleCommand, as if from no client,
+// and returns the raw reply.
+func run(db *Database, args ...string) string {
+	return db.handleCommand(nil, args)
+}
+
+// expect runs a command and fails the test unless the raw reply is want.
+func expect(t *testing.T, db *Database, want string, args ...string) {
+	t.Helper()
+	if got := run(db, args...); got != want {
+		t.Fatalf("%q = %q, want %q", args, got, want)
+	}
+}
+
+// respError is a RESP error reply, without its leading '-'.
+type respError string
+
+// readReply parses one RESP2 reply. Simple and bulk strings become string,
+// integers int64, arrays []any, nil bulks and arrays nil, and errors
+// respError.
+func readReply(r *bufio.Reader) (any, error) {
+	line, err := readLine(r)
+	if err != nil {
+		return nil, err
+	}
+	if line == "" {
+		return nil, fmt.Errorf("empty reply line")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return respError(line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		elems := make([]any, n)
+		for i := range elems {
+			if elems[i], err = readReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return elems, nil
+	}
+	return nil, fmt.Errorf("unexpected reply line %q", line)
+}
+
+// parseReply parses a raw reply as returned by handleCommand.
+func parseReply(t testing.TB, raw string) any {
+	t.Helper()
+	r := bufio.NewReader(strings.NewReader(raw))
+	reply, err := readReply(r)
+	if err != nil {
+		t.Fatalf("parsing %q: %v", raw, err)
+	}
+	if r.Buffered() != 0 {
+		t.Fatalf("trailing data after reply in %q", raw)
+	}
+	return reply
+}
+
+// replyStrings converts an array reply of bulk strings to a []string.
+func replyStrings(t testing.TB, reply any) []string {
+	t.Helper()
+	elems, ok := reply.([]any)
+	if !ok {
+		t.Fatalf("reply %#v is not an array", reply)
+	}
+	out := make([]string, len(elems))
+	for i, elem := range elems {
+		s, ok := elem.(string)
+		if !ok {
+			t.Fatalf("element %d of %#v is not a string", i, reply)
+		}
+		out[i] = s
+	}
+	return out
+}
+
+// startServer serves db on an ephemeral loopback port until the test ends
+// and returns its address. SHUTDOWN closes the listener instead of exiting.
+func startServer(t testing.TB, db *Database) string {
+	t.Helper()
+	db.exit = func(int) {}
+	listener, err := db.Listen("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.Serve(listener)
+	}()
+	t.Cleanup(func() {
+		listener.Close()
+		<-done
+	})
+	return listener.Addr().String()
+}
+
+// testConn is a client connection that sends RESP multi-bulk requests.
+type testConn struct {
+	t    testing.TB
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func dial(t testing.TB, addr string) *testConn {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, r: bufio.NewReader(conn)}
+}
+
+// send writes one request without waiting for its reply.
+func (c *testConn) send(args ...string) {
+	c.t.Helper()
+	var request strings.Builder
+	appendMultiBulk(&request, args)
+	if _, err := io.WriteString(c.conn, request.String()); err != nil {
+		c.t.Fatal(err)
+	}
+}
+
+// read waits up to five seconds for the next reply.
+func (c *testConn) read() any {
+	c.t.Helper()
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := readReply(c.r)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	return reply
+}
+
+// do sends a request and returns its reply.
+func (c *testConn) do(args ...string) any {
+	c.t.Helper()
+	c.send(args...)
+	return c.read()
+}
+
+func TestBitposAllZeroString(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, "+OK\r\n", "SET", "k", "\x00\x00\x00")
+	expect(t, db, ":-1\r\n", "BITPOS", "k", "1")
+	expect(t, db, ":0\r\n", "BITPOS", "k", "0")
+	expect(t, db, ":8\r\n", "BITPOS", "k", "0", "1")
+	// A missing key is an empty string: no set bits, first clear bit 0.
+	expect(t, db, ":-1\r\n", "BITPOS", "missing", "1")
+	expect(t, db, ":0\r\n", "BITPOS", "missing", "0")
+}
+
+func TestBitfieldIncrbySatSaturates(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, "*1\r\n:200\r\n", "BITFIELD", "k", "OVERFLOW", "SAT", "INCRBY", "u8", "0", "200")
+	expect(t, db, "*1\r\n:255\r\n", "BITFIELD", "k", "OVERFLOW", "SAT", "INCRBY", "u8", "0", "100")
+	expect(t, db, "*1\r\n:255\r\n", "BITFIELD", "k", "GET", "u8", "0")
+
+	expect(t, db, "*2\r\n:100\r\n:127\r\n", "BITFIELD", "s", "OVERFLOW", "SAT", "INCRBY", "i8", "0", "100", "INCRBY", "i8", "0", "100")
+	expect(t, db, "*1\r\n:-128\r\n", "BITFIELD", "s", "OVERFLOW", "SAT", "INCRBY", "i8", "0", "-1000")
+}
+
+func TestIntrospectionCommandsAgree(t *testing.T) {
+	db := newTestDatabase(t)
+	for _, args := range [][]string{
+		{"SET", "string", "12"},
+		{"ZADD", "zset", "1", "a"},
+		{"HSET", "hash", "f", "v"},
+		{"RPUSH", "list", "a"},
+		{"SADD", "set", "1"},
+	} {
+		run(db, args...)
+		run(db, "EXPIRE", args[1], "100")
+	}
+	run(db, "SET", "persistent", "v")
+	run(db, "SET", "gone", "v", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+
+	for _, key := range []string{"string", "zset", "hash", "list", "set", "persistent", "gone", "missing"} {
+		db.mu.Lock()
+		info := db.keyInfo(key)
+		db.mu.Unlock()
+
+		if got := run(db, "TYPE", key); got != "+"+info.kind+"\r\n" {
+			t.Errorf("TYPE %s = %q, keyInfo kind %q", key, got, info.kind)
+		}
+		wantTTL := ":-2\r\n"
+		if info.exists {
+			wantTTL = fmt.Sprintf(":%d\r\n", int64(info.ttl/time.Second))
+			if info.ttl < 0 {
+				wantTTL = ":-1\r\n"
+			}
+		}
+		if got := run(db, "TTL", key); got != wantTTL {
+			t.Errorf("TTL %s = %q, want %q", key, got, wantTTL)
+		}
+
+		encoding := run(db, "OBJECT", "ENCODING", key)
+		usage := run(db, "MEMORY", "USAGE", key)
+		debugObject := run(db, "DEBUG", "OBJECT", key)
+		if !info.exists {
+			if encoding != "$-1\r\n" || usage != "$-1\r\n" || !strings.HasPrefix(debugObject, "-") {
+				t.Errorf("%s: missing key reported as OBJECT %q, MEMORY %q, DEBUG %q", key, encoding, usage, debugObject)
+			}
+			continue
+		}
+		if encoding != bulkString(info.encoding) {
+			t.Errorf("OBJECT ENCODING %s = %q, keyInfo encoding %q", key, encoding, info.encoding)
+		}
+		if usage != fmt.Sprintf(":%d\r\n", info.size) {
+			t.Errorf("MEMORY USAGE %s = %q, keyInfo size %d", key, usage, info.size)
+		}
+		if want := fmt.Sprintf("encoding:%s serializedlength:%d ", info.encoding, info.size); !strings.Contains(debugObject, want) {
+			t.Errorf("DEBUG OBJECT %s = %q, want it to contain %q", key, debugObject, want)
+		}
+	}
+}
+
+// infoField returns the value of field in the INFO reply, or "" if it is
+// not there.
+func infoField(t testing.TB, db *Database, field string) string {
+	t.Helper()
+	info, _ := parseReply(t, run(db, "INFO")).(string)
+	for _, line := range strings.Split(info, "\r\n") {
+		if value, ok := strings.CutPrefix(line, field+":"); ok {
+			return value
+		}
+	}
+	return ""
+}
+
+// waitFor polls cond until it holds, failing the test after five seconds.
+func waitFor(t testing.TB, what string, cond func() bool) {
+	t.Helper()
+	for deadline := time.Now().Add(5 * time.Second); !cond(); {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestUnlinkAndFlushallAsyncFreeInBackground(t *testing.T) {
+	db := newTestDatabase(t)
+	members := []string{"SADD", "big"}
+	for i := 0; i <= lazyfreeThreshold; i++ {
+		members = append(members, strconv.Itoa(i))
+	}
+	run(db, members...)
+	run(db, "SADD", "small", "a")
+	expect(t, db, ":2\r\n", "UNLINK", "big", "small", "missing")
+	expect(t, db, ":0\r\n", "EXISTS", "big", "small")
+	waitFor(t, "the large set to be freed", func() bool {
+		return infoField(t, db, "lazyfreed_objects") == "1"
+	})
+
+	run(db, "SET", "s", "v")
+	run(db, "HSET", "h", "f", "v")
+	expect(t, db, "+OK\r\n", "FLUSHALL", "ASYNC")
+	expect(t, db, ":0\r\n", "DBSIZE")
+	waitFor(t, "the flushed keyspace to be freed", func() bool {
+		return infoField(t, db, "lazyfree_pending_objects") == "0" && infoField(t, db, "lazyfreed_objects") == "5"
+	})
+
+	run(db, "SET", "s", "v")
+	expect(t, db, "+OK\r\n", "FLUSHALL", "SYNC")
+	expect(t, db, ":0\r\n", "DBSIZE")
+	if got := infoField(t, db, "lazyfreed_objects"); got != "5" {
+		t.Errorf("FLUSHALL SYNC went through the lazyfree worker: lazyfreed_objects = %s", got)
+	}
+}
+
+// BenchmarkUnlinkLargeSet times UNLINK of a million-member set, which is
+// how long it holds db.mu: the members are released by the lazyfree
+// worker afterwards.
+func BenchmarkUnlinkLargeSet(b *testing.B) {
+	db := newTestDatabase(b)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		set := make(map[string]struct{}, 1000000)
+		for j := 0; j < 1000000; j++ {
+			set[strconv.Itoa(j)] = struct{}{}
+		}
+		db.mu.Lock()
+		db.sets["big"] = set
+		db.mu.Unlock()
+		b.StartTimer()
+
+		if got := run(db, "UNLINK", "big"); got != ":1\r\n" {
+			b.Fatalf("UNLINK = %q", got)
+		}
+	}
+}
+
+// BenchmarkFlushallAsync times FLUSHALL ASYNC of a hundred thousand keys.
+func BenchmarkFlushallAsync(b *testing.B) {
+	db := newTestDatabase(b)
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db.mu.Lock()
+		for j := 0; j < 100000; j++ {
+			db.data.Set("s"+strconv.Itoa(j), "v")
+			db.hashes["h"+strconv.Itoa(j)] = map[string]string{"f": "v"}
+		}
+		db.mu.Unlock()
+		b.StartTimer()
+
+		if got := run(db, "FLUSHALL", "ASYNC"); got != "+OK\r\n" {
+			b.Fatalf("FLUSHALL ASYNC = %q", got)
+		}
+	}
+}
+
+func TestArgumentLimitRejectsBeforeExecuting(t *testing.T) {
+	db := newTestDatabase(t)
+	db.maxArgs = 4
+	run(db, "SET", "a", "1")
+	expect(t, db, "-ERR too many arguments\r\n", "DEL", "a", "b", "c", "d")
+	expect(t, db, ":1\r\n", "EXISTS", "a")
+	expect(t, db, ":1\r\n", "DEL", "a", "b", "c")
+
+	// A multi-bulk header over the limit is refused before its arguments
+	// are read.
+	_, err := readCommand(bufio.NewReader(strings.NewReader("*5\r\n")), db.maxArgs)
+	if err == nil || err.Error() != "Protocol error: invalid multibulk length" {
+		t.Errorf("readCommand with 5 arguments: err = %v", err)
+	}
+}
+
+func TestMultiBulkSetGet(t *testing.T) {
+	db := newTestDatabase(t)
+	conn := dial(t, startServer(t, db))
+	value := "spaces and \r\n inside " + strings.Repeat("x", 64*1024)
+	if got := conn.do("SET", "k", value); got != "OK" {
+		t.Fatalf("SET = %v", got)
+	}
+	if got := conn.do("GET", "k"); got != value {
+		t.Fatalf("GET returned %d bytes, want %d", len(got.(string)), len(value))
+	}
+}
+
+func TestBulkLengthIsNotAllocatedUpFront(t *testing.T) {
+	// A header claiming the largest bulk with only a few bytes behind it
+	// fails on the short body without allocating the claimed length.
+	request := fmt.Sprintf("*1\r\n$%d\r\nabc", maxBulkLen)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := readCommand(bufio.NewReader(strings.NewReader(request)), 0)
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("readCommand allocated %d bytes", allocated)
+	}
+	if err != io.ErrUnexpectedEOF {
+		t.Errorf("readCommand with a short bulk: err = %v, want %v", err, io.ErrUnexpectedEOF)
+	}
+	_, err = readCommand(bufio.NewReader(strings.NewReader("*1\r\n$3\r\nabcXY")), 0)
+	if err == nil || err.Error() != "Protocol error: bulk argument is not terminated by CRLF" {
+		t.Errorf("readCommand without CRLF: err = %v", err)
+	}
+}
+
+func TestOverflowingTTLIsRejected(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "k", "v")
+	for _, args := range [][]string{
+		{"EXPIRE", "k", "9999999999999999"},
+		{"PEXPIRE", "k", "99999999999999999"},
+		{"SET", "k", "other", "EX", "9999999999999999"},
+		{"GETEX", "k", "EX", "9999999999999999"},
+		{"INCREX", "n", "1", "9999999999999999"},
+	} {
+		want := fmt.Sprintf("-ERR invalid expire time in '%s' command\r\n", strings.ToLower(args[0]))
+		expect(t, db, want, args...)
+	}
+	expect(t, db, "$1\r\nv\r\n", "GET", "k")
+	expect(t, db, ":-1\r\n", "TTL", "k")
+	expect(t, db, ":0\r\n", "EXISTS", "n")
+
+	expect(t, db, "-ERR value is not an integer or out of range\r\n", "EXPIRE", "k", "99999999999999999999")
+	expect(t, db, "-ERR value is not an integer or out of range\r\n", "EXPIRE", "k", "ten")
+	expect(t, db, "-ERR invalid expire time in 'set' command\r\n", "SET", "k", "v", "EX", "-1")
+}
+
+func TestShutdownSaveSnapshotsAndExits(t *testing.T) {
+	db := newTestDatabase(t)
+	db.dumpPath = t.TempDir() + "/dump.gob"
+	exitCode := -1
+	db.exit = func(code int) { exitCode = code }
+	run(db, "SET", "k", "v")
+
+	run(db, "SHUTDOWN", "SAVE")
+	if exitCode != 0 {
+		t.Fatalf("exit hook called with %d, want 0", exitCode)
+	}
+	restored := newTestDatabase(t)
+	if err := restored.LoadSnapshot(db.dumpPath); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, restored, "$1\r\nv\r\n", "GET", "k")
+}
+
+func TestShutdownNosaveDoesNotSnapshot(t *testing.T) {
+	db := newTestDatabase(t)
+	db.dumpPath = t.TempDir() + "/dump.gob"
+	exited := false
+	db.exit = func(int) { exited = true }
+	run(db, "SET", "k", "v")
+
+	run(db, "SHUTDOWN", "NOSAVE")
+	if !exited {
+		t.Fatal("exit hook not called")
+	}
+	if _, err := os.Stat(db.dumpPath); !os.IsNotExist(err) {
+		t.Errorf("SHUTDOWN NOSAVE wrote %s: %v", db.dumpPath, err)
+	}
+}
+
+func TestSavePointTriggersBgsave(t *testing.T) {
+	db := newTestDatabase(t)
+	db.dumpPath = t.TempDir() + "/dump.gob"
+	expect(t, db, "+OK\r\n", "CONFIG", "SET", "save", "1 3")
+	expect(t, db, "*2\r\n$4\r\nsave\r\n$3\r\n1 3\r\n", "CONFIG", "GET", "save")
+	run(db, "SET", "a", "1")
+	run(db, "SET", "b", "2")
+	run(db, "GET", "a")
+	if got := infoField(t, db, "rdb_changes_since_last_save"); got != "2" {
+		t.Fatalf("rdb_changes_since_last_save = %s, want 2", got)
+	}
+
+	time.Sleep(1200 * time.Millisecond)
+	if _, err := os.Stat(db.dumpPath); !os.IsNotExist(err) {
+		t.Fatalf("saved after 2 of 3 changes: %v", err)
+	}
+	run(db, "SET", "c", "3")
+	waitFor(t, "automatic BGSAVE", func() bool {
+		return infoField(t, db, "rdb_changes_since_last_save") == "0"
+	})
+	restored := newTestDatabase(t)
+	if err := restored.LoadSnapshot(db.dumpPath); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, restored, "$1\r\n3\r\n", "GET", "c")
+}
+
+func TestSavePointsRejectsBadConfig(t *testing.T) {
+	db := newTestDatabase(t)
+	for _, value := range []string{"900", "900 0", "-1 1", "ten 1"} {
+		if got := run(db, "CONFIG", "SET", "save", value); !strings.HasPrefix(got, "-ERR") {
+			t.Errorf("CONFIG SET save %q = %q, want an error", value, got)
+		}
+	}
+	expect(t, db, "+OK\r\n", "CONFIG", "SET", "save", "")
+}
+
+func TestCommandInfo(t *testing.T) {
+	db := newTestDatabase(t)
+	reply, ok := parseReply(t, run(db, "COMMAND", "INFO", "get", "SET", "bogus")).([]any)
+	if !ok || len(reply) != 3 {
+		t.Fatalf("COMMAND INFO reply = %#v, want three entries", reply)
+	}
+	for i, name := range []string{"get", "set"} {
+		entry, ok := reply[i].([]any)
+		if !ok || len(entry) != 6 {
+			t.Fatalf("entry for %s = %#v", name, reply[i])
+		}
+		spec := commandTable[name]
+		if entry[0] != name || entry[1] != int64(spec.arity) || entry[3] != int64(1) || entry[4] != int64(1) || entry[5] != int64(1) {
+			t.Errorf("entry for %s = %#v", name, entry)
+		}
+		if flags := replyStrings(t, entry[2]); !slices.Equal(flags, spec.flags) {
+			t.Errorf("flags for %s = %q, want %q", name, flags, spec.flags)
+		}
+	}
+	if reply[2] != nil {
+		t.Errorf("entry for bogus = %#v, want nil", reply[2])
+	}
+}
+
+func TestZaddInfiniteScoresSortAtTheEnds(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, ":4\r\n", "ZADD", "z", "+inf", "top", "1", "one", "-inf", "bottom", "inf", "also-top")
+	got := replyStrings(t, parseReply(t, run(db, "ZRANGE", "z", "0", "-1", "WITHSCORES")))
+	want := []string{"bottom", "-inf", "one", "1", "also-top", "inf", "top", "inf"}
+	if !slices.Equal(got, want) {
+		t.Errorf("ZRANGE WITHSCORES = %q, want %q", got, want)
+	}
+	expect(t, db, "-ERR not a valid float\r\n", "ZADD", "z", "nan", "x")
+	expect(t, db, ":4\r\n", "ZCARD", "z")
+}
+
+func TestInfoKeyspaceAvgTTL(t *testing.T) {
+	db := newTestDatabase(t)
+	for i, ttl := range []string{"100", "200", "300", "400"} {
+		run(db, "SET", fmt.Sprintf("k%d", i), "v", "EX", ttl)
+	}
+	run(db, "SET", "persistent", "v")
+	run(db, "SET", "expired", "v", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+
+	keyspace := infoField(t, db, "db0")
+	var keys, expires int
+	var avgTTL int64
+	if _, err := fmt.Sscanf(keyspace, "keys=%d,expires=%d,avg_ttl=%d", &keys, &expires, &avgTTL); err != nil {
+		t.Fatalf("db0:%s: %v", keyspace, err)
+	}
+	if keys != 5 || expires != 4 {
+		t.Errorf("db0:%s, want keys=5,expires=4", keyspace)
+	}
+	if want := int64(250000); avgTTL > want || avgTTL < want-1000 {
+		t.Errorf("avg_ttl = %d, want within a second below %d", avgTTL, want)
+	}
+}
+
+func TestSnapshotWithAKeyUnderTwoTypesIsRejected(t *testing.T) {
+	path := t.TempDir() + "/dump.gob"
+	snap := &snapshot{
+		Strings: map[string]string{"k": "v", "s": "v"},
+		Sets:    map[string][]string{"k": {"m"}},
+		Expiry:  map[string]int64{"s": time.Now().Add(time.Hour).UnixMilli()},
+	}
+	if err := writeSnapshot(path, snap); err != nil {
+		t.Fatal(err)
+	}
+	db := newTestDatabase(t)
+	err := db.LoadSnapshot(path)
+	if err == nil || !strings.Contains(err.Error(), `key "k" is stored as both a`) {
+		t.Fatalf("LoadSnapshot = %v, want the two-type key rejected", err)
+	}
+	expect(t, db, ":0\r\n", "DBSIZE")
+
+	// A valid snapshot replaces what a key held before, whatever its type.
+	delete(snap.Sets, "k")
+	if err := writeSnapshot(path, snap); err != nil {
+		t.Fatal(err)
+	}
+	run(db, "HSET", "k", "f", "v")
+	if err := db.LoadSnapshot(path); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, db, "+string\r\n", "TYPE", "k")
+	if err := checkConsistency(db); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestInfoPubsubChannelsTracksSubscriptions(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	subscriber := dial(t, addr)
+	other := dial(t, addr)
+
+	subscriber.do("SUBSCRIBE", "a", "b")
+	subscriber.read()
+	other.do("SUBSCRIBE", "b")
+	if got := infoField(t, db, "pubsub_channels"); got != "2" {
+		t.Errorf("pubsub_channels = %s after subscribing to a and b, want 2", got)
+	}
+	if got := infoField(t, db, "pubsub_patterns"); got != "0" {
+		t.Errorf("pubsub_patterns = %s, want 0", got)
+	}
+
+	other.do("UNSUBSCRIBE", "b")
+	if got := infoField(t, db, "pubsub_channels"); got != "2" {
+		t.Errorf("pubsub_channels = %s with b still subscribed, want 2", got)
+	}
+	subscriber.do("UNSUBSCRIBE", "a")
+	if got := infoField(t, db, "pubsub_channels"); got != "1" {
+		t.Errorf("pubsub_channels = %s after unsubscribing from a, want 1", got)
+	}
+
+	// Disconnecting drops the connection's remaining subscriptions.
+	subscriber.conn.Close()
+	waitFor(t, "pubsub_channels to drop to 0", func() bool {
+		return infoField(t, db, "pubsub_channels") == "0"
+	})
+}
+
+func TestPexpirePatternOnlyTouchesMatchingKeys(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "session:1", "v")
+	run(db, "HSET", "session:2", "f", "v")
+	run(db, "SET", "user:1", "v")
+	run(db, "SADD", "sessions", "1")
+
+	expect(t, db, ":2\r\n", "PEXPIREPATTERN", "session:*", "100000")
+	for _, key := range []string{"session:1", "session:2"} {
+		if ttl, _ := strconv.Atoi(strings.Trim(run(db, "PTTL", key), ":\r\n")); ttl <= 99000 || ttl > 100000 {
+			t.Errorf("PTTL %s = %d, want about 100000", key, ttl)
+		}
+	}
+	for _, key := range []string{"user:1", "sessions"} {
+		expect(t, db, ":-1\r\n", "PTTL", key)
+	}
+	expect(t, db, ":0\r\n", "PEXPIREPATTERN", "nothing:*", "100")
+}
+
+func TestSetWithoutTTLClearsOldExpiry(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "k", "old", "PX", "50")
+	run(db, "SET", "kept", "old", "PX", "50")
+	run(db, "SET", "k", "new")
+	run(db, "SET", "kept", "new", "KEEPTTL")
+	expect(t, db, ":-1\r\n", "TTL", "k")
+
+	// Outlast the old deadline and give the sweeper a pass.
+	time.Sleep(50*time.Millisecond + 2*sweepInterval)
+	expect(t, db, "$3\r\nnew\r\n", "GET", "k")
+	expect(t, db, "$-1\r\n", "GET", "kept")
+}
+
+func TestClientClosingMidReplyEndsItsConnection(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	run(db, "SET", "big", strings.Repeat("x", 64*1024))
+
+	conn := dial(t, addr)
+	var pipeline strings.Builder
+	for i := 0; i < 1000; i++ {
+		appendMultiBulk(&pipeline, []string{"GET", "big"})
+	}
+	go io.WriteString(conn.conn, pipeline.String())
+	// Read part of the first reply, then hang up on the rest.
+	conn.r.Peek(1)
+	conn.conn.Close()
+
+	waitFor(t, "the connection to be dropped", func() bool {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return len(db.conns) == 0
+	})
+	if got := dial(t, addr).do("STRLEN", "big"); got != int64(64*1024) {
+		t.Fatalf("STRLEN on a new connection = %#v", got)
+	}
+}
+
+func TestDebugPanicIsRecovered(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	conn, other := dial(t, addr), dial(t, addr)
+
+	if got := conn.do("DEBUG", "PANIC"); got != respError("ERR DEBUG PANIC is disabled; start the server with -enable-debug-command") {
+		t.Errorf("DEBUG PANIC without -enable-debug-command = %#v", got)
+	}
+	db.mu.Lock()
+	db.debugCommands = true
+	db.mu.Unlock()
+	if got := conn.do("DEBUG", "PANIC"); got != respError("ERR internal error") {
+		t.Errorf("DEBUG PANIC = %#v, want an internal error", got)
+	}
+	if got := conn.do("SET", "k", "v"); got != "OK" {
+		t.Errorf("SET on the panicking connection = %#v", got)
+	}
+	if got := other.do("GET", "k"); got != "v" {
+		t.Errorf("GET on another connection = %#v", got)
+	}
+}
+
+func TestZaddIncrWithGTOrLT(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "ZADD", "z", "10", "m")
+	expect(t, db, "$-1\r\n", "ZADD", "z", "GT", "INCR", "-5", "m")
+	expect(t, db, "$2\r\n10\r\n", "ZSCORE", "z", "m")
+	expect(t, db, "$2\r\n15\r\n", "ZADD", "z", "GT", "INCR", "5", "m")
+	expect(t, db, "$-1\r\n", "ZADD", "z", "LT", "INCR", "5", "m")
+	expect(t, db, "$2\r\n12\r\n", "ZADD", "z", "LT", "INCR", "-3", "m")
+	expect(t, db, "$2\r\n12\r\n", "ZSCORE", "z", "m")
+}
+
+// sortedMembers is the map-and-sort ordering sorted sets had before the
+// skiplist: ascending score, ties broken by member.
+func sortedMembers(scores map[string]float64) []string {
+	members := make([]string, 0, len(scores))
+	for member := range scores {
+		members = append(members, member)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		a, b := members[i], members[j]
+		if scores[a] != scores[b] {
+			return scores[a] < scores[b]
+		}
+		return a < b
+	})
+	return members
+}
+
+func TestSkiplistMatchesSortedMap(t *testing.T) {
+	db := newTestDatabase(t)
+	rng := rand.New(rand.NewSource(1))
+	scores := make(map[string]float64)
+	for i := 0; i < 2000; i++ {
+		member := strconv.Itoa(rng.Intn(300))
+		if rng.Intn(4) == 0 {
+			run(db, "ZREM", "z", member)
+			delete(scores, member)
+			continue
+		}
+		score := float64(rng.Intn(50))
+		run(db, "ZADD", "z", strconv.FormatFloat(score, 'f', -1, 64), member)
+		scores[member] = score
+	}
+
+	want := sortedMembers(scores)
+	if got := replyStrings(t, parseReply(t, run(db, "ZRANGE", "z", "0", "-1"))); !slices.Equal(got, want) {
+		t.Fatalf("ZRANGE 0 -1 = %q, want %q", got, want)
+	}
+	if got := replyStrings(t, parseReply(t, run(db, "ZRANGE", "z", "10", "20"))); !slices.Equal(got, want[10:21]) {
+		t.Errorf("ZRANGE 10 20 = %q, want %q", got, want[10:21])
+	}
+	for rank, member := range want {
+		expect(t, db, fmt.Sprintf(":%d\r\n", rank), "ZRANK", "z", member)
+	}
+}
+
+func BenchmarkZrange100k(b *testing.B) {
+	db := newTestDatabase(b)
+	for i := 0; i < 100000; i++ {
+		run(db, "ZADD", "z", strconv.Itoa(i%1000), strconv.Itoa(i))
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		run(db, "ZRANGE", "z", "50000", "50009")
+	}
+}
+
+func TestLegacyZrangeCommandsMatchUnifiedForm(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "ZADD", "z", "1", "a", "2", "b", "2", "c", "3", "d", "5", "e")
+	run(db, "ZADD", "lex", "0", "a", "0", "b", "0", "c", "0", "d", "0", "e")
+	for _, tc := range []struct{ legacy, unified []string }{
+		{[]string{"ZREVRANGE", "z", "0", "-1"}, []string{"ZRANGE", "z", "0", "-1", "REV"}},
+		{[]string{"ZREVRANGE", "z", "1", "3", "WITHSCORES"}, []string{"ZRANGE", "z", "1", "3", "REV", "WITHSCORES"}},
+		{[]string{"ZRANGEBYSCORE", "z", "2", "(5"}, []string{"ZRANGE", "z", "2", "(5", "BYSCORE"}},
+		{[]string{"ZRANGEBYSCORE", "z", "-inf", "+inf", "WITHSCORES", "LIMIT", "1", "2"}, []string{"ZRANGE", "z", "-inf", "+inf", "BYSCORE", "LIMIT", "1", "2", "WITHSCORES"}},
+		{[]string{"ZREVRANGEBYSCORE", "z", "5", "(1"}, []string{"ZRANGE", "z", "5", "(1", "BYSCORE", "REV"}},
+		{[]string{"ZRANGEBYLEX", "lex", "[b", "(e"}, []string{"ZRANGE", "lex", "[b", "(e", "BYLEX"}},
+		{[]string{"ZRANGEBYLEX", "lex", "-", "+", "LIMIT", "0", "2"}, []string{"ZRANGE", "lex", "-", "+", "BYLEX", "LIMIT", "0", "2"}},
+		{[]string{"ZREVRANGEBYLEX", "lex", "+", "[c"}, []string{"ZRANGE", "lex", "+", "[c", "BYLEX", "REV"}},
+	} {
+		legacy, unified := run(db, tc.legacy...), run(db, tc.unified...)
+		if legacy != unified || strings.HasPrefix(legacy, "-") {
+			t.Errorf("%q = %q, %q = %q", tc.legacy, legacy, tc.unified, unified)
+		}
+	}
+	expect(t, db, "-ERR syntax error, LIMIT is only supported in combination with either BYSCORE or BYLEX\r\n", "ZRANGE", "z", "0", "-1", "LIMIT", "0", "1")
+}
+
+// argTokens collects the tokens of a COMMAND DOCS argument list and its
+// nested arguments.
+func argTokens(t *testing.T, args any) []string {
+	t.Helper()
+	var tokens []string
+	for _, arg := range args.([]any) {
+		fields := arg.([]any)
+		for i := 0; i+1 < len(fields); i += 2 {
+			switch fields[i] {
+			case "token":
+				tokens = append(tokens, fields[i+1].(string))
+			case "arguments":
+				tokens = append(tokens, argTokens(t, fields[i+1])...)
+			}
+		}
+	}
+	return tokens
+}
+
+func TestCommandDocsSet(t *testing.T) {
+	db := newTestDatabase(t)
+	reply := parseReply(t, run(db, "COMMAND", "DOCS", "set", "bogus")).([]any)
+	if len(reply) != 2 || reply[0] != "set" {
+		t.Fatalf("COMMAND DOCS set bogus = %#v, want only set", reply)
+	}
+	doc := reply[1].([]any)
+	var tokens []string
+	for i := 0; i+1 < len(doc); i += 2 {
+		if doc[i] == "arguments" {
+			tokens = argTokens(t, doc[i+1])
+		}
+	}
+	for _, token := range []string{"EX", "PX", "NX", "XX", "KEEPTTL"} {
+		if !slices.Contains(tokens, token) {
+			t.Errorf("COMMAND DOCS set has no %s argument; tokens are %q", token, tokens)
+		}
+	}
+
+	for name := range commandTable {
+		if _, ok := commandDocs[name]; !ok {
+			t.Errorf("%s has no COMMAND DOCS entry", name)
+		}
+	}
+}
+
+func TestQuitRepliesOKBeforeClosing(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	for _, send := range []func(c *testConn){
+		func(c *testConn) { c.send("QUIT") },
+		func(c *testConn) { io.WriteString(c.conn, "quit\r\n") },
+	} {
+		conn := dial(t, addr)
+		send(conn)
+		if got := conn.read(); got != "OK" {
+			t.Errorf("QUIT = %#v, want OK", got)
+		}
+		if _, err := conn.r.ReadByte(); err != io.EOF {
+			t.Errorf("read after QUIT: err = %v, want EOF", err)
+		}
+	}
+}
+
+func TestClientInfoReportsName(t *testing.T) {
+	db := newTestDatabase(t)
+	conn := dial(t, startServer(t, db))
+	if got := conn.do("CLIENT", "SETNAME", "foo"); got != "OK" {
+		t.Fatalf("CLIENT SETNAME = %#v", got)
+	}
+	id := conn.do("CLIENT", "ID")
+	info, _ := conn.do("CLIENT", "INFO").(string)
+	for _, field := range []string{fmt.Sprintf("id=%d", id), "name=foo", "db=0", "sub=0", "cmd=client"} {
+		if !slices.Contains(strings.Fields(info), field) {
+			t.Errorf("CLIENT INFO = %q, want %s", info, field)
+		}
+	}
+}
+
+// captureStdout returns what fn prints to standard output, where the
+// server logs.
+func captureStdout(t *testing.T, fn func()) string {
+	t.Helper()
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+	output := make(chan string)
+	go func() {
+		b, _ := io.ReadAll(r)
+		output <- string(b)
+	}()
+	fn()
+	w.Close()
+	return <-output
+}
+
+func TestKeysTypeFilterAndWarning(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "s", "v")
+	run(db, "SADD", "set1", "m")
+	run(db, "SADD", "set2", "m")
+	run(db, "HSET", "h", "f", "v")
+
+	var got []string
+	logged := captureStdout(t, func() {
+		got = replyStrings(t, parseReply(t, run(db, "KEYS", "*", "TYPE", "set")))
+	})
+	sort.Strings(got)
+	if !slices.Equal(got, []string{"set1", "set2"}) {
+		t.Errorf("KEYS * TYPE set = %q", got)
+	}
+	if logged != "" {
+		t.Errorf("KEYS under the threshold logged %q", logged)
+	}
+
+	db.keysWarnThreshold = 3
+	logged = captureStdout(t, func() { run(db, "KEYS", "*") })
+	if !strings.Contains(logged, "Warning: KEYS * returned 4 keys") {
+		t.Errorf("KEYS over the threshold logged %q", logged)
+	}
+}
+
+// pttl returns the PTTL of key.
+func pttl(t *testing.T, db *Database, key string) int64 {
+	t.Helper()
+	ms, ok := parseReply(t, run(db, "PTTL", key)).(int64)
+	if !ok {
+		t.Fatalf("PTTL %s is not an integer", key)
+	}
+	return ms
+}
+
+func TestIncrexIncrementsAndExtendsTTL(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, ":1\r\n", "INCREX", "hits", "1", "1")
+	time.Sleep(600 * time.Millisecond)
+	if ms := pttl(t, db, "hits"); ms > 400 {
+		t.Fatalf("PTTL after 600ms = %d", ms)
+	}
+	expect(t, db, ":3\r\n", "INCREX", "hits", "2", "1")
+	if ms := pttl(t, db, "hits"); ms < 900 {
+		t.Errorf("PTTL after a second INCREX = %d, want the window restarted", ms)
+	}
+
+	// Past the first window the key lives on, until its own window ends.
+	time.Sleep(600 * time.Millisecond)
+	expect(t, db, "$1\r\n3\r\n", "GET", "hits")
+	time.Sleep(500 * time.Millisecond)
+	expect(t, db, ":0\r\n", "EXISTS", "hits")
+	expect(t, db, "-ERR invalid expire time in 'increx' command\r\n", "INCREX", "hits", "1", "0")
+}
+
+func TestMpopFallsThroughToFirstNonEmptyKey(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "ZADD", "z2", "1", "a", "2", "b", "3", "c")
+	expect(t, db, "*2\r\n$2\r\nz2\r\n*1\r\n*2\r\n$1\r\na\r\n$1\r\n1\r\n", "ZMPOP", "2", "z1", "z2", "MIN")
+	expect(t, db, "*2\r\n$2\r\nz2\r\n*2\r\n*2\r\n$1\r\nc\r\n$1\r\n3\r\n*2\r\n$1\r\nb\r\n$1\r\n2\r\n", "ZMPOP", "2", "z1", "z2", "MAX", "COUNT", "5")
+	expect(t, db, ":0\r\n", "EXISTS", "z2")
+	expect(t, db, "*-1\r\n", "ZMPOP", "2", "z1", "z2", "MIN")
+
+	run(db, "RPUSH", "l2", "a", "b", "c", "d")
+	expect(t, db, "*2\r\n$2\r\nl2\r\n*1\r\n$1\r\na\r\n", "LMPOP", "2", "l1", "l2", "LEFT")
+	expect(t, db, "*2\r\n$2\r\nl2\r\n*2\r\n$1\r\nd\r\n$1\r\nc\r\n", "LMPOP", "2", "l1", "l2", "RIGHT", "COUNT", "2")
+	expect(t, db, "*2\r\n$2\r\nl2\r\n*1\r\n$1\r\nb\r\n", "LMPOP", "2", "l1", "l2", "LEFT", "COUNT", "10")
+	expect(t, db, ":0\r\n", "EXISTS", "l2")
+	expect(t, db, "*-1\r\n", "LMPOP", "2", "l1", "l2", "LEFT")
+
+	expect(t, db, "-ERR syntax error\r\n", "LMPOP", "1", "l1", "MIN")
+	expect(t, db, "-ERR numkeys should be greater than 0\r\n", "LMPOP", "0", "l1", "LEFT")
+	expect(t, db, "-ERR count should be greater than 0\r\n", "LMPOP", "1", "l1", "LEFT", "COUNT", "0")
+}
+
+// waitBlocked waits until n clients are blocked.
+func waitBlocked(t *testing.T, db *Database, n int) {
+	t.Helper()
+	waitFor(t, fmt.Sprintf("%d blocked clients", n), func() bool {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		blocked := 0
+		for _, c := range db.conns {
+			if c.blocked {
+				blocked++
+			}
+		}
+		return blocked == n
+	})
+}
+
+func TestBlmpopWokenByPushToSecondKey(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	blocked, pusher := dial(t, addr), dial(t, addr)
+
+	blocked.send("BLMPOP", "0", "2", "first", "second", "LEFT", "COUNT", "2")
+	waitBlocked(t, db, 1)
+	if got := pusher.do("RPUSH", "second", "a", "b", "c"); got != int64(3) {
+		t.Fatalf("RPUSH = %#v", got)
+	}
+	got := blocked.read().([]any)
+	if got[0] != "second" || !slices.Equal(replyStrings(t, got[1]), []string{"a", "b"}) {
+		t.Errorf("BLMPOP = %#v, want a and b from second", got)
+	}
+	if got := pusher.do("LRANGE", "second", "0", "-1"); !slices.Equal(replyStrings(t, got), []string{"c"}) {
+		t.Errorf("LRANGE after BLMPOP = %#v", got)
+	}
+
+	if got := blocked.do("BLMPOP", "0.05", "1", "first", "RIGHT"); got != nil {
+		t.Errorf("BLMPOP timing out = %#v, want nil", got)
+	}
+}
+
+func TestBzmpopWokenByZadd(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	blocked, writer := dial(t, addr), dial(t, addr)
+
+	blocked.send("BZMPOP", "5", "2", "z1", "z2", "MAX")
+	waitBlocked(t, db, 1)
+	writer.do("ZADD", "z2", "1", "a", "2", "b")
+	got := blocked.read().([]any)
+	if got[0] != "z2" || fmt.Sprint(got[1]) != "[[b 2]]" {
+		t.Errorf("BZMPOP = %#v, want b from z2", got)
+	}
+	if got := blocked.do("BZMPOP", "0.05", "1", "missing", "MIN"); got != nil {
+		t.Errorf("BZMPOP timing out = %#v, want nil", got)
+	}
+}
+
+// sliceStore is a Store kept as a sorted slice, standing in for a backend
+// other than a map. It panics if modified during Iterate, which the Store
+// contract rules out.
+type sliceStore struct {
+	keys, values []string
+	iterating    bool
+}
+
+func (s *sliceStore) find(key string) (int, bool) {
+	return slices.BinarySearch(s.keys, key)
+}
+
+func (s *sliceStore) Get(key string) (string, bool) {
+	if i, ok := s.find(key); ok {
+		return s.values[i], true
+	}
+	return "", false
+}
+
+func (s *sliceStore) Set(key, value string) {
+	s.mustNotIterate()
+	i, ok := s.find(key)
+	if ok {
+		s.values[i] = value
+		return
+	}
+	s.keys = slices.Insert(s.keys, i, key)
+	s.values = slices.Insert(s.values, i, value)
+}
+
+func (s *sliceStore) Del(key string) bool {
+	s.mustNotIterate()
+	i, ok := s.find(key)
+	if ok {
+		s.keys = slices.Delete(s.keys, i, i+1)
+		s.values = slices.Delete(s.values, i, i+1)
+	}
+	return ok
+}
+
+func (s *sliceStore) Len() int {
+	return len(s.keys)
+}
+
+func (s *sliceStore) Iterate(fn func(key, value string) bool) {
+	s.iterating = true
+	defer func() { s.iterating = false }()
+	for i := range s.keys {
+		if !fn(s.keys[i], s.values[i]) {
+			return
+		}
+	}
+}
+
+func (s *sliceStore) Clear() {
+	s.mustNotIterate()
+	s.keys, s.values = nil, nil
+}
+
+func (s *sliceStore) mustNotIterate() {
+	if s.iterating {
+		panic("sliceStore modified during Iterate")
+	}
+}
+
+func TestCommandsWorkAgainstAnotherStore(t *testing.T) {
+	store := &sliceStore{}
+	db := NewDatabaseWithStore(store)
+	t.Cleanup(db.Close)
+	db.dumpPath = t.TempDir() + "/dump.gob"
+
+	expect(t, db, "+OK\r\n", "MSET", "b", "2", "a", "1", "c", "3")
+	expect(t, db, "$1\r\n1\r\n", "GET", "a")
+	expect(t, db, ":3\r\n", "APPEND", "a", "00")
+	expect(t, db, ":101\r\n", "INCR", "a")
+	expect(t, db, "+OK\r\n", "RENAME", "b", "d")
+	expect(t, db, "+OK\r\n", "SET", "gone", "v", "PX", "1")
+	expect(t, db, ":1\r\n", "PEXPIREPATTERN", "c", "100000")
+	time.Sleep(5 * time.Millisecond)
+	expect(t, db, "$-1\r\n", "GET", "gone")
+	if got := replyStrings(t, parseReply(t, run(db, "KEYS", "*"))); !slices.Equal(got, []string{"a", "c", "d"}) {
+		t.Errorf("KEYS * = %q", got)
+	}
+	expect(t, db, ":3\r\n", "DBSIZE")
+	expect(t, db, "+OK\r\n", "SAVE")
+	if !slices.Equal(store.keys, []string{"a", "c", "d"}) {
+		t.Errorf("store holds %q, want a, c and d", store.keys)
+	}
+
+	expect(t, db, "+OK\r\n", "FLUSHALL")
+	expect(t, db, ":0\r\n", "DBSIZE")
+	if store.Len() != 0 {
+		t.Errorf("store holds %q after FLUSHALL", store.keys)
+	}
+	if err := db.LoadSnapshot(db.dumpPath); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, db, "$3\r\n101\r\n", "GET", "a")
+	expect(t, db, "$1\r\n2\r\n", "GET", "d")
+}
+
+func TestObjectIdletimeDoesNotTouchButGetDoes(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "k", "v")
+	db.mu.Lock()
+	db.accessed["k"] = time.Now().Add(-10 * time.Second)
+	db.mu.Unlock()
+
+	expect(t, db, ":10\r\n", "OBJECT", "IDLETIME", "k")
+	expect(t, db, ":10\r\n", "OBJECT", "IDLETIME", "k")
+	expect(t, db, "$1\r\nv\r\n", "GETEX", "k")
+	expect(t, db, ":10\r\n", "OBJECT", "IDLETIME", "k")
+	expect(t, db, "$1\r\nv\r\n", "GET", "k")
+	expect(t, db, ":0\r\n", "OBJECT", "IDLETIME", "k")
+}
+
+// incrScript increments KEYS[1] with a GET and a SET, which only adds up
+// if nothing runs between the two.
+const incrScript = `
+local n = tonumber(redis.call("GET", KEYS[1]) or "0")
+redis.call("SET", KEYS[1], n + ARGV[1])
+return n + ARGV[1]`
+
+func TestEvalGetThenSetIsAtomic(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	expect(t, db, ":5\r\n", "EVAL", incrScript, "1", "counter", "5")
+	expect(t, db, "$1\r\n5\r\n", "GET", "counter")
+
+	const clients, evals = 8, 50
+	var wg sync.WaitGroup
+	for i := 0; i < clients; i++ {
+		conn := dial(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < evals; j++ {
+				conn.send("EVAL", incrScript, "1", "counter", "1")
+				conn.send("SET", "other", strconv.Itoa(j))
+			}
+			for j := 0; j < 2*evals; j++ {
+				if reply, ok := conn.read().(respError); ok {
+					t.Errorf("reply %d: %s", j, reply)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	expect(t, db, fmt.Sprintf("$3\r\n%d\r\n", 5+clients*evals), "GET", "counter")
+}
+
+func TestEvalReplies(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "k", "v")
+	for _, tt := range []struct {
+		script string
+		want   string
+	}{
+		{`return "s"`, "$1\r\ns\r\n"},
+		{`return 3.9`, ":3\r\n"},
+		{`return true`, ":1\r\n"},
+		{`return false`, "$-1\r\n"},
+		{`return nil`, "$-1\r\n"},
+		{`return {1, "a", {2}, nil, 4}`, "*3\r\n:1\r\n$1\r\na\r\n*1\r\n:2\r\n"},
+		{`return redis.status_reply("FINE")`, "+FINE\r\n"},
+		{`return redis.error_reply("MY error")`, "-MY error\r\n"},
+		{`return redis.call("GET", KEYS[1])`, "$1\r\nv\r\n"},
+		{`return redis.call("GET", "missing")`, "$-1\r\n"},
+		{`return redis.call("SET", "k2", 1)`, "+OK\r\n"},
+		{`return {KEYS[1], ARGV[1], ARGV[2]}`, "*3\r\n$1\r\nk\r\n$1\r\na\r\n$1\r\nb\r\n"},
+	} {
+		expect(t, db, tt.want, "EVAL", tt.script, "1", "k", "a", "b")
+	}
+}
+
+func TestEvalErrors(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "z", "abc")
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"return 1", "x"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{"return 1", "-1"}, "-ERR Number of keys can't be negative\r\n"},
+		{[]string{"return 1", "2", "k"}, "-ERR Number of keys can't be greater than number of args\r\n"},
+		{[]string{`return redis.call("NOPE")`, "0"}, "-ERR Unknown Redis command called from script\r\n"},
+		{[]string{`return redis.call("GET")`, "0"}, "-ERR Wrong number of args calling Redis command from script\r\n"},
+		{[]string{`return redis.call("SUBSCRIBE", "c")`, "0"}, "-ERR This Redis command is not allowed from script\r\n"},
+		{[]string{`return redis.call("BZMPOP", "0", "1", "z", "MIN")`, "0"}, "-ERR This Redis command is not allowed from script\r\n"},
+		{[]string{`return redis.call("EVAL", "return 1", "0")`, "0"}, "-ERR This Redis command is not allowed from script\r\n"},
+		{[]string{`return redis.call("INCR", "z")`, "0"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{`return redis.pcall("INCR", "z")`, "0"}, "-ERR value is not an integer or out of range\r\n"},
+		{[]string{`local r = redis.pcall("NOPE"); return r.err`, "0"}, "$44\r\nERR Unknown Redis command called from script\r\n"},
+		{[]string{`return dofile("/etc/passwd")`, "0"}, ""},
+	} {
+		got := run(db, append([]string{"EVAL"}, tt.args...)...)
+		if tt.want == "" {
+			if !strings.HasPrefix(got, "-ERR Error running script: ") || strings.Count(got, "\n") != 1 {
+				t.Errorf("EVAL %q = %q, want a one-line runtime error", tt.args, got)
+			}
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("EVAL %q = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+	if got := run(db, "EVAL", "return (", "0"); !strings.HasPrefix(got, "-ERR Error compiling script: ") {
+		t.Errorf("EVAL of a syntax error = %q", got)
+	}
+	if got := run(db, "EVAL", `redis.call("SET", "a", "1"); redis.call("INCR", "z"); redis.call("SET", "b", "1")`, "0"); !strings.HasPrefix(got, "-ERR value") {
+		t.Errorf("EVAL stopping at an error = %q", got)
+	}
+	expect(t, db, ":1\r\n", "EXISTS", "a")
+	expect(t, db, ":0\r\n", "EXISTS", "b")
+}
+
+func TestScriptLoadAndEvalsha(t *testing.T) {
+	db := newTestDatabase(t)
+	sha := "e0e1f9fabfc9d4800c877a703b823ac0578ff8db"
+	expect(t, db, "*1\r\n:0\r\n", "SCRIPT", "EXISTS", sha)
+	expect(t, db, "-NOSCRIPT No matching script. Please use EVAL.\r\n", "EVALSHA", sha, "0")
+	expect(t, db, "$40\r\n"+sha+"\r\n", "SCRIPT", "LOAD", "return 1")
+	expect(t, db, ":1\r\n", "EVALSHA", sha, "0")
+	expect(t, db, ":1\r\n", "EVALSHA", strings.ToUpper(sha), "0")
+	expect(t, db, "+OK\r\n", "SCRIPT", "FLUSH")
+	expect(t, db, "*2\r\n:0\r\n:0\r\n", "SCRIPT", "EXISTS", sha, "ffff")
+
+	// EVAL caches what it runs.
+	run(db, "EVAL", incrScript, "1", "n", "2")
+	expect(t, db, ":4\r\n", "EVALSHA", scriptSHA(incrScript), "1", "n", "2")
+}
+
+func TestBusyScriptCanBeKilled(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	runner, other := dial(t, addr), dial(t, addr)
+	expect(t, db, "-NOTBUSY No scripts in execution right now.\r\n", "SCRIPT", "KILL")
+	expect(t, db, "+OK\r\n", "CONFIG", "SET", "busy-reply-threshold", "50")
+
+	runner.send("EVAL", "while true do end", "0")
+	waitFor(t, "the script to start", func() bool { return db.script.Load() != nil })
+	start := time.Now()
+	if got, ok := other.do("GET", "k").(respError); !ok || !strings.HasPrefix(string(got), "BUSY ") {
+		t.Fatalf("GET during the script = %v, want BUSY", got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("BUSY took %v", elapsed)
+	}
+	if got := other.do("SCRIPT", "KILL"); got != "OK" {
+		t.Fatalf("SCRIPT KILL = %v", got)
+	}
+	if got := runner.read(); got != respError("ERR Script killed by user with SCRIPT KILL...") {
+		t.Errorf("EVAL after SCRIPT KILL = %v", got)
+	}
+	if got := other.do("SET", "k", "v"); got != "OK" {
+		t.Errorf("SET after the script was killed = %v", got)
+	}
+
+	// A script that has written cannot be killed; SHUTDOWN NOSAVE stops
+	// it along with the server.
+	runner.send("EVAL", `redis.call("SET", "k", "written") while true do end`, "0")
+	waitFor(t, "the script to write", func() bool {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		value, _ := db.data.Get("k")
+		return value == "written"
+	})
+	if got, ok := other.do("SCRIPT", "KILL").(respError); !ok || !strings.HasPrefix(string(got), "UNKILLABLE ") {
+		t.Fatalf("SCRIPT KILL after a write = %v, want UNKILLABLE", got)
+	}
+	other.send("SHUTDOWN", "NOSAVE")
+	waitFor(t, "the script to stop", func() bool { return db.script.Load() == nil })
+}
+
+func TestEvalWritesAreLoggedToTheAOF(t *testing.T) {
+	path := t.TempDir() + "/appendonly.aof"
+	db := newTestDatabase(t)
+	if err := db.OpenAOF(path, FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	run(db, "EVAL", incrScript, "1", "n", "3")
+	run(db, "EVAL", incrScript, "1", "n", "4")
+	run(db, "SCRIPT", "FLUSH")
+	db.aof.close()
+
+	replayed := newTestDatabase(t)
+	if err := replayed.OpenAOF(path, FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(replayed.aof.close)
+	expect(t, replayed, "$1\r\n7\r\n", "GET", "n")
+}
+
+func TestRateLimitRejectsThenRecovers(t *testing.T) {
+	db := newTestDatabase(t)
+	conn := dial(t, startServer(t, db))
+	if reply := conn.do("CONFIG", "SET", "client-rate-limit", "5"); reply != "OK" {
+		t.Fatalf("CONFIG SET = %v", reply)
+	}
+	for i := 0; i < 8; i++ {
+		conn.send("DBSIZE")
+	}
+	allowed, limited := 0, 0
+	for i := 0; i < 8; i++ {
+		switch reply := conn.read(); reply {
+		case int64(0):
+			allowed++
+		case respError("ERR rate limit exceeded"):
+			limited++
+		default:
+			t.Fatalf("DBSIZE = %v", reply)
+		}
+	}
+	// The bucket starts full, after CONFIG SET took nothing from it.
+	if allowed != 5 || limited != 3 {
+		t.Fatalf("%d allowed and %d limited, want 5 and 3", allowed, limited)
+	}
+
+	time.Sleep(250 * time.Millisecond)
+	if reply := conn.do("DBSIZE"); reply != int64(0) {
+		t.Fatalf("DBSIZE after waiting = %v", reply)
+	}
+	other := dial(t, conn.conn.RemoteAddr().String())
+	if reply := other.do("DBSIZE"); reply != int64(0) {
+		t.Fatalf("another connection's DBSIZE = %v", reply)
+	}
+}
+
+func TestSetOptions(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, "+OK\r\n", "SET", "k", "v1", "NX")
+	expect(t, db, "$-1\r\n", "SET", "k", "v2", "NX")
+	expect(t, db, "$2\r\nv1\r\n", "GET", "k")
+	expect(t, db, "$-1\r\n", "SET", "missing", "v", "XX")
+	expect(t, db, ":0\r\n", "EXISTS", "missing")
+	expect(t, db, "+OK\r\n", "SET", "k", "v3", "XX")
+	expect(t, db, "-ERR syntax error\r\n", "SET", "k", "v", "NX", "XX")
+
+	expect(t, db, "+OK\r\n", "SET", "p", "v", "PX", "100")
+	expect(t, db, "$1\r\nv\r\n", "GET", "p")
+	time.Sleep(150 * time.Millisecond)
+	expect(t, db, "$-1\r\n", "GET", "p")
+	expect(t, db, ":-2\r\n", "PTTL", "p")
+}
+
+func TestStringWritesReplaceOtherTypes(t *testing.T) {
+	db := newTestDatabase(t)
+	writes := [][]string{
+		{"SET", "k", "s"},
+		{"MSET", "k", "s"},
+		{"GETSET", "k", "s"},
+	}
+	creates := [][]string{
+		{"ZADD", "k", "1", "m"},
+		{"HSET", "k", "f", "v"},
+		{"RPUSH", "k", "e"},
+		{"SADD", "k", "m"},
+	}
+	for _, write := range writes {
+		for _, create := range creates {
+			run(db, "DEL", "k")
+			run(db, create...)
+			run(db, write...)
+			expect(t, db, "+string\r\n", "TYPE", "k")
+			expect(t, db, "$1\r\ns\r\n", "GET", "k")
+			expect(t, db, ":1\r\n", "DBSIZE")
+			db.mu.RLock()
+			_, z := db.sortedSet["k"]
+			_, h := db.hashes["k"]
+			_, l := db.lists["k"]
+			_, s := db.sets["k"]
+			db.mu.RUnlock()
+			if z || h || l || s {
+				t.Errorf("%q after %q left the old value behind", write, create)
+			}
+		}
+	}
+}
+
+func TestWritesToAnotherTypeReplyWrongType(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "string", "v")
+	run(db, "ZADD", "zset", "1", "m")
+	run(db, "HSET", "hash", "f", "v")
+	run(db, "RPUSH", "list", "e")
+	run(db, "SADD", "set", "m")
+	for _, tt := range []struct {
+		args []string
+		ok   string
+	}{
+		{[]string{"HSET", "f", "v"}, "hash"},
+		{[]string{"LPUSH", "e"}, "list"},
+		{[]string{"RPUSH", "e"}, "list"},
+		{[]string{"SADD", "m"}, "set"},
+		{[]string{"ZADD", "1", "m"}, "zset"},
+		{[]string{"ZINCRBY", "1", "m"}, "zset"},
+		{[]string{"INCR"}, "string"},
+		{[]string{"DECR"}, "string"},
+		{[]string{"INCRBY", "2"}, "string"},
+		{[]string{"DECRBY", "2"}, "string"},
+		{[]string{"INCRBYFLOAT", "1.5"}, "string"},
+		{[]string{"INCREX", "1", "10"}, "string"},
+		{[]string{"APPEND", "s"}, "string"},
+		{[]string{"SETRANGE", "0", "s"}, "string"},
+		{[]string{"SETRANGE", "0", ""}, "string"},
+		{[]string{"BITFIELD", "SET", "u8", "0", "1"}, "string"},
+		{[]string{"BITFIELD", "GET", "u8", "0"}, "string"},
+	} {
+		for _, key := range []string{"string", "zset", "hash", "list", "set"} {
+			if key == tt.ok {
+				continue
+			}
+			args := append([]string{tt.args[0], key}, tt.args[1:]...)
+			expect(t, db, wrongTypeResponse, args...)
+			expect(t, db, "+"+key+"\r\n", "TYPE", key)
+		}
+	}
+	expect(t, db, ":5\r\n", "DBSIZE")
+	expect(t, db, "*2\r\n$1\r\nf\r\n$1\r\nv\r\n", "HGETALL", "hash")
+	expect(t, db, ":-1\r\n", "TTL", "hash")
+}
+
+// fuzzCommands are the command templates FuzzCommandSequences draws from.
+// "k" is replaced by a key and "v" by a value picked from the input.
+var fuzzCommands = [][]string{
+	{"SET", "k", "v"}, {"SET", "k", "v", "PX", "1"}, {"MSET", "k", "v", "k", "v"},
+	{"GETSET", "k", "v"}, {"APPEND", "k", "v"}, {"SETRANGE", "k", "2", "v"},
+	{"INCR", "k"}, {"INCRBYFLOAT", "k", "1.5"}, {"CAS", "k", "v", "v"},
+	{"GETEX", "k", "PERSIST"}, {"BITFIELD", "k", "SET", "u8", "0", "255"},
+	{"DEL", "k"}, {"UNLINK", "k"}, {"RENAME", "k", "k"}, {"RENAMENX", "k", "k"},
+	{"PEXPIRE", "k", "1"}, {"EXPIRE", "k", "100"}, {"PERSIST", "k"},
+	{"ZADD", "k", "1", "v"}, {"ZINCRBY", "k", "2", "v"}, {"ZREM", "k", "v"},
+	{"ZMPOP", "1", "k", "MIN"},
+	{"HSET", "k", "v", "v"}, {"HDEL", "k", "v"},
+	{"LPUSH", "k", "v"}, {"RPUSH", "k", "v"}, {"LPOP", "k"}, {"RPOP", "k"},
+	{"LMPOP", "2", "k", "k", "LEFT", "COUNT", "2"},
+	{"SADD", "k", "v"}, {"SREM", "k", "v"},
+	{"GET", "k"}, {"TYPE", "k"}, {"EXISTS", "k"}, {"TTL", "k"}, {"OBJECT", "ENCODING", "k"},
+	{"SCAN", "0"}, {"KEYS", "*"}, {"PEXPIREPATTERN", "k*", "1"},
+	{"FLUSHALL"},
+}
+
+// FuzzCommandSequences runs the commands an input encodes against one
+// database and checks the keyspace invariants after each. Each byte picks
+// a command, and the keys and values in it come from the bytes after.
+func FuzzCommandSequences(f *testing.F) {
+	rng := rand.New(rand.NewSource(1))
+	for i := 0; i < 20; i++ {
+		seed := make([]byte, 300)
+		rng.Read(seed)
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, input []byte) {
+		db := newTestDatabase(t)
+		// Bound the work one input can ask for.
+		const maxCommands = 200
+		next := func() byte {
+			if len(input) == 0 {
+				return 0
+			}
+			b := input[0]
+			input = input[1:]
+			return b
+		}
+		for n := 0; n < maxCommands && len(input) > 0; n++ {
+			template := fuzzCommands[int(next())%len(fuzzCommands)]
+			args := make([]string, len(template))
+			for i, arg := range template {
+				switch arg {
+				case "k":
+					args[i] = string(rune('a' + next()%4))
+				case "v":
+					args[i] = strconv.Itoa(int(next() % 3))
+				default:
+					args[i] = arg
+				}
+			}
+			run(db, args...)
+			if err := checkConsistency(db); err != nil {
+				t.Fatalf("after %q: %v", args, err)
+			}
+		}
+	})
+}
+
+// checkConsistency reports the first keyspace invariant db breaks: a key
+// stored in more than one type map, an empty collection, a sorted set
+// whose skiplist disagrees with its dict, or a TTL on a key that holds
+// nothing or that the TTL heap does not index.
+func checkConsistency(db *Database) error {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	stored := make(map[string][]string)
+	db.data.Iterate(func(key, _ string) bool {
+		stored[key] = append(stored[key], "string")
+		return true
+	})
+	for key, zs := range db.sortedSet {
+		stored[key] = append(stored[key], "zset")
+		if zs.len() == 0 {
+			return fmt.Errorf("sorted set %q is empty", key)
+		}
+		if zs.zsl.length != zs.len() {
+			return fmt.Errorf("sorted set %q: skiplist holds %d members, dict %d", key, zs.zsl.length, zs.len())
+		}
+		var prev *skiplistNode
+		for node := zs.zsl.header.level[0].forward; node != nil; node = node.level[0].forward {
+			if score, ok := zs.dict[node.member]; !ok || score != node.score {
+				return fmt.Errorf("sorted set %q: skiplist has %q at %v, dict %v", key, node.member, node.score, score)
+			}
+			if prev != nil && (prev.score > node.score || prev.score == node.score && prev.member >= node.member) {
+				return fmt.Errorf("sorted set %q: %q sorts after %q", key, prev.member, node.member)
+			}
+			prev = node
+		}
+	}
+	for key, hash := range db.hashes {
+		stored[key] = append(stored[key], "hash")
+		if len(hash) == 0 {
+			return fmt.Errorf("hash %q is empty", key)
+		}
+	}
+	for key, list := range db.lists {
+		stored[key] = append(stored[key], "list")
+		if len(list) == 0 {
+			return fmt.Errorf("list %q is empty", key)
+		}
+	}
+	for key, set := range db.sets {
+		stored[key] = append(stored[key], "set")
+		if len(set) == 0 {
+			return fmt.Errorf("set %q is empty", key)
+		}
+	}
+	for key, types := range stored {
+		if len(types) > 1 {
+			return fmt.Errorf("key %q is stored as %v", key, types)
+		}
+	}
+	for key := range db.expiry {
+		if _, ok := stored[key]; !ok {
+			return fmt.Errorf("key %q has a TTL but no value", key)
+		}
+		if _, ok := db.ttlEntries[key]; !ok {
+			return fmt.Errorf("key %q has a TTL the heap does not index", key)
+		}
+	}
+	if len(db.ttlEntries) != len(db.expiry) || len(db.ttlHeap) != len(db.expiry) {
+		return fmt.Errorf("%d TTLs but %d heap entries", len(db.expiry), len(db.ttlHeap))
+	}
+	return nil
+}
+
+func TestConcurrentCommandsAreRaceFree(t *testing.T) {
+	db := newTestDatabase(t)
+	var wg sync.WaitGroup
+	for g := 0; g < 200; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 20; i++ {
+				key := strconv.Itoa((g + i) % 10)
+				switch i % 6 {
+				case 0:
+					run(db, "SET", key, "v")
+				case 1:
+					run(db, "GET", key)
+				case 2:
+					run(db, "EXPIRE", key, "100")
+				case 3:
+					run(db, "TTL", key)
+				case 4:
+					run(db, "KEYS", "*")
+				case 5:
+					run(db, "DEL", key)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := checkConsistency(db); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCas(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, ":0\r\n", "CAS", "k", "old", "new")
+	expect(t, db, ":0\r\n", "EXISTS", "k")
+	expect(t, db, ":1\r\n", "CAS", "k", casAbsent, "v1")
+	expect(t, db, ":0\r\n", "CAS", "k", casAbsent, "v2")
+	expect(t, db, ":0\r\n", "CAS", "k", "wrong", "v2")
+	expect(t, db, "$2\r\nv1\r\n", "GET", "k")
+	run(db, "EXPIRE", "k", "100")
+	expect(t, db, ":1\r\n", "CAS", "k", "v1", "v2")
+	expect(t, db, "$2\r\nv2\r\n", "GET", "k")
+	expect(t, db, ":-1\r\n", "TTL", "k")
+
+	run(db, "HSET", "h", "f", "v")
+	expect(t, db, ":0\r\n", "CAS", "h", casAbsent, "v")
+	expect(t, db, "+hash\r\n", "TYPE", "h")
+
+	// Concurrent read-CAS loops lose no increments.
+	run(db, "SET", "n", "0")
+	var wg sync.WaitGroup
+	for g := 0; g < 8; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; {
+				current := parseReply(t, run(db, "GET", "n")).(string)
+				n, _ := strconv.Atoi(current)
+				if run(db, "CAS", "n", current, strconv.Itoa(n+1)) == ":1\r\n" {
+					i++
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	expect(t, db, "$3\r\n400\r\n", "GET", "n")
+}
+
+func TestSweeperRemovesExpiredKeysUntilClosed(t *testing.T) {
+	db := newTestDatabase(t)
+	stored := func() int {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return db.data.Len() + len(db.sortedSet) + len(db.expiry)
+	}
+	run(db, "SET", "a", "v", "PX", "20")
+	run(db, "ZADD", "z", "1", "m")
+	run(db, "PEXPIRE", "z", "20")
+	run(db, "SET", "kept", "v")
+	// Nothing reads the keys, so only the sweeper can remove them.
+	waitFor(t, "the sweeper to remove expired keys", func() bool { return stored() == 1 })
+
+	db.Close()
+	run(db, "SET", "b", "v", "PX", "1")
+	time.Sleep(3 * sweepInterval)
+	if n := stored(); n != 3 {
+		t.Fatalf("%d entries after Close, want the expired key kept", n)
+	}
+	expect(t, db, "$-1\r\n", "GET", "b")
+}
+
+func TestInjectedClockDrivesExpiry(t *testing.T) {
+	db := newTestDatabase(t)
+	db.Close() // the sweeper runs on real time
+	now := time.Unix(1700000000, 0)
+	db.SetClock(func() time.Time { return now })
+	run(db, "SET", "k", "v", "EX", "10")
+	run(db, "SET", "idle", "v")
+
+	now = now.Add(9 * time.Second)
+	expect(t, db, ":1\r\n", "TTL", "k")
+	expect(t, db, ":9\r\n", "OBJECT", "IDLETIME", "idle")
+	now = now.Add(time.Second + time.Millisecond)
+	expect(t, db, "$-1\r\n", "GET", "k")
+	expect(t, db, ":1\r\n", "DBSIZE")
+}
+
+func TestExpiredKeysAreInvisibleToReads(t *testing.T) {
+	db := newTestDatabase(t)
+	db.Close() // leave expired keys to the lazy path
+	creates := map[string][]string{
+		"string": {"SET", "k", "10"},
+		"zset":   {"ZADD", "k", "1", "m"},
+		"hash":   {"HSET", "k", "f", "v"},
+		"list":   {"RPUSH", "k", "e"},
+		"set":    {"SADD", "k", "m"},
+	}
+	reads := []struct {
+		kind string
+		args []string
+		want string
+	}{
+		{"", []string{"EXISTS", "k"}, ":0\r\n"},
+		{"", []string{"TYPE", "k"}, "+none\r\n"},
+		{"", []string{"TTL", "k"}, ":-2\r\n"},
+		{"", []string{"PTTL", "k"}, ":-2\r\n"},
+		{"", []string{"KEYS", "*"}, "*0\r\n"},
+		{"", []string{"SCAN", "0"}, "*2\r\n$1\r\n0\r\n*0\r\n"},
+		{"", []string{"DBSIZE"}, ":0\r\n"},
+		{"", []string{"OBJECT", "ENCODING", "k"}, "$-1\r\n"},
+		{"string", []string{"GET", "k"}, "$-1\r\n"},
+		{"string", []string{"MGET", "k"}, "*1\r\n$-1\r\n"},
+		{"string", []string{"STRLEN", "k"}, ":0\r\n"},
+		{"string", []string{"GETRANGE", "k", "0", "-1"}, "$0\r\n\r\n"},
+		{"zset", []string{"ZSCORE", "k", "m"}, "$-1\r\n"},
+		{"zset", []string{"ZCARD", "k"}, ":0\r\n"},
+		{"zset", []string{"ZRANGE", "k", "0", "-1"}, "*0\r\n"},
+		{"zset", []string{"ZRANK", "k", "m"}, "$-1\r\n"},
+		{"hash", []string{"HGET", "k", "f"}, "$-1\r\n"},
+		{"hash", []string{"HGETALL", "k"}, "*0\r\n"},
+		{"hash", []string{"HLEN", "k"}, ":0\r\n"},
+		{"hash", []string{"HEXISTS", "k", "f"}, ":0\r\n"},
+		{"list", []string{"LLEN", "k"}, ":0\r\n"},
+		{"list", []string{"LRANGE", "k", "0", "-1"}, "*0\r\n"},
+		{"list", []string{"LINDEX", "k", "0"}, "$-1\r\n"},
+		{"set", []string{"SMEMBERS", "k"}, "*0\r\n"},
+		{"set", []string{"SCARD", "k"}, ":0\r\n"},
+		{"set", []string{"SISMEMBER", "k", "m"}, ":0\r\n"},
+	}
+	for _, read := range reads {
+		for kind, create := range creates {
+			if read.kind != "" && read.kind != kind {
+				continue
+			}
+			run(db, create...)
+			db.mu.Lock()
+			db.setExpiry("k", time.Now().Add(-time.Millisecond))
+			db.mu.Unlock()
+			if got := run(db, read.args...); got != read.want {
+				t.Errorf("%q on an expired %s = %q, want %q", read.args, kind, got, read.want)
+			}
+			db.mu.RLock()
+			gone := db.typeOf("k") == "none"
+			db.mu.RUnlock()
+			if !gone && read.args[0] != "KEYS" && read.args[0] != "SCAN" && read.args[0] != "DBSIZE" {
+				t.Errorf("%q left the expired %s in place", read.args, kind)
+			}
+			run(db, "DEL", "k")
+		}
+	}
+}
+
+func TestGetRoundTripsValuesOverTheNetwork(t *testing.T) {
+	conn := dial(t, startServer(t, newTestDatabase(t)))
+	for _, value := range []string{"", "plain", "with spaces", "line\r\nbreak", "$3\r\nfoo\r\n", "\x00binary\xff"} {
+		if reply := conn.do("SET", "k", value); reply != "OK" {
+			t.Fatalf("SET %q = %v", value, reply)
+		}
+		if reply := conn.do("GET", "k"); reply != value {
+			t.Errorf("GET = %q, want %q", reply, value)
+		}
+	}
+	if reply := conn.do("GET", "missing"); reply != nil {
+		t.Errorf("GET missing = %q, want nil", reply)
+	}
+
+	// Inline commands quote the same values.
+	if _, err := io.WriteString(conn.conn, "SET k \"with spaces\\r\\nand a break\"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if reply := conn.read(); reply != "OK" {
+		t.Fatalf("inline SET = %v", reply)
+	}
+	if reply := conn.do("GET", "k"); reply != "with spaces\r\nand a break" {
+		t.Errorf("GET after inline SET = %q", reply)
+	}
+}
+
+func TestIncrAndDecr(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, ":1\r\n", "INCR", "n")
+	expect(t, db, ":2\r\n", "INCR", "n")
+	expect(t, db, ":1\r\n", "DECR", "n")
+	expect(t, db, ":-1\r\n", "DECR", "missing")
+	expect(t, db, "$1\r\n1\r\n", "GET", "n")
+	run(db, "EXPIRE", "n", "100")
+	run(db, "INCR", "n")
+	if ttl := run(db, "TTL", "n"); ttl == ":-1\r\n" {
+		t.Error("INCR dropped the TTL")
+	}
+
+	for _, value := range []string{"abc", "1.5", " 1", "", "9223372036854775808"} {
+		run(db, "SET", "bad", value)
+		expect(t, db, "-ERR value is not an integer or out of range\r\n", "INCR", "bad")
+		expect(t, db, bulkString(value), "GET", "bad")
+	}
+	run(db, "SET", "max", strconv.FormatInt(math.MaxInt64, 10))
+	expect(t, db, "-ERR value is not an integer or out of range\r\n", "INCR", "max")
+	run(db, "SET", "min", strconv.FormatInt(math.MinInt64, 10))
+	expect(t, db, "-ERR value is not an integer or out of range\r\n", "DECR", "min")
+
+	var wg sync.WaitGroup
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				run(db, "INCR", "c")
+			}
+		}()
+	}
+	wg.Wait()
+	expect(t, db, "$4\r\n1000\r\n", "GET", "c")
+}
+
+func TestIncrbyAndDecrby(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, ":5\r\n", "INCRBY", "n", "5")
+	expect(t, db, ":-3\r\n", "INCRBY", "n", "-8")
+	expect(t, db, ":7\r\n", "DECRBY", "n", "-10")
+	expect(t, db, ":-10\r\n", "DECRBY", "missing", "10")
+	for _, delta := range []string{"x", "1.0", "9223372036854775808", ""} {
+		expect(t, db, "-ERR value is not an integer or out of range\r\n", "INCRBY", "n", delta)
+		expect(t, db, "-ERR value is not an integer or out of range\r\n", "DECRBY", "n", delta)
+	}
+	expect(t, db, "$1\r\n7\r\n", "GET", "n")
+
+	run(db, "SET", "s", "seven")
+	expect(t, db, "-ERR value is not an integer or out of range\r\n", "INCRBY", "s", "1")
+	run(db, "SET", "big", strconv.FormatInt(math.MaxInt64-1, 10))
+	expect(t, db, "-ERR value is not an integer or out of range\r\n", "INCRBY", "big", "2")
+	expect(t, db, ":9223372036854775807\r\n", "INCRBY", "big", "1")
+	run(db, "SET", "small", strconv.FormatInt(math.MinInt64+1, 10))
+	expect(t, db, "-ERR value is not an integer or out of range\r\n", "DECRBY", "small", "2")
+	expect(t, db, "-ERR value is not an integer or out of range\r\n", "INCRBY", "small", "-2")
+	// Negating MinInt64 would itself overflow.
+	expect(t, db, "-ERR decrement would overflow\r\n", "DECRBY", "n", "-9223372036854775808")
+}
+
+func TestEmptyMultibulkIsIgnoredAndBlankCommandRejected(t *testing.T) {
+	conn := dial(t, startServer(t, newTestDatabase(t)))
+	if _, err := io.WriteString(conn.conn, "*0\r\n*-1\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if reply := conn.do("DBSIZE"); reply != int64(0) {
+		t.Fatalf("first reply after empty multibulks = %v, want DBSIZE's", reply)
+	}
+	reply, ok := conn.do("").(respError)
+	if !ok || !strings.HasPrefix(string(reply), "ERR Unknown command ''") {
+		t.Fatalf("blank command name = %v, want an unknown command error", reply)
+	}
+	if reply := conn.do("DBSIZE"); reply != int64(0) {
+		t.Fatalf("DBSIZE after a blank command = %v", reply)
+	}
+}
+
+func TestExistsCountsPresentKeys(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "a", "1")
+	run(db, "HSET", "h", "f", "v")
+	run(db, "SET", "gone", "v")
+	db.mu.Lock()
+	db.setExpiry("gone", time.Now().Add(-time.Millisecond))
+	db.mu.Unlock()
+
+	expect(t, db, ":0\r\n", "EXISTS", "missing")
+	expect(t, db, ":1\r\n", "EXISTS", "a")
+	expect(t, db, ":2\r\n", "EXISTS", "a", "a")
+	expect(t, db, ":3\r\n", "EXISTS", "a", "missing", "h", "gone", "a")
+	db.mu.RLock()
+	_, stored := db.data.Get("gone")
+	db.mu.RUnlock()
+	if stored {
+		t.Error("EXISTS left the expired key in place")
+	}
+}
+
+// BenchmarkSweep compares one sweeper pass over 1M keys, 10 of them with
+// TTLs, against scanning every key for expired ones as the sweeper did
+// before the TTL heap.
+func BenchmarkSweep(b *testing.B) {
+	db := newTestDatabase(b)
+	db.mu.Lock()
+	for i := 0; i < 1_000_000; i++ {
+		db.data.Set(strconv.Itoa(i), "v")
+	}
+	for i := 0; i < 10; i++ {
+		db.setExpiry(strconv.Itoa(i), time.Now().Add(time.Hour))
+	}
+	db.mu.Unlock()
+
+	b.Run("heap", func(b *testing.B) {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		for i := 0; i < b.N; i++ {
+			db.sweepExpired()
+		}
+	})
+	b.Run("scan", func(b *testing.B) {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		for i := 0; i < b.N; i++ {
+			db.data.Iterate(func(key, _ string) bool {
+				db.isExpired(key)
+				return true
+			})
+		}
+	})
+}
+
+func TestPersistKeepsKeyPastItsDeadline(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, "+OK\r\n", "SET", "k", "v", "EX", "1")
+	expect(t, db, "+OK\r\n", "SET", "other", "v", "EX", "1")
+	expect(t, db, ":1\r\n", "PERSIST", "k")
+	expect(t, db, ":-1\r\n", "TTL", "k")
+	expect(t, db, ":0\r\n", "PERSIST", "k")
+	expect(t, db, ":0\r\n", "PERSIST", "missing")
+
+	// Past the old deadline and at least one sweep.
+	time.Sleep(time.Second + 2*sweepInterval)
+	db.mu.RLock()
+	_, stored := db.data.Get("other")
+	db.mu.RUnlock()
+	if stored {
+		t.Fatal("the sweeper has not run past the deadline")
+	}
+	expect(t, db, "$1\r\nv\r\n", "GET", "k")
+	expect(t, db, ":-1\r\n", "TTL", "k")
+}
+
+func TestRepliesAndPushesDoNotInterleave(t *testing.T) {
+	addr := startServer(t, newTestDatabase(t))
+	sub, pub := dial(t, addr), dial(t, addr)
+	sub.do("SUBSCRIBE", "ch")
+
+	const messages, subscribes = 300, 100
+	payload := func(i int) string { return strings.Repeat(strconv.Itoa(i%10), 4096+i) }
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < messages; i++ {
+			pub.send("PUBLISH", "ch", payload(i))
+		}
+		for i := 0; i < messages; i++ {
+			pub.read()
+		}
+	}()
+	go func() {
+		for i := 0; i < subscribes; i++ {
+			sub.send("SUBSCRIBE", fmt.Sprintf("c%d", i))
+		}
+	}()
+
+	received, subscribed := 0, 0
+	for received+subscribed < messages+subscribes {
+		frame, ok := sub.read().([]any)
+		if !ok || len(frame) != 3 {
+			t.Fatalf("malformed frame %v", frame)
+		}
+		switch frame[0] {
+		case "message":
+			if frame[1] != "ch" || frame[2] != payload(received) {
+				t.Fatalf("message %d garbled", received)
+			}
+			received++
+		case "subscribe":
+			subscribed++
+			if frame[2] != int64(subscribed+1) {
+				t.Fatalf("subscribe reply %v, want count %d", frame, subscribed+1)
+			}
+		default:
+			t.Fatalf("unexpected frame %v", frame)
+		}
+	}
+	<-done
+}
+
+func TestMemoryStatsFields(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "s", strings.Repeat("x", 1000))
+	run(db, "ZADD", "z", "1", "m")
+	run(db, "SADD", "set", "m")
+	run(db, "SET", "gone", "v")
+	db.mu.Lock()
+	db.setExpiry("gone", time.Now().Add(-time.Millisecond))
+	db.mu.Unlock()
+
+	reply := parseReply(t, run(db, "MEMORY", "STATS")).([]any)
+	stats := make(map[string]any)
+	for i := 0; i+1 < len(reply); i += 2 {
+		stats[reply[i].(string)] = reply[i+1]
+	}
+	for _, field := range []string{"peak.allocated", "total.allocated", "overhead.total", "keys.count", "dataset.bytes", "fragmentation"} {
+		if _, ok := stats[field]; !ok {
+			t.Errorf("MEMORY STATS has no %s", field)
+		}
+	}
+	dbsize := parseReply(t, run(db, "DBSIZE"))
+	if stats["keys.count"] != dbsize || dbsize != int64(3) {
+		t.Errorf("keys.count = %v, DBSIZE = %v, want 3", stats["keys.count"], dbsize)
+	}
+	if bytes, _ := stats["dataset.bytes"].(int64); bytes < 1000 {
+		t.Errorf("dataset.bytes = %v, want at least the 1000-byte string", stats["dataset.bytes"])
+	}
+}
+
+func TestPexpireAndPttl(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, ":-2\r\n", "PTTL", "k")
+	expect(t, db, ":-2\r\n", "TTL", "k")
+	run(db, "SET", "k", "v")
+	expect(t, db, ":-1\r\n", "PTTL", "k")
+	expect(t, db, ":-1\r\n", "TTL", "k")
+	expect(t, db, ":0\r\n", "PEXPIRE", "missing", "500")
+
+	start := time.Now()
+	expect(t, db, ":1\r\n", "PEXPIRE", "k", "500")
+	pttl := parseReply(t, run(db, "PTTL", "k")).(int64)
+	if pttl <= 400 || pttl > 500 {
+		t.Errorf("PTTL = %d, want just under 500", pttl)
+	}
+	time.Sleep(400*time.Millisecond - time.Since(start))
+	expect(t, db, "$1\r\nv\r\n", "GET", "k")
+	time.Sleep(600*time.Millisecond - time.Since(start))
+	expect(t, db, "$-1\r\n", "GET", "k")
+	expect(t, db, ":-2\r\n", "PTTL", "k")
+}
+
+func TestEveryCommandChecksItsArity(t *testing.T) {
+	db := newTestDatabase(t)
+	for name, spec := range commandTable {
+		want := fmt.Sprintf("-ERR wrong number of arguments for '%s' command\r\n", strings.ToUpper(name))
+		n := spec.arity
+		if n < 0 {
+			n = -n
+		}
+		args := []string{name}
+		for i := 1; i < n+1; i++ {
+			args = append(args, "x")
+		}
+		if n > 1 {
+			expect(t, db, want, args[:n-1]...)
+		}
+		if spec.arity > 0 {
+			expect(t, db, want, args...)
+		}
+	}
+}
+
+func TestExpireOnMissingKeyLeavesNoTTL(t *testing.T) {
+	db := newTestDatabase(t)
+	for _, args := range [][]string{
+		{"EXPIRE", "missing", "100"},
+		{"PEXPIRE", "missing", "100"},
+		{"PEXPIREAT", "missing", strconv.FormatInt(time.Now().Add(time.Hour).UnixMilli(), 10)},
+	} {
+		expect(t, db, ":0\r\n", args...)
+	}
+	db.mu.RLock()
+	n := len(db.expiry)
+	db.mu.RUnlock()
+	if n != 0 {
+		t.Fatalf("db.expiry holds %d entries, want none", n)
+	}
+	run(db, "SET", "k", "v")
+	expect(t, db, ":1\r\n", "EXPIRE", "k", "100")
+	if ttl := parseReply(t, run(db, "TTL", "k")).(int64); ttl < 99 || ttl > 100 {
+		t.Errorf("TTL = %d, want about 100", ttl)
+	}
+}
+
+func TestZrangeOrdersByScoreThenMember(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "ZADD", "z", "3", "c", "1", "z", "2", "b", "1", "a", "-1", "neg", "2", "a2")
+	want := []string{"neg", "a", "z", "a2", "b", "c"}
+	for i := 0; i < 5; i++ {
+		if got := replyStrings(t, parseReply(t, run(db, "ZRANGE", "z", "0", "-1"))); !slices.Equal(got, want) {
+			t.Fatalf("ZRANGE z 0 -1 = %q, want %q", got, want)
+		}
+	}
+	for _, tt := range []struct {
+		start, stop string
+		want        []string
+	}{
+		{"1", "2", want[1:3]},
+		{"-2", "-1", want[4:]},
+		{"-100", "1", want[:2]},
+		{"4", "100", want[4:]},
+		{"3", "1", nil},
+		{"10", "20", nil},
+	} {
+		if got := replyStrings(t, parseReply(t, run(db, "ZRANGE", "z", tt.start, tt.stop))); !slices.Equal(got, tt.want) {
+			t.Errorf("ZRANGE z %s %s = %q, want %q", tt.start, tt.stop, got, tt.want)
+		}
+	}
+}
+
+// subLag returns the sub-lag CLIENT LIST, sent on conn, reports for
+// client id.
+func subLag(t *testing.T, conn *testConn, id int64) int {
+	t.Helper()
+	reply := conn.do("CLIENT", "LIST")
+	list, ok := reply.(string)
+	if !ok {
+		t.Fatalf("CLIENT LIST = %v", reply)
+	}
+	for _, line := range strings.Split(list, "\n") {
+		if !strings.HasPrefix(line, fmt.Sprintf("id=%d ", id)) {
+			continue
+		}
+		for _, field := range strings.Fields(line) {
+			if value, ok := strings.CutPrefix(field, "sub-lag="); ok {
+				lag, _ := strconv.Atoi(value)
+				return lag
+			}
+		}
+	}
+	t.Fatalf("CLIENT LIST has no sub-lag for client %d", id)
+	return 0
+}
+
+func TestClientListReportsSubscriberLag(t *testing.T) {
+	addr := startServer(t, newTestDatabase(t))
+	healthy, stalled, pub := dial(t, addr), dial(t, addr), dial(t, addr)
+	healthyID, stalledID := healthy.do("CLIENT", "ID").(int64), stalled.do("CLIENT", "ID").(int64)
+	healthy.do("SUBSCRIBE", "ch")
+	stalled.do("SUBSCRIBE", "ch")
+
+	// The stalled subscriber never reads, so once its socket buffers fill
+	// the messages queue up behind them.
+	message := strings.Repeat("m", 64<<10)
+	publish := func(n int) {
+		for i := 0; i < n; i++ {
+			pub.do("PUBLISH", "ch", message)
+			if healthy.read().([]any)[2] != message {
+				t.Fatal("healthy subscriber got a garbled message")
+			}
+		}
+	}
+	publish(150)
+	var first int
+	waitFor(t, "the stalled subscriber to lag", func() bool {
+		first = subLag(t, pub, stalledID)
+		return first > 0
+	})
+	publish(100)
+	if lag := subLag(t, pub, stalledID); lag < first+100 {
+		t.Errorf("sub-lag went from %d to %d after 100 more messages", first, lag)
+	}
+	if lag := subLag(t, pub, healthyID); lag != 0 {
+		t.Errorf("healthy subscriber's sub-lag = %d, want 0", lag)
+	}
+}
+
+func TestPubsubIntrospection(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	a, b := dial(t, addr), dial(t, addr)
+	a.do("SUBSCRIBE", "news.tech")
+	a.do("SUBSCRIBE", "news.art")
+	b.do("SUBSCRIBE", "news.tech")
+	b.do("PSUBSCRIBE", "news.*")
+	a.do("PSUBSCRIBE", "news.*")
+	a.do("PSUBSCRIBE", "sport.*")
+
+	expect(t, db, "*2\r\n$8\r\nnews.art\r\n$9\r\nnews.tech\r\n", "PUBSUB", "CHANNELS")
+	expect(t, db, "*1\r\n$9\r\nnews.tech\r\n", "PUBSUB", "CHANNELS", "*tech")
+	expect(t, db, "*4\r\n$9\r\nnews.tech\r\n:2\r\n$7\r\nmissing\r\n:0\r\n", "PUBSUB", "NUMSUB", "news.tech", "missing")
+	expect(t, db, "*0\r\n", "PUBSUB", "NUMSUB")
+	expect(t, db, ":2\r\n", "PUBSUB", "NUMPAT")
+	// There is no sharded pub/sub, so nothing is ever listed.
+	expect(t, db, "*0\r\n", "PUBSUB", "SHARDCHANNELS")
+	expect(t, db, "*2\r\n$9\r\nnews.tech\r\n:0\r\n", "PUBSUB", "SHARDNUMSUB", "news.tech")
+	expect(t, db, "-ERR unknown subcommand or wrong number of arguments for 'NUMPAT'. Try PUBSUB HELP.\r\n", "PUBSUB", "NUMPAT", "x")
+
+	a.do("UNSUBSCRIBE", "news.art")
+	expect(t, db, "*1\r\n$9\r\nnews.tech\r\n", "PUBSUB", "CHANNELS")
+}
+
+func TestZscoreZremZcard(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, ":3\r\n", "ZADD", "z", "1", "a", "2.5", "b", "3", "c")
+	expect(t, db, "$3\r\n2.5\r\n", "ZSCORE", "z", "b")
+	expect(t, db, ":1\r\n", "ZREM", "z", "b", "missing")
+	expect(t, db, ":2\r\n", "ZCARD", "z")
+	expect(t, db, "$-1\r\n", "ZSCORE", "z", "b")
+	expect(t, db, "$-1\r\n", "ZSCORE", "nokey", "a")
+	expect(t, db, ":0\r\n", "ZCARD", "nokey")
+	expect(t, db, ":0\r\n", "ZREM", "nokey", "a")
+	expect(t, db, ":2\r\n", "ZREM", "z", "a", "c")
+	expect(t, db, ":0\r\n", "EXISTS", "z")
+}
+
+func TestFloatIncrementsFormatLosslessly(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "HSET", "h", "f", "3.0")
+	run(db, "SET", "s", "3.0")
+	increments := []struct {
+		name string
+		args func(delta string) []string
+	}{
+		{"INCRBYFLOAT", func(delta string) []string { return []string{"INCRBYFLOAT", "k", delta} }},
+		{"HINCRBYFLOAT", func(delta string) []string { return []string{"HINCRBYFLOAT", "h", "g", delta} }},
+		{"ZINCRBY", func(delta string) []string { return []string{"ZINCRBY", "z", delta, "m"} }},
+		{"ZADD INCR", func(delta string) []string { return []string{"ZADD", "zz", "INCR", delta, "m"} }},
+	}
+	for _, inc := range increments {
+		sum := 0.0
+		for i := 0; i < 3; i++ {
+			sum += 0.1
+			expect(t, db, bulkString(strconv.FormatFloat(sum, 'f', -1, 64)), inc.args("0.1")...)
+		}
+		// 0.1 three times is 0.30000000000000004 in float64.
+		expect(t, db, "$3\r\n0.4\r\n", inc.args("0.09999999999999998")...)
+		expect(t, db, "$1\r\n1\r\n", inc.args("0.6")...)
+		expect(t, db, "$18\r\n1.0000000000000002\r\n", inc.args("2.220446049250313e-16")...)
+		expect(t, db, "$3\r\n1.5\r\n", inc.args("0.4999999999999998")...)
+		expect(t, db, "$21\r\n100000000000000000000\r\n", inc.args("1e20")...)
+		if t.Failed() {
+			t.Fatalf("%s formatted its results wrongly", inc.name)
+		}
+	}
+	expect(t, db, "$1\r\n3\r\n", "INCRBYFLOAT", "s", "0")
+	expect(t, db, "$1\r\n4\r\n", "HINCRBYFLOAT", "h", "f", "1.000")
+	expect(t, db, "$18\r\n1.0000000000000002\r\n", "INCRBYFLOAT", "new", "1.0000000000000002")
+
+	for _, args := range [][]string{
+		{"INCRBYFLOAT", "k", "inf"},
+		{"INCRBYFLOAT", "big", "1.7e308"},
+		{"HINCRBYFLOAT", "h", "f", "-inf"},
+		{"HINCRBYFLOAT", "h", "big", "-1.7e308"},
+	} {
+		run(db, args...)
+		expect(t, db, "-ERR increment would produce NaN or Infinity\r\n", args...)
+	}
+	expect(t, db, "$1\r\n4\r\n", "HGET", "h", "f")
+	expect(t, db, "-ERR value is not a valid float\r\n", "HINCRBYFLOAT", "h", "f", "x")
+	run(db, "HSET", "h", "text", "abc")
+	expect(t, db, "-ERR hash value is not a float\r\n", "HINCRBYFLOAT", "h", "text", "1")
+	expect(t, db, wrongTypeResponse, "HINCRBYFLOAT", "s", "f", "1")
+
+	// A score may be infinite, but not NaN.
+	expect(t, db, "$3\r\ninf\r\n", "ZINCRBY", "inf", "inf", "m")
+	expect(t, db, "-ERR resulting score is not a number (NaN)\r\n", "ZINCRBY", "inf", "-inf", "m")
+}
+
+func TestZrankBreaksTiesLikeZrange(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "ZADD", "z", "1", "b", "1", "a", "0", "z", "1", "c", "2", "a0")
+	order := replyStrings(t, parseReply(t, run(db, "ZRANGE", "z", "0", "-1")))
+	if want := []string{"z", "a", "b", "c", "a0"}; !slices.Equal(order, want) {
+		t.Fatalf("ZRANGE z 0 -1 = %q, want %q", order, want)
+	}
+	for rank, member := range order {
+		expect(t, db, fmt.Sprintf(":%d\r\n", rank), "ZRANK", "z", member)
+		expect(t, db, fmt.Sprintf(":%d\r\n", len(order)-1-rank), "ZREVRANK", "z", member)
+	}
+	expect(t, db, "$-1\r\n", "ZRANK", "z", "missing")
+	expect(t, db, "$-1\r\n", "ZREVRANK", "nokey", "a")
+}
+
+func TestZincrby(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, "$3\r\n2.5\r\n", "ZINCRBY", "z", "2.5", "a")
+	expect(t, db, ":1\r\n", "ZCARD", "z")
+	expect(t, db, "$1\r\n5\r\n", "ZINCRBY", "z", "2.5", "a")
+	expect(t, db, "$2\r\n-1\r\n", "ZINCRBY", "z", "-6", "a")
+	expect(t, db, "$1\r\n1\r\n", "ZINCRBY", "z", "1", "b")
+	expect(t, db, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", "ZRANGE", "z", "0", "-1")
+	expect(t, db, "$2\r\n-1\r\n", "ZSCORE", "z", "a")
+	expect(t, db, "-ERR invalid score\r\n", "ZINCRBY", "z", "x", "a")
+
+	reply := parseReply(t, run(db, "COMMAND", "DOCS", "ZINCRBY")).([]any)
+	docs := fmt.Sprint(reply)
+	if !strings.Contains(docs, "increment type double") {
+		t.Errorf("COMMAND DOCS ZINCRBY = %v, want a double increment", docs)
+	}
+}
+
+// gatedStore is a mapStore whose Set waits until gate is closed, to stand
+// in for a slow load.
+type gatedStore struct {
+	*mapStore
+	gate chan struct{}
+}
+
+func (s gatedStore) Set(key, value string) {
+	<-s.gate
+	s.mapStore.Set(key, value)
+}
+
+func TestHealthIsUnavailableUntilLoadedAndListening(t *testing.T) {
+	store := gatedStore{newMapStore(), make(chan struct{})}
+	db := NewDatabaseWithStore(store)
+	t.Cleanup(db.Close)
+	path := t.TempDir() + "/appendonly.aof"
+	var aof strings.Builder
+	appendMultiBulk(&aof, []string{"SET", "k", "v"})
+	if err := os.WriteFile(path, []byte(aof.String()), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	health := httptest.NewServer(http.HandlerFunc(db.Health))
+	t.Cleanup(health.Close)
+	status := func() int {
+		t.Helper()
+		resp, err := http.Get(health.URL + "/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	loaded := make(chan error)
+	go func() { loaded <- db.OpenAOF(path, FsyncNo) }()
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("/health during the load = %d, want 503", got)
+	}
+	close(store.gate)
+	if err := <-loaded; err != nil {
+		t.Fatal(err)
+	}
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("/health before listening = %d, want 503", got)
+	}
+	startServer(t, db)
+	if got := status(); got != http.StatusOK {
+		t.Errorf("/health once listening = %d, want 200", got)
+	}
+	expect(t, db, "$1\r\nv\r\n", "GET", "k")
+	run(db, "SHUTDOWN", "NOSAVE")
+	if got := status(); got != http.StatusServiceUnavailable {
+		t.Errorf("/health after SHUTDOWN = %d, want 503", got)
+	}
+}
+
+func TestHsetOverwriteAndHgetallOrder(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, ":3\r\n", "HSET", "h", "b", "2", "c", "3", "a", "1")
+	expect(t, db, ":0\r\n", "HSET", "h", "a", "one")
+	expect(t, db, ":1\r\n", "HSET", "h", "a", "uno", "d", "4")
+	expect(t, db, "$3\r\nuno\r\n", "HGET", "h", "a")
+	expect(t, db, "$-1\r\n", "HGET", "h", "missing")
+	want := []string{"a", "uno", "b", "2", "c", "3", "d", "4"}
+	for i := 0; i < 5; i++ {
+		if got := replyStrings(t, parseReply(t, run(db, "HGETALL", "h"))); !slices.Equal(got, want) {
+			t.Fatalf("HGETALL h = %q, want %q", got, want)
+		}
+	}
+	expect(t, db, ":2\r\n", "HDEL", "h", "a", "b", "missing")
+	expect(t, db, ":2\r\n", "HDEL", "h", "c", "d")
+	expect(t, db, ":0\r\n", "EXISTS", "h")
+	expect(t, db, "*0\r\n", "HGETALL", "h")
+}
+
+func TestHashReadCommandsAgree(t *testing.T) {
+	db := newTestDatabase(t)
+	for i := 0; i < 20; i++ {
+		run(db, "HSET", "h", fmt.Sprintf("f%d", i), strconv.Itoa(i))
+	}
+	keys := replyStrings(t, parseReply(t, run(db, "HKEYS", "h")))
+	vals := replyStrings(t, parseReply(t, run(db, "HVALS", "h")))
+	expect(t, db, fmt.Sprintf(":%d\r\n", len(keys)), "HLEN", "h")
+	if len(keys) != 20 || len(vals) != 20 {
+		t.Fatalf("HKEYS returned %d fields and HVALS %d values, want 20", len(keys), len(vals))
+	}
+	for i, field := range keys {
+		expect(t, db, bulkString(vals[i]), "HGET", "h", field)
+		expect(t, db, ":1\r\n", "HEXISTS", "h", field)
+	}
+	expect(t, db, ":0\r\n", "HEXISTS", "h", "missing")
+
+	for _, args := range [][]string{{"HKEYS", "nokey"}, {"HVALS", "nokey"}} {
+		expect(t, db, "*0\r\n", args...)
+	}
+	expect(t, db, ":0\r\n", "HLEN", "nokey")
+	expect(t, db, ":0\r\n", "HEXISTS", "nokey", "f0")
+}
+
+func TestDebugSetEncodingPinsObjectEncoding(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "HSET", "h", "f", "v")
+	expect(t, db, "$8\r\nlistpack\r\n", "OBJECT", "ENCODING", "h")
+	expect(t, db, "-ERR DEBUG SET-ENCODING is disabled; start the server with -enable-debug-command\r\n", "DEBUG", "SET-ENCODING", "h", "hashtable")
+
+	db.debugCommands = true
+	expect(t, db, "+OK\r\n", "DEBUG", "SET-ENCODING", "h", "hashtable")
+	expect(t, db, "$9\r\nhashtable\r\n", "OBJECT", "ENCODING", "h")
+	run(db, "HSET", "h", "g", "v")
+	expect(t, db, "$9\r\nhashtable\r\n", "OBJECT", "ENCODING", "h")
+	expect(t, db, "-ERR encoding 'intset' is not valid for a hash\r\n", "DEBUG", "SET-ENCODING", "h", "intset")
+	expect(t, db, "-ERR no such key\r\n", "DEBUG", "SET-ENCODING", "missing", "hashtable")
+
+	// The pin goes with the key.
+	run(db, "DEL", "h")
+	run(db, "HSET", "h", "f", "v")
+	expect(t, db, "$8\r\nlistpack\r\n", "OBJECT", "ENCODING", "h")
+}
+
+func TestListPushPopAndAutoDelete(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, ":3\r\n", "LPUSH", "l", "a", "b", "c")
+	expect(t, db, ":5\r\n", "RPUSH", "l", "d", "e")
+	expect(t, db, "*5\r\n$1\r\nc\r\n$1\r\nb\r\n$1\r\na\r\n$1\r\nd\r\n$1\r\ne\r\n", "LRANGE", "l", "0", "-1")
+	expect(t, db, ":5\r\n", "LLEN", "l")
+	expect(t, db, "$1\r\nc\r\n", "LPOP", "l")
+	expect(t, db, "$1\r\ne\r\n", "RPOP", "l")
+	expect(t, db, "$1\r\nb\r\n", "LPOP", "l")
+	expect(t, db, "$1\r\nd\r\n", "RPOP", "l")
+	expect(t, db, ":1\r\n", "LLEN", "l")
+	expect(t, db, "$1\r\na\r\n", "RPOP", "l")
+	expect(t, db, ":0\r\n", "EXISTS", "l")
+	expect(t, db, ":0\r\n", "LLEN", "l")
+	expect(t, db, "$-1\r\n", "LPOP", "l")
+	expect(t, db, "$-1\r\n", "RPOP", "l")
+	db.mu.RLock()
+	_, stored := db.lists["l"]
+	db.mu.RUnlock()
+	if stored {
+		t.Error("the emptied list is still stored")
+	}
+}
+
+func TestLrangeAndLindex(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "RPUSH", "l", "a", "b", "c", "d")
+	for _, tt := range []struct {
+		start, stop string
+		want        []string
+	}{
+		{"0", "-1", []string{"a", "b", "c", "d"}},
+		{"1", "2", []string{"b", "c"}},
+		{"-2", "-1", []string{"c", "d"}},
+		{"-100", "0", []string{"a"}},
+		{"2", "100", []string{"c", "d"}},
+		{"3", "1", nil},
+		{"4", "10", nil},
+	} {
+		if got := replyStrings(t, parseReply(t, run(db, "LRANGE", "l", tt.start, tt.stop))); !slices.Equal(got, tt.want) {
+			t.Errorf("LRANGE l %s %s = %q, want %q", tt.start, tt.stop, got, tt.want)
+		}
+	}
+	expect(t, db, "*0\r\n", "LRANGE", "missing", "0", "-1")
+
+	expect(t, db, "$1\r\nd\r\n", "LINDEX", "l", "-1")
+	expect(t, db, "$1\r\na\r\n", "LINDEX", "l", "0")
+	expect(t, db, "$1\r\na\r\n", "LINDEX", "l", "-4")
+	expect(t, db, "$-1\r\n", "LINDEX", "l", "4")
+	expect(t, db, "$-1\r\n", "LINDEX", "l", "-5")
+	expect(t, db, "$-1\r\n", "LINDEX", "missing", "0")
+	expect(t, db, "-ERR value is not an integer or out of range\r\n", "LINDEX", "l", "x")
+}
+
+func TestKeyspaceEventsFilterByClass(t *testing.T) {
+	addr := startServer(t, newTestDatabase(t))
+	sub, conn := dial(t, addr), dial(t, addr)
+	if reply := conn.do("CONFIG", "SET", "notify-keyspace-events", "Elg"); reply != "OK" {
+		t.Fatalf("CONFIG SET = %v", reply)
+	}
+	channels := []string{"__keyspace@0__:l", "__keyspace@0__:s", "done"}
+	for _, event := range []string{"set", "append", "incrby", "lpush", "rpop", "del", "expire", "rename_from", "rename_to"} {
+		channels = append(channels, "__keyevent@0__:"+event)
+	}
+	sub.send(append([]string{"SUBSCRIBE"}, channels...)...)
+	for range channels {
+		sub.read()
+	}
+
+	for _, args := range [][]string{
+		{"SET", "s", "1"},
+		{"APPEND", "s", "2"},
+		{"INCR", "s"},
+		{"LPUSH", "l", "a", "b"},
+		{"RPOP", "l"},
+		{"EXPIRE", "l", "100"},
+		{"RENAME", "s", "s2"},
+		{"DEL", "s2"},
+		{"PUBLISH", "done", "."},
+	} {
+		conn.do(args...)
+	}
+	var got []string
+	for {
+		frame := sub.read().([]any)
+		if frame[1] == "done" {
+			break
+		}
+		got = append(got, fmt.Sprintf("%s %s", frame[1], frame[2]))
+	}
+	want := []string{
+		"__keyevent@0__:lpush l",
+		"__keyevent@0__:rpop l",
+		"__keyevent@0__:expire l",
+		"__keyevent@0__:rename_from s",
+		"__keyevent@0__:rename_to s2",
+		"__keyevent@0__:del s2",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("events = %q, want %q", got, want)
+	}
+}
+
+func TestExpiredEventFollowsTheDelete(t *testing.T) {
+	addr := startServer(t, newTestDatabase(t))
+	sub, conn := dial(t, addr), dial(t, addr)
+	if reply := conn.do("CONFIG", "SET", "notify-keyspace-events", "Ex"); reply != "OK" {
+		t.Fatalf("CONFIG SET = %v", reply)
+	}
+	sub.send("SUBSCRIBE", "__keyevent@0__:expired", "done")
+	sub.read()
+	sub.read()
+
+	// Nothing reads k, so the sweeper raises the event.
+	conn.do("SET", "k", "v", "PX", "20")
+	if frame := sub.read().([]any); frame[2] != "k" {
+		t.Fatalf("event = %q", frame)
+	}
+	if reply := conn.do("GET", "k"); reply != nil {
+		t.Errorf("GET k after its expired event = %v, want a miss", reply)
+	}
+	if reply := conn.do("EXISTS", "k"); reply != int64(0) {
+		t.Errorf("EXISTS k = %v", reply)
+	}
+	// The GET found nothing left to expire, so the event is not repeated.
+	conn.do("PUBLISH", "done", ".")
+	if frame := sub.read().([]any); frame[1] != "done" {
+		t.Errorf("got %q, want only one expired event", frame)
+	}
+}
+
+func TestClientKillUnblocksABlockedClient(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	blocked, admin := dial(t, addr), dial(t, addr)
+	id := blocked.do("CLIENT", "ID").(int64)
+	blocked.send("BLMPOP", "0", "1", "l", "LEFT")
+
+	waitFor(t, "the client to block", func() bool {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return len(db.waiters["l"]) == 1
+	})
+	list := admin.do("CLIENT", "LIST", "TYPE", "normal").(string)
+	if !strings.Contains(list, fmt.Sprintf("id=%d ", id)) || !strings.Contains(list, "flags=b") {
+		t.Fatalf("CLIENT LIST does not show client %d blocked:\n%s", id, list)
+	}
+
+	if reply := admin.do("CLIENT", "KILL", "ID", strconv.FormatInt(id, 10)); reply != int64(1) {
+		t.Fatalf("CLIENT KILL = %v", reply)
+	}
+	// The blocked goroutine stops waiting, drops its waiter and closes the
+	// connection.
+	waitFor(t, "the blocked client to exit", func() bool {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return len(db.waiters) == 0 && len(db.conns) == 1
+	})
+	blocked.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := readReply(blocked.r); err == nil {
+		t.Error("the killed connection is still open")
+	}
+	admin.do("RPUSH", "l", "a")
+	if reply := admin.do("LLEN", "l"); reply != int64(1) {
+		t.Errorf("LLEN l = %v, want the pushed element left unpopped", reply)
+	}
+}
+
+func TestSaddDedupesAndSmembersMatchesScard(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, ":1\r\n", "SADD", "s", "a")
+	expect(t, db, ":0\r\n", "SADD", "s", "a")
+	expect(t, db, ":2\r\n", "SADD", "s", "b", "c", "b")
+	members := replyStrings(t, parseReply(t, run(db, "SMEMBERS", "s")))
+	sort.Strings(members)
+	if !slices.Equal(members, []string{"a", "b", "c"}) {
+		t.Fatalf("SMEMBERS s = %q", members)
+	}
+	expect(t, db, fmt.Sprintf(":%d\r\n", len(members)), "SCARD", "s")
+	expect(t, db, ":1\r\n", "SISMEMBER", "s", "a")
+	expect(t, db, ":0\r\n", "SISMEMBER", "s", "z")
+	expect(t, db, ":2\r\n", "SREM", "s", "a", "b", "z")
+	expect(t, db, ":1\r\n", "SREM", "s", "c")
+	expect(t, db, ":0\r\n", "EXISTS", "s")
+	expect(t, db, "*0\r\n", "SMEMBERS", "s")
+	expect(t, db, ":0\r\n", "SCARD", "s")
+	expect(t, db, ":0\r\n", "SISMEMBER", "s", "a")
+}
+
+// sortedReply returns the members of an array reply, sorted.
+func sortedReply(t *testing.T, raw string) []string {
+	t.Helper()
+	members := replyStrings(t, parseReply(t, raw))
+	sort.Strings(members)
+	return members
+}
+
+func TestSetAlgebraAcrossThreeSets(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SADD", "a", "1", "2", "3", "4")
+	run(db, "SADD", "b", "2", "3", "5")
+	run(db, "SADD", "c", "3", "4", "6")
+	run(db, "SADD", "d", "x", "y")
+	for _, tt := range []struct {
+		args []string
+		want []string
+	}{
+		{[]string{"SINTER", "a", "b", "c"}, []string{"3"}},
+		{[]string{"SINTER", "a", "c"}, []string{"3", "4"}},
+		{[]string{"SINTER", "a", "b", "d"}, nil},
+		{[]string{"SINTER", "a", "missing"}, nil},
+		{[]string{"SUNION", "a", "b", "c"}, []string{"1", "2", "3", "4", "5", "6"}},
+		{[]string{"SUNION", "b", "d", "missing"}, []string{"2", "3", "5", "x", "y"}},
+		{[]string{"SDIFF", "a", "b", "c"}, []string{"1"}},
+		{[]string{"SDIFF", "a", "d"}, []string{"1", "2", "3", "4"}},
+		{[]string{"SDIFF", "a", "missing"}, []string{"1", "2", "3", "4"}},
+		{[]string{"SDIFF", "missing", "a"}, nil},
+	} {
+		if got := sortedReply(t, run(db, tt.args...)); !slices.Equal(got, tt.want) {
+			t.Errorf("%q = %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+func TestDebugObjectReportsPerTypeFields(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "string", "v")
+	run(db, "RPUSH", "list", "a", "b", strings.Repeat("x", 9000))
+	run(db, "HSET", "hash", "f", "v", "g", "w")
+	run(db, "SADD", "set", "1", "2", "3")
+	run(db, "ZADD", "zset", "1", "m")
+	for _, tt := range []struct {
+		key    string
+		fields []string
+	}{
+		{"string", []string{"encoding:embstr"}},
+		{"list", []string{"encoding:quicklist", "ql_nodes:2", "ql_avg_node:1.50", "ql_listpack_max:-2", "ql_compressed:0", "ql_uncompressed_size:9008"}},
+		{"hash", []string{"encoding:listpack", "entries:2"}},
+		{"set", []string{"encoding:intset", "entries:3"}},
+		{"zset", []string{"encoding:listpack", "entries:1"}},
+	} {
+		reply, ok := parseReply(t, run(db, "DEBUG", "OBJECT", tt.key)).(string)
+		if !ok {
+			t.Fatalf("DEBUG OBJECT %s did not reply with a status", tt.key)
+		}
+		fields := strings.Fields(reply)
+		for _, want := range append([]string{"refcount:1", "lru_seconds_idle:0"}, tt.fields...) {
+			if !slices.Contains(fields, want) {
+				t.Errorf("DEBUG OBJECT %s = %q, missing %s", tt.key, reply, want)
+			}
+		}
+		if tt.key == "string" && strings.Contains(reply, "entries:") {
+			t.Errorf("DEBUG OBJECT string = %q, want no container fields", reply)
+		}
+	}
+	expect(t, db, "-ERR no such key\r\n", "DEBUG", "OBJECT", "missing")
+}
+
+func TestTypeReportsEachKind(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "s", "v")
+	run(db, "ZADD", "z", "1", "m")
+	run(db, "HSET", "h", "f", "v")
+	run(db, "RPUSH", "l", "e")
+	run(db, "SADD", "set", "m")
+	for key, want := range map[string]string{"s": "string", "z": "zset", "h": "hash", "l": "list", "set": "set", "missing": "none"} {
+		expect(t, db, "+"+want+"\r\n", "TYPE", key)
+	}
+
+	// Commands keep a key in one map, but should one ever be in several,
+	// string wins, then zset, hash, list and set.
+	db.mu.Lock()
+	db.sets["dup"] = map[string]struct{}{"m": {}}
+	db.lists["dup"] = []string{"e"}
+	db.mu.Unlock()
+	expect(t, db, "+list\r\n", "TYPE", "dup")
+	db.mu.Lock()
+	db.hashes["dup"] = map[string]string{"f": "v"}
+	db.mu.Unlock()
+	expect(t, db, "+hash\r\n", "TYPE", "dup")
+	db.mu.Lock()
+	db.sortedSet["dup"] = db.sortedSet["z"]
+	db.mu.Unlock()
+	expect(t, db, "+zset\r\n", "TYPE", "dup")
+	db.mu.Lock()
+	db.data.Set("dup", "v")
+	db.mu.Unlock()
+	expect(t, db, "+string\r\n", "TYPE", "dup")
+}
+
+func TestInlineQuotedValues(t *testing.T) {
+	for _, tc := range []struct {
+		line string
+		want []string
+	}{
+		{`SET k "hello world"` + "\r\n", []string{"SET", "k", "hello world"}},
+		{`SET k "say \"hi\""` + "\r\n", []string{"SET", "k", `say "hi"`}},
+		{`SET k 'it\'s'` + "\r\n", []string{"SET", "k", "it's"}},
+		{`SET k "  padded  "` + "\r\n", []string{"SET", "k", "  padded  "}},
+		{"  SET   k   v  \r\n", []string{"SET", "k", "v"}},
+		{`SET k "a\r\nb"` + "\r\n", []string{"SET", "k", "a\r\nb"}},
+	} {
+		got, ok := splitCommand(tc.line)
+		if !ok || !slices.Equal(got, tc.want) {
+			t.Errorf("splitCommand(%q) = %q, %v, want %q", tc.line, got, ok, tc.want)
+		}
+	}
+	for _, line := range []string{`SET k "open`, `SET k "a"b`} {
+		if _, ok := splitCommand(line); ok {
+			t.Errorf("splitCommand(%q) accepted unbalanced quotes", line)
+		}
+	}
+
+	db := newTestDatabase(t)
+	conn := dial(t, startServer(t, db))
+	if _, err := io.WriteString(conn.conn, "SET k \"  say \\\"hi\\\" there  \"\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	if got := conn.read(); got != "OK" {
+		t.Fatalf("inline SET = %v", got)
+	}
+	if got := conn.do("GET", "k"); got != `  say "hi" there  ` {
+		t.Errorf("GET k = %q", got)
+	}
+}
+
+func TestMatch(t *testing.T) {
+	for _, tc := range []struct {
+		pattern, key string
+		want         bool
+	}{
+		{"h*o", "hello", true},
+		{"h*o", "hell", false},
+		{"h*", "hello", true},
+		{"*", "", true},
+		{"*", "anything at all", true},
+		{"*llo", "hello", true},
+		{"*l*o*", "hello", true},
+		{"a*b*c", "aXbYbZc", true},
+		{"a*b*c", "aXbYbZ", false},
+		{"f??", "foo", true},
+		{"f??", "fo", false},
+		{"f??", "fooo", false},
+		{"[hg]ello", "hello", true},
+		{"[hg]ello", "gello", true},
+		{"[hg]ello", "jello", false},
+		{"[^h]ello", "jello", true},
+		{"[^h]ello", "hello", false},
+		{"[a-c]at", "bat", true},
+		{"[a-c]at", "rat", false},
+		{`h\*o`, "h*o", true},
+		{`h\*o`, "hello", false},
+		{`\?`, "?", true},
+		{`\?`, "x", false},
+		{`[\]]`, "]", true},
+	} {
+		if got := match(tc.pattern, tc.key); got != tc.want {
+			t.Errorf("match(%q, %q) = %v, want %v", tc.pattern, tc.key, got, tc.want)
+		}
+	}
+}
+
+func TestKeysReturnsArray(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, "*0\r\n", "KEYS", "*")
+	for _, key := range []string{"hello", "hallo", "world"} {
+		run(db, "SET", key, "v")
+	}
+	got := replyStrings(t, parseReply(t, run(db, "KEYS", "h*")))
+	sort.Strings(got)
+	if !slices.Equal(got, []string{"hallo", "hello"}) {
+		t.Errorf("KEYS h* = %q", got)
+	}
+	got = replyStrings(t, parseReply(t, run(db, "KEYS", "*")))
+	sort.Strings(got)
+	if !slices.Equal(got, []string{"hallo", "hello", "world"}) {
+		t.Errorf("KEYS * = %q", got)
+	}
+	expect(t, db, "*0\r\n", "KEYS", "nomatch*")
+}
+
+func TestMsetMget(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, "-ERR wrong number of arguments for 'MSET' command\r\n", "MSET", "a", "1", "b")
+	expect(t, db, ":0\r\n", "EXISTS", "a")
+
+	expect(t, db, "+OK\r\n", "MSET", "a", "1", "b", "2")
+	run(db, "SET", "gone", "v", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+	expect(t, db, "*4\r\n$1\r\n2\r\n$-1\r\n$1\r\n1\r\n$-1\r\n", "MGET", "b", "missing", "a", "gone")
+}
+
+func TestSetnxGetset(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, ":1\r\n", "SETNX", "lock", "me")
+	expect(t, db, ":0\r\n", "SETNX", "lock", "you")
+	expect(t, db, "$2\r\nme\r\n", "GET", "lock")
+
+	expect(t, db, "$-1\r\n", "GETSET", "counter", "1")
+	expect(t, db, "$1\r\n1\r\n", "GETSET", "counter", "2")
+	expect(t, db, "$1\r\n2\r\n", "GET", "counter")
+}
+
+func TestAppendStrlen(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, ":0\r\n", "STRLEN", "k")
+	expect(t, db, ":5\r\n", "APPEND", "k", "hello")
+	expect(t, db, ":11\r\n", "APPEND", "k", " world")
+	expect(t, db, ":11\r\n", "STRLEN", "k")
+	expect(t, db, "$11\r\nhello world\r\n", "GET", "k")
+
+	run(db, "EXPIRE", "k", "100")
+	run(db, "APPEND", "k", "!")
+	if ms := pttl(t, db, "k"); ms <= 0 {
+		t.Errorf("APPEND dropped the TTL: PTTL = %d", ms)
+	}
+}
+
+func TestGetrangeSetrange(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "k", "Hello World")
+	expect(t, db, "$5\r\nWorld\r\n", "GETRANGE", "k", "-5", "-1")
+	expect(t, db, "$3\r\nrld\r\n", "GETRANGE", "k", "-3", "100")
+	expect(t, db, "$11\r\nHello World\r\n", "GETRANGE", "k", "-100", "-1")
+	expect(t, db, "$0\r\n\r\n", "GETRANGE", "k", "20", "30")
+	expect(t, db, "$0\r\n\r\n", "GETRANGE", "k", "-1", "-5")
+
+	expect(t, db, ":11\r\n", "SETRANGE", "k", "6", "Redis")
+	expect(t, db, "$11\r\nHello Redis\r\n", "GET", "k")
+	expect(t, db, ":15\r\n", "SETRANGE", "k", "13", "!!")
+	expect(t, db, "$15\r\nHello Redis\x00\x00!!\r\n", "GET", "k")
+	expect(t, db, ":4\r\n", "SETRANGE", "new", "2", "ab")
+	expect(t, db, "$4\r\n\x00\x00ab\r\n", "GET", "new")
+
+	tooLarge := "-ERR string exceeds maximum allowed size (proto-max-bulk-len)\r\n"
+	expect(t, db, tooLarge, "SETRANGE", "k", "9223372036854775807", "x")
+	expect(t, db, tooLarge, "SETRANGE", "k", strconv.Itoa(maxBulkLen), "x")
+	expect(t, db, "$15\r\nHello Redis\x00\x00!!\r\n", "GET", "k")
+}
+
+// scanAll walks SCAN with the given options from cursor 0 to the end,
+// calling between after each batch, and returns every key it was given.
+func scanAll(t *testing.T, db *Database, between func(), options ...string) []string {
+	t.Helper()
+	var seen []string
+	cursor := "0"
+	for calls := 0; ; calls++ {
+		if calls > 100 {
+			t.Fatal("SCAN did not finish")
+		}
+		reply, ok := parseReply(t, run(db, append([]string{"SCAN", cursor}, options...)...)).([]any)
+		if !ok || len(reply) != 2 {
+			t.Fatalf("SCAN %s = %v", cursor, reply)
+		}
+		seen = append(seen, replyStrings(t, reply[1])...)
+		cursor = reply[0].(string)
+		if cursor == "0" {
+			return seen
+		}
+		between()
+	}
+}
+
+func TestScanVisitsEveryKeyOnce(t *testing.T) {
+	db := newTestDatabase(t)
+	var want []string
+	for i := range 9 {
+		key := fmt.Sprintf("key:%d", i)
+		run(db, "SET", key, "v")
+		want = append(want, key)
+	}
+	got := scanAll(t, db, func() {}, "COUNT", "2")
+	if !slices.Equal(got, want) {
+		t.Errorf("SCAN COUNT 2 = %q, want %q", got, want)
+	}
+	expect(t, db, "-ERR invalid cursor\r\n", "SCAN", "not-a-cursor")
+
+	// Deleting keys already returned must not make the scan skip the
+	// ones after them, and keys added mid-scan don't repeat earlier ones.
+	deleted := false
+	got = scanAll(t, db, func() {
+		if !deleted {
+			run(db, "DEL", "key:0", "key:1")
+			run(db, "SET", "key:00", "v")
+			deleted = true
+		}
+	}, "COUNT", "2")
+	counts := map[string]int{}
+	for _, key := range got {
+		counts[key]++
+	}
+	for _, key := range want[2:] {
+		if counts[key] != 1 {
+			t.Errorf("key %s returned %d times, want once: %q", key, counts[key], got)
+		}
+	}
+
+	got = scanAll(t, db, func() {}, "COUNT", "3", "MATCH", "*[13579]")
+	if !slices.Equal(got, []string{"key:3", "key:5", "key:7"}) {
+		t.Errorf("SCAN MATCH = %q", got)
+	}
+}
+
+func TestDbsizeAndFlushdb(t *testing.T) {
+	db := newTestDatabase(t)
+	run(db, "SET", "s", "v")
+	run(db, "HSET", "h", "f", "v")
+	run(db, "RPUSH", "l", "a")
+	run(db, "SADD", "set", "m")
+	run(db, "ZADD", "z", "1", "m")
+	run(db, "SET", "gone", "v", "PX", "1")
+	time.Sleep(5 * time.Millisecond)
+	expect(t, db, ":5\r\n", "DBSIZE")
+
+	expect(t, db, "+OK\r\n", "FLUSHDB")
+	expect(t, db, ":0\r\n", "DBSIZE")
+	expect(t, db, "$-1\r\n", "GET", "s")
+	expect(t, db, ":0\r\n", "EXISTS", "h", "l", "set", "z")
+}
+
+func TestRenameKeepsTTLAndType(t *testing.T) {
+	db := newTestDatabase(t)
+	expect(t, db, "-ERR no such key\r\n", "RENAME", "missing", "dst")
+
+	run(db, "SET", "src", "v", "EX", "100")
+	run(db, "SET", "dst", "old")
+	expect(t, db, "+OK\r\n", "RENAME", "src", "dst")
+	expect(t, db, ":0\r\n", "EXISTS", "src")
+	expect(t, db, "$1\r\nv\r\n", "GET", "dst")
+	if ms := pttl(t, db, "dst"); ms <= 0 || ms > 100000 {
+		t.Errorf("PTTL after RENAME = %d, want the source's TTL", ms)
+	}
+
+	for _, setup := range [][]string{
+		{"HSET", "from", "f", "v"},
+		{"RPUSH", "from", "a"},
+		{"SADD", "from", "m"},
+		{"ZADD", "from", "1", "m"},
+	} {
+		run(db, "DEL", "from", "to")
+		run(db, setup...)
+		typ := run(db, "TYPE", "from")
+		expect(t, db, "+OK\r\n", "RENAME", "from", "to")
+		expect(t, db, typ, "TYPE", "to")
+		expect(t, db, ":0\r\n", "EXISTS", "from")
+	}
+
+	run(db, "SET", "a", "1")
+	run(db, "SET", "b", "2")
+	expect(t, db, ":0\r\n", "RENAMENX", "a", "b")
+	expect(t, db, "$1\r\n1\r\n", "GET", "a")
+	expect(t, db, "$1\r\n2\r\n", "GET", "b")
+	expect(t, db, ":1\r\n", "RENAMENX", "a", "c")
+	expect(t, db, "$1\r\n1\r\n", "GET", "c")
+}
+
+func TestAOFRoundTripWithPexpirePattern(t *testing.T) {
+	path := t.TempDir() + "/appendonly.aof"
+	db := newTestDatabase(t)
+	if err := db.OpenAOF(path, FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	run(db, "SET", "s", "v")
+	run(db, "HSET", "h", "f", "v")
+	run(db, "ZADD", "z", "1", "m")
+	run(db, "SET", "session:1", "a")
+	run(db, "SET", "session:2", "b")
+	run(db, "SET", "old:1", "c")
+	expect(t, db, ":2\r\n", "PEXPIREPATTERN", "session:*", "100000")
+	expect(t, db, ":1\r\n", "PEXPIREPATTERN", "old:*", "-1")
+	// Written after the pattern ran, so replay must leave it without a TTL.
+	run(db, "SET", "session:3", "d")
+	db.aof.close()
+
+	// The pattern is logged as absolute per-key deadlines, so replay
+	// neither restarts the TTL nor matches a different set of keys.
+	logged, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(logged), "PEXPIREPATTERN") || strings.Count(string(logged), "PEXPIREAT") != 3 {
+		t.Errorf("AOF = %q, want a PEXPIREAT per changed key instead of PEXPIREPATTERN", logged)
+	}
+
+	replayed := newTestDatabase(t)
+	if err := replayed.OpenAOF(path, FsyncAlways); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(replayed.aof.close)
+	expect(t, replayed, "$1\r\nv\r\n", "GET", "s")
+	expect(t, replayed, "$1\r\nv\r\n", "HGET", "h", "f")
+	expect(t, replayed, "$1\r\n1\r\n", "ZSCORE", "z", "m")
+	for _, key := range []string{"session:1", "session:2"} {
+		if ms := pttl(t, replayed, key); ms <= 0 || ms > 100000 {
+			t.Errorf("PTTL %s after replay = %d", key, ms)
+		}
+	}
+	expect(t, replayed, ":-1\r\n", "PTTL", "session:3")
+	expect(t, replayed, ":0\r\n", "EXISTS", "old:1")
+}
+
+func TestSnapshotRoundTripKeepsTTLs(t *testing.T) {
+	db := newTestDatabase(t)
+	db.dumpPath = t.TempDir() + "/dump.gob"
+	run(db, "SET", "s", "v", "PX", "100000")
+	run(db, "HSET", "h", "f", "v")
+	run(db, "RPUSH", "l", "a", "b")
+	run(db, "SADD", "set", "m")
+	run(db, "ZADD", "z", "1.5", "m")
+	run(db, "PEXPIRE", "z", "50000")
+	expect(t, db, "+OK\r\n", "SAVE")
+	saved := pttl(t, db, "s")
+
+	restored := newTestDatabase(t)
+	if err := restored.LoadSnapshot(db.dumpPath); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, restored, "$1\r\nv\r\n", "GET", "s")
+	expect(t, restored, "$1\r\nv\r\n", "HGET", "h", "f")
+	expect(t, restored, "*2\r\n$1\r\na\r\n$1\r\nb\r\n", "LRANGE", "l", "0", "-1")
+	expect(t, restored, ":1\r\n", "SISMEMBER", "set", "m")
+	expect(t, restored, "$3\r\n1.5\r\n", "ZSCORE", "z", "m")
+	// Deadlines are absolute, so the remaining TTL has not been reset.
+	if ms := pttl(t, restored, "s"); ms <= 0 || ms > saved {
+		t.Errorf("PTTL s after load = %d, want at most %d", ms, saved)
+	}
+	if ms := pttl(t, restored, "z"); ms <= 0 || ms > 50000 {
+		t.Errorf("PTTL z after load = %d", ms)
+	}
+	expect(t, restored, ":-1\r\n", "PTTL", "h")
+
+	expect(t, db, "+Background saving started\r\n", "BGSAVE")
+	waitFor(t, "BGSAVE to finish", func() bool {
+		return infoField(t, db, "rdb_bgsave_in_progress") == "0"
+	})
+}
+
+func TestDebugReloadIsTransparent(t *testing.T) {
+	db := newTestDatabase(t)
+	db.dumpPath = t.TempDir() + "/dump.gob"
+	run(db, "SET", "s", "v", "PX", "100000")
+	run(db, "SET", "n", "12345")
+	run(db, "SET", "raw", strings.Repeat("x", 100))
+	run(db, "HSET", "h", "f", "v", "g", "w")
+	run(db, "PEXPIRE", "h", "200000")
+	run(db, "RPUSH", "l", "a", "b", "c")
+	run(db, "SADD", "ints", "1", "2", "3")
+	run(db, "SADD", "set", "m", "n")
+	run(db, "PEXPIRE", "set", "300000")
+	run(db, "ZADD", "z", "1.5", "m", "-inf", "low")
+	run(db, "PEXPIRE", "z", "50000")
+
+	// state renders each key's type, value, encoding and TTL.
+	reads := map[string][]string{
+		"string": {"GET"}, "hash": {"HGETALL"}, "list": {"LRANGE", "0", "-1"},
+		"set": {"SMEMBERS"}, "zset": {"ZRANGE", "0", "-1", "WITHSCORES"},
+	}
+	state := func() (map[string]string, map[string]int64) {
+		values, ttls := map[string]string{}, map[string]int64{}
+		for _, key := range []string{"s", "n", "raw", "h", "l", "ints", "set", "z"} {
+			kind := parseReply(t, run(db, "TYPE", key)).(string)
+			value := parseReply(t, run(db, append([]string{reads[kind][0], key}, reads[kind][1:]...)...))
+			if items, ok := value.([]any); ok && kind != "list" && kind != "zset" {
+				slices.SortFunc(items, func(a, b any) int { return strings.Compare(a.(string), b.(string)) })
+			}
+			encoding := parseReply(t, run(db, "OBJECT", "ENCODING", key))
+			values[key] = fmt.Sprintf("%s %v %v", kind, value, encoding)
+			ttls[key] = pttl(t, db, key)
+		}
+		return values, ttls
+	}
+	beforeValues, beforeTTLs := state()
+
+	expect(t, db, "+OK\r\n", "DEBUG", "RELOAD")
+	afterValues, afterTTLs := state()
+	if !maps.Equal(afterValues, beforeValues) {
+		t.Errorf("after DEBUG RELOAD:\n%v\nwant\n%v", afterValues, beforeValues)
+	}
+	for key, before := range beforeTTLs {
+		// Deadlines are absolute: a TTL only runs down across the reload.
+		if after := afterTTLs[key]; before == -1 && after != -1 || before != -1 && (after > before || after < before-1000) {
+			t.Errorf("PTTL %s = %d after DEBUG RELOAD, was %d", key, after, before)
+		}
+	}
+	expect(t, db, ":8\r\n", "DBSIZE")
+	if err := checkConsistency(db); err != nil {
+		t.Error(err)
+	}
+	if _, err := os.Stat(db.dumpPath); err != nil {
+		t.Errorf("DEBUG RELOAD left no snapshot: %v", err)
+	}
+}
+
+func TestListenOnConfiguredAddress(t *testing.T) {
+	first, second := newTestDatabase(t), newTestDatabase(t)
+	var addr string
+	logged := captureStdout(t, func() { addr = startServer(t, first) })
+	if !strings.Contains(logged, "Listening on "+addr) {
+		t.Errorf("listen logged %q, want the bound address %s", logged, addr)
+	}
+	if strings.HasSuffix(addr, ":0") {
+		t.Fatalf("listen reported port 0: %s", addr)
+	}
+
+	// A second instance runs alongside on its own port.
+	other := startServer(t, second)
+	dial(t, addr).do("SET", "k", "first")
+	if got := dial(t, other).do("GET", "k"); got != nil {
+		t.Errorf("second instance GET k = %v, want nil", got)
+	}
+	if _, err := newTestDatabase(t).Listen(addr); err == nil {
+		t.Errorf("listen on %s, already in use, succeeded", addr)
+	}
+}
+
+func TestDuplicateSubscriptionsDeliverOnce(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	sub, pub := dial(t, addr), dial(t, addr)
+	sub.send("SUBSCRIBE", "a", "a")
+	for _, want := range []int64{1, 1} {
+		if frame := sub.read().([]any); frame[0] != "subscribe" || frame[2] != want {
+			t.Fatalf("SUBSCRIBE a a confirmed %v, want count %d", frame, want)
+		}
+	}
+	if got := pub.do("PUBLISH", "a", "hello"); got != int64(1) {
+		t.Errorf("PUBLISH a = %v, want 1 receiver", got)
+	}
+	if frame := fmt.Sprint(sub.read().([]any)...); frame != "messageahello" {
+		t.Errorf("delivery = %q, want the one message", frame)
+	}
+	sub.send("PSUBSCRIBE", "a*", "a*")
+	sub.read()
+	if frame := sub.read().([]any); frame[0] != "psubscribe" || frame[2] != int64(2) {
+		t.Fatalf("PSUBSCRIBE a* a* confirmed %v, want count 2", frame)
+	}
+	// A channel and a matching pattern are two subscriptions, so the
+	// second message arrives once as a message and once as a pmessage.
+	if got := pub.do("PUBLISH", "a", "again"); got != int64(2) {
+		t.Errorf("PUBLISH a = %v, want 2 deliveries", got)
+	}
+	pub.do("PUBLISH", "done", ".")
+	if got := pub.do("PUBLISH", "ab", "pattern only"); got != int64(1) {
+		t.Errorf("PUBLISH ab = %v, want 1 delivery", got)
+	}
+
+	var got []string
+	for len(got) < 3 {
+		got = append(got, fmt.Sprint(sub.read().([]any)...))
+	}
+	want := []string{"messageaagain", "pmessagea*aagain", "pmessagea*abpattern only"}
+	if !slices.Equal(got, want) {
+		t.Errorf("deliveries = %q, want %q", got, want)
+	}
+	if got := infoField(t, db, "pubsub_patterns"); got != "1" {
+		t.Errorf("pubsub_patterns = %s, want 1", got)
+	}
+
+	sub.send("PUNSUBSCRIBE")
+	if frame := sub.read().([]any); frame[0] != "punsubscribe" || frame[1] != "a*" || frame[2] != int64(1) {
+		t.Errorf("PUNSUBSCRIBE = %v", frame)
+	}
+	if got := infoField(t, db, "pubsub_patterns"); got != "0" {
+		t.Errorf("pubsub_patterns = %s after PUNSUBSCRIBE, want 0", got)
+	}
+}
+
+// publishToStalled publishes n large messages on ch while a subscriber
+// that never reads is subscribed, failing if the publisher is held up.
+func publishToStalled(t *testing.T, pub *testConn, n int) {
+	t.Helper()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			pub.send("PUBLISH", "ch", fmt.Sprintf("%04d%s", i, strings.Repeat("m", 16<<10)))
+		}
+		for i := 0; i < n; i++ {
+			pub.read()
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatal("the publisher was blocked by a stalled subscriber")
+	}
+}
+
+func TestStalledSubscriberIsDisconnected(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	stalled, pub := dial(t, addr), dial(t, addr)
+	expect(t, db, "+OK\r\n", "CONFIG", "SET", "pubsub-queue-limit", "8")
+	stalled.do("SUBSCRIBE", "ch")
+
+	publishToStalled(t, pub, 1000)
+	waitFor(t, "the stalled subscriber to be disconnected", func() bool {
+		db.mu.RLock()
+		defer db.mu.RUnlock()
+		return len(db.conns) == 1 && len(db.channels) == 0
+	})
+}
+
+func TestStalledSubscriberDropsOldestMessages(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	stalled, pub := dial(t, addr), dial(t, addr)
+	expect(t, db, "+OK\r\n", "CONFIG", "SET", "pubsub-queue-limit", "8")
+	expect(t, db, "+OK\r\n", "CONFIG", "SET", "pubsub-overflow-policy", "drop-oldest")
+	expect(t, db, "-ERR CONFIG SET failed (possibly related to argument 'pubsub-overflow-policy') - argument must be disconnect or drop-oldest\r\n",
+		"CONFIG", "SET", "pubsub-overflow-policy", "block")
+	stalled.do("SUBSCRIBE", "ch")
+
+	const n = 1000
+	publishToStalled(t, pub, n)
+	// The subscriber is still connected and, once it reads again, gets the
+	// newest messages in order with the oldest queued ones gone.
+	received, last := 0, -1
+	for last != n-1 {
+		frame := stalled.read().([]any)
+		i, err := strconv.Atoi(frame[2].(string)[:4])
+		if err != nil || i <= last {
+			t.Fatalf("message %v after %d", frame[2].(string)[:4], last)
+		}
+		received, last = received+1, i
+	}
+	if received >= n {
+		t.Errorf("received all %d messages, want the oldest dropped", n)
+	}
+	if got := pub.do("PUBLISH", "ch", "still here"); got != int64(1) {
+		t.Errorf("PUBLISH after the overflow = %v, want 1 subscriber", got)
+	}
+}
+
+func TestConcurrentPublishesDeliverEachMessageOnce(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	byChannel, byPattern, churn := dial(t, addr), dial(t, addr), dial(t, addr)
+	byChannel.do("SUBSCRIBE", "ch")
+	byPattern.do("PSUBSCRIBE", "c*")
+
+	const publishers, perPublisher = 4, 200
+	var wg sync.WaitGroup
+	for p := 0; p < publishers; p++ {
+		pub := dial(t, addr)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < perPublisher; i++ {
+				pub.send("PUBLISH", "ch", fmt.Sprintf("%d-%d", p, i))
+			}
+			for i := 0; i < perPublisher; i++ {
+				if n := pub.read().(int64); n < 2 {
+					t.Errorf("PUBLISH reached %d subscribers, want at least 2", n)
+				}
+			}
+		}()
+	}
+	// Subscriber lists change under the publishers' feet.
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			churn.do("SUBSCRIBE", "ch")
+			churn.do("UNSUBSCRIBE", "ch")
+		}
+	}()
+
+	for _, sub := range []*testConn{byChannel, byPattern} {
+		next := make([]int, publishers)
+		for range publishers * perPublisher {
+			frame := sub.read().([]any)
+			var p, i int
+			fmt.Sscanf(frame[len(frame)-1].(string), "%d-%d", &p, &i)
+			// Each publisher's messages arrive once each and in order.
+			if i != next[p] {
+				t.Fatalf("message %d-%d, want %d-%d", p, i, p, next[p])
+			}
+			next[p]++
+		}
+	}
+	wg.Wait()
+	churn.do("PUBLISH", "ch", "end")
+	for _, sub := range []*testConn{byChannel, byPattern} {
+		if frame := sub.read().([]any); frame[len(frame)-1] != "end" {
+			t.Errorf("got %q after every message, want end", frame)
+		}
+	}
+}
+
+// BenchmarkPublishManySubscribers times PUBLISH to a thousand subscribers
+// from parallel publishers.
+func BenchmarkPublishManySubscribers(b *testing.B) {
+	db := newTestDatabase(b)
+	db.pubsubQueueLimit = 16
+	db.pubsubOverflow = overflowDropOldest
+	for i := 0; i < 1000; i++ {
+		c := &client{id: int64(i), wake: make(chan struct{}, 1), killed: make(chan struct{})}
+		db.handleCommand(c, []string{"SUBSCRIBE", "ch"})
+	}
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if got := run(db, "PUBLISH", "ch", "m"); got != ":1000\r\n" {
+				b.Fatalf("PUBLISH = %q", got)
+			}
+		}
+	})
+}
+
+func TestResetClearsConnectionState(t *testing.T) {
+	db := newTestDatabase(t)
+	addr := startServer(t, db)
+	conn, pub := dial(t, addr), dial(t, addr)
+	conn.do("CLIENT", "SETNAME", "worker")
+	conn.do("SUBSCRIBE", "a")
+	conn.do("PSUBSCRIBE", "b*")
+	if got := conn.do("GET", "k"); got == nil {
+		t.Fatal("GET ran while subscribed")
+	}
+
+	if got := conn.do("RESET"); got != "RESET" {
+		t.Fatalf("RESET = %v", got)
+	}
+	if got := conn.do("CLIENT", "GETNAME"); got != nil {
+		t.Errorf("CLIENT GETNAME after RESET = %v, want nil", got)
+	}
+	if got := pub.do("PUBLISH", "a", "m"); got != int64(0) {
+		t.Errorf("PUBLISH a after RESET = %v, want no subscribers", got)
+	}
+	if got := pub.do("PUBLISH", "bb", "m"); got != int64(0) {
+		t.Errorf("PUBLISH bb after RESET = %v, want no subscribers", got)
+	}
+	if got := infoField(t, db, "pubsub_channels") + infoField(t, db, "pubsub_patterns"); got != "00" {
+		t.Errorf("pubsub_channels and pubsub_patterns = %s, want 0 and 0", got)
+	}
+	// Out of subscribed mode, ordinary commands run again.
+	if got := conn.do("SET", "k", "v"); got != "OK" {
+		t.Errorf("SET after RESET = %v", got)
+	}
+	if info := conn.do("CLIENT", "INFO").(string); !strings.Contains(info, " name= ") || !strings.Contains(info, " sub=0 psub=0 ") {
+		t.Errorf("CLIENT INFO after RESET = %q", info)
+	}
+}
+
+func TestSnapshotLoadsOlderAndNewerFormats(t *testing.T) {
+	dir := t.TempDir()
+	write := func(name, header string, value any) string {
+		t.Helper()
+		path := dir + "/" + name
+		var buf bytes.Buffer
+		buf.WriteString(header)
+		if err := gob.NewEncoder(&buf).Encode(value); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	// A version 1 dump has no header, and one written by a string-only
+	// build has none of the other types.
+	deadline := time.Now().Add(time.Hour).UnixMilli()
+	v1 := write("v1.gob", "", struct {
+		Strings map[string]string
+		Expiry  map[string]int64
+	}{map[string]string{"a": "1", "b": "2"}, map[string]int64{"a": deadline}})
+	db := newTestDatabase(t)
+	if err := db.LoadSnapshot(v1); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, db, ":2\r\n", "DBSIZE")
+	expect(t, db, "$1\r\n2\r\n", "GET", "b")
+	if ms := pttl(t, db, "a"); ms <= 0 || ms > time.Hour.Milliseconds() {
+		t.Errorf("PTTL a = %d", ms)
+	}
+	if err := checkConsistency(db); err != nil {
+		t.Error(err)
+	}
+
+	// Records this build does not know are skipped.
+	newer := write("extra.gob", fmt.Sprintf("%s%04d", snapshotMagic, snapshotVersion), struct {
+		Strings map[string]string
+		Streams map[string][]string
+	}{map[string]string{"s": "v"}, map[string][]string{"events": {"1-0"}}})
+	db = newTestDatabase(t)
+	if err := db.LoadSnapshot(newer); err != nil {
+		t.Fatal(err)
+	}
+	expect(t, db, ":1\r\n", "DBSIZE")
+
+	// A format version from the future is refused rather than misread.
+	future := write("future.gob", fmt.Sprintf("%s%04d", snapshotMagic, snapshotVersion+1), snapshot{})
+	if err := newTestDatabase(t).LoadSnapshot(future); err == nil || !strings.Contains(err.Error(), "newer than this build") {
+		t.Errorf("loading a future version: %v", err)
+	}
+
+	// What SAVE writes carries the current header.
+	db.dumpPath = dir + "/dump.gob"
+	expect(t, db, "+OK\r\n", "SAVE")
+	saved, err := os.ReadFile(db.dumpPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("%s%04d", snapshotMagic, snapshotVersion); !bytes.HasPrefix(saved, []byte(want)) {
+		t.Errorf("snapshot starts %q, want %q", saved[:len(want)], want)
+	}
+}
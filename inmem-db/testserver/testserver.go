@@ -0,0 +1,56 @@
+// Package testserver starts a throwaway inmem-db server for tests, so
+// programs that talk to it can be tested against the real thing.
+package testserver
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"inmem-db/m/server"
+)
+
+// Options configure a test server. The zero value uses the real clock.
+type Options struct {
+	// Now, if set, is the clock key expiry and TTLs are measured against,
+	// so a test can move time forward instead of sleeping. It is called
+	// from the server's goroutines, so it must be safe for concurrent use.
+	Now func() time.Time
+}
+
+// Start starts a server on an ephemeral port of 127.0.0.1 and returns its
+// address and a function that shuts it down. The server is also shut down
+// when the test ends, so calling shutdown is only needed to stop it
+// earlier.
+//
+// The expiry sweeper and save points are off, so nothing changes behind
+// the test's back: an expired key is removed when it is next read, and
+// nothing is saved unless the test sends SAVE or BGSAVE.
+func Start(tb testing.TB, opts Options) (addr string, shutdown func()) {
+	tb.Helper()
+	db := server.NewDatabase()
+	// Close stops the background work; commands keep working without it.
+	db.Close()
+	if opts.Now != nil {
+		db.SetClock(opts.Now)
+	}
+	db.SetDumpPath(tb.TempDir() + "/dump.gob")
+	listener, err := db.Listen("127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		db.Serve(listener)
+	}()
+	var once sync.Once
+	shutdown = func() {
+		once.Do(func() {
+			db.Shutdown()
+			<-done
+		})
+	}
+	tb.Cleanup(shutdown)
+	return listener.Addr().String(), shutdown
+}
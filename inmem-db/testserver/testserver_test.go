@@ -0,0 +1,67 @@
+package testserver_test
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"inmem-db/m/testserver"
+)
+
+// do sends one command as a RESP array and returns the first line of the
+// reply, with bulk strings unwrapped to their value.
+func do(t *testing.T, r *bufio.Reader, conn net.Conn, args ...string) string {
+	t.Helper()
+	request := fmt.Sprintf("*%d\r\n", len(args))
+	for _, arg := range args {
+		request += fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)
+	}
+	if _, err := conn.Write([]byte(request)); err != nil {
+		t.Fatal(err)
+	}
+	line, err := r.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.HasPrefix(line, "$") && line != "$-1\r\n" {
+		if line, err = r.ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return strings.TrimSuffix(line, "\r\n")
+}
+
+func TestSetGetRoundTrip(t *testing.T) {
+	// The server reads the clock from its own goroutines.
+	start, elapsed := time.Now(), atomic.Int64{}
+	addr, shutdown := testserver.Start(t, testserver.Options{
+		Now: func() time.Time { return start.Add(time.Duration(elapsed.Load())) },
+	})
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	if got := do(t, r, conn, "SET", "greeting", "hello", "EX", "60"); got != "+OK" {
+		t.Fatalf("SET = %q", got)
+	}
+	if got := do(t, r, conn, "GET", "greeting"); got != "hello" {
+		t.Errorf("GET = %q, want hello", got)
+	}
+	// The injected clock moves the key past its TTL without sleeping.
+	elapsed.Store(int64(time.Minute + time.Millisecond))
+	if got := do(t, r, conn, "GET", "greeting"); got != "$-1" {
+		t.Errorf("GET after the TTL = %q, want a miss", got)
+	}
+
+	shutdown()
+	if _, err := net.Dial("tcp", addr); err == nil {
+		t.Error("dialled the server after shutdown")
+	}
+}